@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+type aggregateCommand struct {
+	ListenAddr    string        `short:"l" long:"listen-addr" description:"listen address for the aggregated metrics" default:":2112" env:"DHT_LISTEN_ADDR"`
+	Peers         []string      `long:"peer" description:"metrics URL of a peer exporter, e.g. http://attic-pi:2112/metrics (can be repeated)" env:"DHT_AGGREGATE_PEERS" env-delim:","`
+	ScrapeTimeout time.Duration `long:"scrape-timeout" description:"timeout of a single peer scrape" default:"5s" env:"DHT_AGGREGATE_SCRAPE_TIMEOUT"`
+	WriteTimeout  time.Duration `long:"http-write-timeout" description:"maximum duration before timing out writes of the response" default:"30s" env:"DHT_HTTP_WRITE_TIMEOUT"`
+	InfoMetric    string        `long:"peer-info-metric" description:"full name of the sensor info metric of the peers the sensor locations are taken from, defaults to the one of --metrics-namespace and --metric-name, e.g. dht_sensor_info" env:"DHT_AGGREGATE_PEER_INFO_METRIC"`
+}
+
+func (c *aggregateCommand) Execute(_ []string) error {
+	if len(c.Peers) == 0 {
+		return errors.New("at least one --peer is required")
+	}
+	if c.WriteTimeout > 0 && c.ScrapeTimeout >= c.WriteTimeout {
+		return errors.New("--scrape-timeout must be lower than --http-write-timeout")
+	}
+	if len(c.InfoMetric) > 0 && !model.IsValidMetricName(model.LabelValue(c.InfoMetric)) {
+		return fmt.Errorf("invalid --peer-info-metric %q", c.InfoMetric)
+	}
+	if _, ok := opts.Metrics.Labels["instance"]; ok {
+		return errors.New("label \"instance\" is set to the peer by the aggregate command")
+	}
+	var peers []*aggregatePeer
+	for _, peer := range c.Peers {
+		u, err := url.Parse(peer)
+		if err != nil || len(u.Host) == 0 {
+			return fmt.Errorf("invalid --peer %q, expected a URL like http://host:2112/metrics", peer)
+		}
+		peers = append(peers, &aggregatePeer{url: u.String(), instance: u.Host})
+	}
+
+	// the constant labels are set by the collector, wrapping it would fail the
+	// gather with a duplicate label for peers exporting one of them
+	infoMetric := c.InfoMetric
+	if len(infoMetric) == 0 {
+		infoMetric = fullMetricName("sensor_info")
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(newAggregateCollector(peers, c.ScrapeTimeout, infoMetric, opts.Metrics.Labels))
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{
+		ErrorLog: slog.NewLogLogger(log.Handler(), slog.LevelError),
+		// a peer can report series the others don't, serve what was collected
+		ErrorHandling: promhttp.ContinueOnError,
+	}))
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+		WriteTimeout:      c.WriteTimeout,
+		ErrorLog:          slog.NewLogLogger(log.Handler(), slog.LevelWarn),
+	}
+	listener, err := net.Listen("tcp", c.ListenAddr)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	go func() {
+		log.Info("Starting HTTP server", "addr", c.ListenAddr, "peers", len(peers))
+		if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			log.Error("HTTP server error", "err", err)
+			os.Exit(1)
+		}
+		log.Info("Stopped serving new connections")
+	}()
+
+	<-ctx.Done()
+	shutdownCtx, shutdownRelease := context.WithTimeout(context.Background(), c.ScrapeTimeout+5*time.Second)
+	defer shutdownRelease()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("HTTP shutdown error: %v", err)
+	}
+	return nil
+}
+
+// aggregatePeer is an exporter scraped by the aggregate command.
+type aggregatePeer struct {
+	url string
+	// instance is the value of the instance label added to the peer series
+	instance string
+}
+
+// aggregateCollector scrapes all peers on every collection and re-exports
+// their series with an instance label. Series labeled by sensor also get the
+// location of the sensor from the peer sensor info metric. The constant labels
+// override the labels of the peer series with the same name.
+type aggregateCollector struct {
+	client      *http.Client
+	peers       []*aggregatePeer
+	constLabels prometheus.Labels
+	// infoMetric is the full name of the sensor info metric of the peers
+	infoMetric string
+
+	up             *prometheus.Desc
+	scrapeDuration *prometheus.Desc
+}
+
+func newAggregateCollector(peers []*aggregatePeer, timeout time.Duration, infoMetric string, constLabels map[string]string) *aggregateCollector {
+	return &aggregateCollector{
+		client:      &http.Client{Timeout: timeout},
+		peers:       peers,
+		constLabels: constLabels,
+		infoMetric:  infoMetric,
+		up: prometheus.NewDesc(
+			fullMetricName("aggregate_peer_up"),
+			"Whether the last scrape of the peer exporter was successful",
+			[]string{"instance"}, constLabels),
+		scrapeDuration: prometheus.NewDesc(
+			fullMetricName("aggregate_peer_scrape_duration_seconds"),
+			"Duration of the last scrape of the peer exporter",
+			[]string{"instance"}, constLabels),
+	}
+}
+
+// Describe sends no descriptors, the peer series are only known after a
+// scrape, which makes this an unchecked collector.
+func (c *aggregateCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (c *aggregateCollector) Collect(ch chan<- prometheus.Metric) {
+	type result struct {
+		peer     *aggregatePeer
+		families map[string]*dto.MetricFamily
+		duration time.Duration
+		err      error
+	}
+	results := make([]result, len(c.peers))
+	var wg sync.WaitGroup
+	for i, peer := range c.peers {
+		wg.Add(1)
+		go func(i int, peer *aggregatePeer) {
+			defer wg.Done()
+			start := time.Now()
+			families, err := c.scrape(peer)
+			results[i] = result{peer: peer, families: families, duration: time.Since(start), err: err}
+		}(i, peer)
+	}
+	wg.Wait()
+
+	// peers running different versions may disagree on the help text, which
+	// must be the same within a family
+	help := map[string]string{}
+	for _, r := range results {
+		up := 1.0
+		if r.err != nil {
+			log.Warn("Unable to scrape peer", "instance", r.peer.instance, "url", r.peer.url, "err", r.err)
+			up = 0
+		}
+		ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, up, r.peer.instance)
+		ch <- prometheus.MustNewConstMetric(c.scrapeDuration, prometheus.GaugeValue, r.duration.Seconds(), r.peer.instance)
+		if r.err != nil {
+			continue
+		}
+		locations := sensorLocationsOf(r.families[c.infoMetric])
+		for name, family := range r.families {
+			if _, ok := help[name]; !ok {
+				help[name] = family.GetHelp()
+			}
+			for _, metric := range family.GetMetric() {
+				m, err := aggregateMetric(name, help[name], family.GetType(), metric, r.peer.instance, locations, c.constLabels)
+				if err != nil {
+					log.Warn("Unable to re-export peer series", "instance", r.peer.instance, "metric", name, "err", err)
+					continue
+				}
+				ch <- m
+			}
+		}
+	}
+}
+
+func (c *aggregateCollector) scrape(peer *aggregatePeer) (map[string]*dto.MetricFamily, error) {
+	req, err := http.NewRequest(http.MethodGet, peer.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", string(expfmt.FmtText))
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var parser expfmt.TextParser
+	return parser.TextToMetricFamilies(resp.Body)
+}
+
+// sensorLocationsOf maps the sensor names, see sensorKey, to their locations
+// using the sensor info metric family of a peer, which is nil when the peer
+// doesn't export it.
+func sensorLocationsOf(family *dto.MetricFamily) map[string]string {
+	locations := map[string]string{}
+	for _, metric := range family.GetMetric() {
+		var sensor, origin, location string
+		for _, label := range metric.GetLabel() {
+			switch label.GetName() {
+			case "sensor":
+				sensor = label.GetValue()
+			case "origin":
+				origin = label.GetValue()
+			case "location":
+				location = label.GetValue()
+			}
+		}
+		if len(sensor) > 0 && len(location) > 0 {
+			locations[sensorKey(sensor, origin)] = location
+		}
+	}
+	return locations
+}
+
+// aggregateMetric converts a scraped series into a constant metric with the
+// instance and location labels added and the constant labels set.
+func aggregateMetric(name, help string, metricType dto.MetricType, metric *dto.Metric, instance string, locations map[string]string, constLabels map[string]string) (prometheus.Metric, error) {
+	labels := prometheus.Labels{}
+	for _, label := range metric.GetLabel() {
+		labels[label.GetName()] = label.GetValue()
+	}
+	// keep the labels set by the peer itself
+	if _, ok := labels["instance"]; !ok {
+		labels["instance"] = instance
+	}
+	if location, ok := locations[sensorKey(labels["sensor"], labels["origin"])]; ok {
+		if _, ok := labels["location"]; !ok {
+			labels["location"] = location
+		}
+	}
+	for labelName, value := range constLabels {
+		labels[labelName] = value
+	}
+	var names, values []string
+	for labelName, value := range labels {
+		names = append(names, labelName)
+		values = append(values, value)
+	}
+	desc := prometheus.NewDesc(name, help, names, nil)
+
+	switch metricType {
+	case dto.MetricType_COUNTER:
+		return prometheus.NewConstMetric(desc, prometheus.CounterValue, metric.GetCounter().GetValue(), values...)
+	case dto.MetricType_GAUGE:
+		return prometheus.NewConstMetric(desc, prometheus.GaugeValue, metric.GetGauge().GetValue(), values...)
+	case dto.MetricType_UNTYPED:
+		return prometheus.NewConstMetric(desc, prometheus.UntypedValue, metric.GetUntyped().GetValue(), values...)
+	case dto.MetricType_SUMMARY:
+		summary := metric.GetSummary()
+		quantiles := map[float64]float64{}
+		for _, q := range summary.GetQuantile() {
+			quantiles[q.GetQuantile()] = q.GetValue()
+		}
+		return prometheus.NewConstSummary(desc, summary.GetSampleCount(), summary.GetSampleSum(), quantiles, values...)
+	case dto.MetricType_HISTOGRAM:
+		histogram := metric.GetHistogram()
+		buckets := map[float64]uint64{}
+		for _, b := range histogram.GetBucket() {
+			buckets[b.GetUpperBound()] = b.GetCumulativeCount()
+		}
+		return prometheus.NewConstHistogram(desc, histogram.GetSampleCount(), histogram.GetSampleSum(), buckets, values...)
+	default:
+		return nil, fmt.Errorf("unsupported metric type %s", metricType)
+	}
+}
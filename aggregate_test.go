@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestAggregateCollectorLabels(t *testing.T) {
+	tests := []struct {
+		name string
+		// infoMetric is the sensor info metric of the peer, the aggregator is
+		// configured with it
+		infoMetric string
+		// other is a family the peer exports besides the sensor info
+		other string
+	}{
+		{name: "default", infoMetric: "dht_sensor_info"},
+		{name: "renamed peer", infoMetric: "home_dht_info"},
+		{name: "family with the same suffix", infoMetric: "dht_sensor_info", other: "other_sensor_info"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				fmt.Fprintf(w, "# TYPE %s gauge\n", tt.infoMetric)
+				fmt.Fprintf(w, "%s{sensor=\"attic\",location=\"roof\",site=\"home\"} 1\n", tt.infoMetric)
+				fmt.Fprintf(w, "%s{sensor=\"attic\",origin=\"shed\",location=\"garden\"} 1\n", tt.infoMetric)
+				if len(tt.other) > 0 {
+					// an unrelated family doesn't set any location
+					fmt.Fprintf(w, "# TYPE %s gauge\n", tt.other)
+					fmt.Fprintf(w, "%s{sensor=\"attic\",location=\"basement\"} 1\n", tt.other)
+					fmt.Fprintf(w, "%s{sensor=\"cellar\",location=\"basement\"} 1\n", tt.other)
+				}
+				fmt.Fprintln(w, `# TYPE dht_last_temperature gauge`)
+				fmt.Fprintln(w, `dht_last_temperature{sensor="attic",site="home"} 21.5`)
+				fmt.Fprintln(w, `dht_last_temperature{sensor="cellar",instance="cellar-pi"} 12`)
+				fmt.Fprintln(w, `dht_last_temperature{sensor="attic",origin="shed"} 18`)
+			}))
+			defer peer.Close()
+			u, _ := url.Parse(peer.URL)
+
+			registry := prometheus.NewRegistry()
+			registry.MustRegister(newAggregateCollector([]*aggregatePeer{{url: peer.URL, instance: u.Host}}, time.Second, tt.infoMetric, map[string]string{"site": "lab"}))
+			families, err := registry.Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]map[string]string{
+				"attic":  {"instance": u.Host, "location": "roof", "site": "lab"},
+				"cellar": {"instance": "cellar-pi", "site": "lab"},
+				// the pushed sensors have their own locations
+				"shed/attic": {"instance": u.Host, "location": "garden", "origin": "shed", "site": "lab"},
+			}
+			found := 0
+			for _, family := range families {
+				if family.GetName() != "dht_last_temperature" {
+					continue
+				}
+				for _, metric := range family.GetMetric() {
+					labels := map[string]string{}
+					for _, label := range metric.GetLabel() {
+						labels[label.GetName()] = label.GetValue()
+					}
+					sensor := sensorKey(labels["sensor"], labels["origin"])
+					delete(labels, "sensor")
+					if fmt.Sprint(labels) != fmt.Sprint(want[sensor]) {
+						t.Errorf("labels of %s = %v, want %v", sensor, labels, want[sensor])
+					}
+					found++
+				}
+			}
+			if found != len(want) {
+				t.Errorf("found %d series, want %d", found, len(want))
+			}
+		})
+	}
+}
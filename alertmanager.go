@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// alertmanagerAlert is an alert of the Alertmanager v2 API.
+type alertmanagerAlert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	StartsAt    time.Time         `json:"startsAt"`
+	EndsAt      time.Time         `json:"endsAt"`
+}
+
+// alertmanagerKey identifies the alert of a threshold of a sensor.
+type alertmanagerKey struct {
+	sensor, threshold string
+}
+
+// alertmanagerNotifier sends the threshold breaches as alerts to Alertmanager.
+// Firing alerts are resent periodically with an end a few resends ahead, like
+// Prometheus does, so Alertmanager resolves them on its own when the exporter
+// goes away. Resolved alerts are sent once with the time they resolved, the
+// alerts of a sensor that fails or whose values expired are resolved as well.
+type alertmanagerNotifier struct {
+	client  *http.Client
+	urls    []string
+	headers map[string]string
+	resend  time.Duration
+	labels  map[string]string
+
+	mu sync.Mutex
+	// firing and resolved are the alerts by the sensor and threshold, resolved
+	// ones are kept until they are delivered
+	firing   map[alertmanagerKey]*alertmanagerAlert
+	resolved map[alertmanagerKey]*alertmanagerAlert
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+
+	notifications prometheus.Counter
+	failures      prometheus.Counter
+}
+
+func (c *serveCommand) newAlertmanagerNotifier(reg prometheus.Registerer) (*alertmanagerNotifier, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get hostname: %v", err)
+	}
+	labels := map[string]string{"instance": hostname}
+	for name, value := range opts.Metrics.Labels {
+		labels[name] = value
+	}
+	var urls []string
+	for _, u := range c.AlertmanagerURLs {
+		urls = append(urls, strings.TrimSuffix(u, "/")+"/api/v2/alerts")
+	}
+	factory := promauto.With(reg)
+	n := &alertmanagerNotifier{
+		client:   &http.Client{Timeout: c.AlertmanagerTimeout},
+		urls:     urls,
+		headers:  c.AlertmanagerHeaders,
+		resend:   c.AlertmanagerResend,
+		labels:   labels,
+		firing:   map[alertmanagerKey]*alertmanagerAlert{},
+		resolved: map[alertmanagerKey]*alertmanagerAlert{},
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		notifications: factory.NewCounter(prometheus.CounterOpts{
+			Namespace: opts.Metrics.Namespace,
+			Name:      metricName(opts.Metrics.Names, "alertmanager_notifications_total"),
+			Help:      "Number of alert batches sent to Alertmanager",
+		}),
+		failures: factory.NewCounter(prometheus.CounterOpts{
+			Namespace: opts.Metrics.Namespace,
+			Name:      metricName(opts.Metrics.Names, "alertmanager_notification_failures_total"),
+			Help:      "Number of alert batches that couldn't be sent to Alertmanager",
+		}),
+	}
+	go n.run()
+	return n, nil
+}
+
+// observe updates the alert of the threshold with a checked reading.
+func (n *alertmanagerNotifier) observe(r *reading, t *threshold, breached bool) {
+	sensor, value := r.Sensor, thresholdValues[t.value](r)
+	key := alertmanagerKey{sensor: sensor, threshold: t.name}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	alert, firing := n.firing[key]
+	switch {
+	case breached && !firing:
+		// the constant labels can't change the identity or the routing of
+		// the alert
+		labels := map[string]string{}
+		for name, value := range n.labels {
+			labels[name] = value
+		}
+		labels["alertname"] = "DHTThresholdBreached"
+		values := sensorLabels(sensor)
+		labels["sensor"] = values[0]
+		if len(values[1]) > 0 {
+			labels["origin"] = values[1]
+		}
+		labels["threshold"] = t.name
+		labels["severity"] = t.severity
+		// the readings of all kinds of sensors have their location
+		if len(r.Location) > 0 {
+			labels["location"] = r.Location
+		}
+		alert = &alertmanagerAlert{Labels: labels, StartsAt: time.Now()}
+		n.firing[key] = alert
+		delete(n.resolved, key)
+		n.notify()
+	case !breached && firing:
+		alert.EndsAt = time.Now()
+		delete(n.firing, key)
+		n.resolved[key] = alert
+		n.notify()
+	case !breached:
+		return
+	}
+	alert.Annotations = map[string]string{
+		"summary":     fmt.Sprintf("%s of sensor %s is %.1f, expected %s", t.value, sensor, value, t),
+		"description": fmt.Sprintf("The %s of sensor %s is outside of the range of threshold %s.", t.value, sensor, t.name),
+		"value":       fmt.Sprintf("%g", value),
+	}
+}
+
+// resolveSensor resolves the firing alerts of the sensor, e.g. when it fails,
+// so they don't stay active in Alertmanager until they expire.
+func (n *alertmanagerNotifier) resolveSensor(sensor string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := time.Now()
+	for key, alert := range n.firing {
+		if key.sensor != sensor {
+			continue
+		}
+		alert.EndsAt = now
+		delete(n.firing, key)
+		n.resolved[key] = alert
+		n.notify()
+	}
+}
+
+func (n *alertmanagerNotifier) notify() {
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (n *alertmanagerNotifier) run() {
+	defer close(n.done)
+	ticker := time.NewTicker(n.resend)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-n.wake:
+		case <-ticker.C:
+		}
+		n.send(context.Background())
+	}
+}
+
+// send posts the firing alerts and the undelivered resolved ones to all the
+// Alertmanagers. The resolved alerts are dropped once any of them got them.
+func (n *alertmanagerNotifier) send(ctx context.Context) error {
+	n.mu.Lock()
+	var alerts []alertmanagerAlert
+	endsAt := time.Now().Add(4 * n.resend)
+	for _, alert := range n.firing {
+		a := *alert
+		a.EndsAt = endsAt
+		alerts = append(alerts, a)
+	}
+	resolved := map[alertmanagerKey]*alertmanagerAlert{}
+	for key, alert := range n.resolved {
+		alerts = append(alerts, *alert)
+		resolved[key] = alert
+	}
+	n.mu.Unlock()
+	if len(alerts) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	delivered := false
+	for _, url := range n.urls {
+		if err := n.post(ctx, url, body); err != nil {
+			n.failures.Inc()
+			log.Error("Unable to send alerts to Alertmanager", "url", url, "alerts", len(alerts), "err", err)
+			lastErr = err
+			continue
+		}
+		n.notifications.Inc()
+		delivered = true
+	}
+	if delivered {
+		n.mu.Lock()
+		for key, alert := range resolved {
+			// the alert may fire again meanwhile
+			if n.resolved[key] == alert {
+				delete(n.resolved, key)
+			}
+		}
+		n.mu.Unlock()
+		return nil
+	}
+	return lastErr
+}
+
+func (n *alertmanagerNotifier) post(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-dht-prometheus/"+version)
+	for name, value := range n.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Alertmanager returned %s", resp.Status)
+	}
+	return nil
+}
+
+// closer delivers the pending resolved alerts. The firing alerts are left to
+// expire, so an exporter that is restarted doesn't resolve them.
+func (n *alertmanagerNotifier) closer() outputCloser {
+	return outputCloser{
+		name: "alertmanager",
+		close: func(ctx context.Context) error {
+			close(n.stop)
+			select {
+			case <-n.done:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			n.mu.Lock()
+			pending := len(n.resolved)
+			n.mu.Unlock()
+			if pending == 0 {
+				return nil
+			}
+			return n.send(ctx)
+		},
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// alertmanagerServer answers the alert requests with the status and records
+// the received alerts.
+type alertmanagerServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	status   int
+	requests [][]alertmanagerAlert
+}
+
+func newAlertmanagerServer(t *testing.T) *alertmanagerServer {
+	s := &alertmanagerServer{status: http.StatusOK}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/alerts" {
+			t.Errorf("got request of %s, want /api/v2/alerts", r.URL.Path)
+		}
+		var alerts []alertmanagerAlert
+		if err := json.NewDecoder(r.Body).Decode(&alerts); err != nil {
+			t.Errorf("invalid alerts: %v", err)
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.requests = append(s.requests, alerts)
+		w.WriteHeader(s.status)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *alertmanagerServer) setStatus(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
+
+// newTestAlertmanagerNotifier returns a notifier of the cold threshold that
+// only sends the alerts when asked to.
+func newTestAlertmanagerNotifier(t *testing.T, url string) (*alertmanagerNotifier, *threshold) {
+	thresholds, err := parseThresholds(t, "name=cold,value=temperature,max=8,severity=critical")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &serveCommand{AlertmanagerURLs: []string{url + "/"}, AlertmanagerTimeout: time.Second, AlertmanagerResend: time.Hour}
+	n, err := c.newAlertmanagerNotifier(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.closer().close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return n, thresholds[0]
+}
+
+// testAlertReading returns a reading of the sensor with the temperature.
+func testAlertReading(sensor, location string, temperature float64) *reading {
+	r := newReading(sensor, temperature, 50, 0)
+	r.Location = location
+	return r
+}
+
+func TestAlertmanagerNotifierPayload(t *testing.T) {
+	type observation struct {
+		breached bool
+		value    float64
+	}
+	tests := []struct {
+		name         string
+		observations []observation
+		// want is the state of the sent alert, empty when none is sent
+		want      string
+		wantValue string
+	}{
+		{name: "not breached", observations: []observation{{false, 5}}},
+		{name: "firing", observations: []observation{{true, 9}}, want: "firing", wantValue: "9"},
+		{name: "still firing", observations: []observation{{true, 9}, {true, 9.5}}, want: "firing", wantValue: "9.5"},
+		{name: "resolved", observations: []observation{{true, 9}, {false, 7}}, want: "resolved", wantValue: "7"},
+		{name: "firing again", observations: []observation{{true, 9}, {false, 7}, {true, 10}}, want: "firing", wantValue: "10"},
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newAlertmanagerServer(t)
+			n, threshold := newTestAlertmanagerNotifier(t, server.URL)
+			start := time.Now()
+			for _, o := range tt.observations {
+				n.observe(testAlertReading("attic", "roof", o.value), threshold, o.breached)
+			}
+			if err := n.send(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if len(tt.want) == 0 {
+				if len(server.requests) > 0 {
+					t.Errorf("got alerts %+v, want none", server.requests)
+				}
+				return
+			}
+			if len(server.requests) != 1 || len(server.requests[0]) != 1 {
+				t.Fatalf("got alerts %+v, want a single alert", server.requests)
+			}
+			alert := server.requests[0][0]
+			wantLabels := map[string]string{
+				"alertname": "DHTThresholdBreached",
+				"sensor":    "attic",
+				"threshold": "cold",
+				"severity":  "critical",
+				"location":  "roof",
+				"instance":  hostname,
+			}
+			if len(alert.Labels) != len(wantLabels) {
+				t.Errorf("got labels %v, want %v", alert.Labels, wantLabels)
+			}
+			for name, value := range wantLabels {
+				if alert.Labels[name] != value {
+					t.Errorf("got label %s=%q, want %q", name, alert.Labels[name], value)
+				}
+			}
+			if got := alert.Annotations["value"]; got != tt.wantValue {
+				t.Errorf("got value annotation %q, want %q", got, tt.wantValue)
+			}
+			if alert.StartsAt.Before(start) {
+				t.Errorf("the alert started at %v, before the observations at %v", alert.StartsAt, start)
+			}
+			// firing alerts end a few resends ahead, resolved ones when they
+			// resolved
+			state := "resolved"
+			if alert.EndsAt.After(time.Now().Add(time.Hour)) {
+				state = "firing"
+			}
+			if state != tt.want {
+				t.Errorf("got a %s alert ending at %v, want %s", state, alert.EndsAt, tt.want)
+			}
+		})
+	}
+}
+
+func TestAlertmanagerNotifierResolvedDelivery(t *testing.T) {
+	server := newAlertmanagerServer(t)
+	n, threshold := newTestAlertmanagerNotifier(t, server.URL)
+	n.observe(testAlertReading("attic", "roof", 9), threshold, true)
+	n.observe(testAlertReading("attic", "roof", 7), threshold, false)
+
+	// the resolved alert is kept until it's delivered
+	server.setStatus(http.StatusServiceUnavailable)
+	if err := n.send(context.Background()); err == nil {
+		t.Fatal("the send didn't fail")
+	}
+	server.setStatus(http.StatusOK)
+	if err := n.send(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.send(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(server.requests) != 2 {
+		t.Fatalf("got %d requests, want the failed one and the delivered one", len(server.requests))
+	}
+	for i, alerts := range server.requests {
+		if len(alerts) != 1 || alerts[0].EndsAt.After(time.Now()) {
+			t.Errorf("request %d: got alerts %+v, want the resolved alert", i, alerts)
+		}
+	}
+}
+
+func TestAlertmanagerNotifierResolveSensor(t *testing.T) {
+	server := newAlertmanagerServer(t)
+	n, threshold := newTestAlertmanagerNotifier(t, server.URL)
+	n.observe(testAlertReading("attic", "roof", 9), threshold, true)
+	// a pushed sensor of the same name has its own alert and location
+	n.observe(testAlertReading("garage/attic", "shed", 10), threshold, true)
+	n.resolveSensor("attic")
+	if err := n.send(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(server.requests) != 1 || len(server.requests[0]) != 2 {
+		t.Fatalf("got alerts %+v, want the resolved and the firing alert", server.requests)
+	}
+	for _, alert := range server.requests[0] {
+		resolved := !alert.EndsAt.After(time.Now())
+		switch origin := alert.Labels["origin"]; origin {
+		case "":
+			if !resolved || alert.Labels["location"] != "roof" {
+				t.Errorf("got alert %+v, want the resolved alert of attic in the roof", alert)
+			}
+		case "garage":
+			if resolved || alert.Labels["sensor"] != "attic" || alert.Labels["location"] != "shed" {
+				t.Errorf("got alert %+v, want the firing alert of garage/attic in the shed", alert)
+			}
+		default:
+			t.Errorf("got alert of origin %q", origin)
+		}
+	}
+	// the next breach fires again
+	n.observe(testAlertReading("attic", "roof", 9), threshold, true)
+	if _, ok := n.firing[alertmanagerKey{sensor: "attic", threshold: threshold.name}]; !ok {
+		t.Error("the alert of attic doesn't fire again")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// readResult is the result of reading a sensor on demand.
+type readResult struct {
+	Sensor    string   `json:"sensor"`
+	Reading   *reading `json:"reading,omitempty"`
+	Error     string   `json:"error,omitempty"`
+	ErrorType string   `json:"error_type,omitempty"`
+}
+
+// readHandler serves POST /api/v1/read. It reads the polled sensors selected
+// by the sensor query parameters, or all of them, right away and responds with
+// the results, responses for failed reads have the 502 status. The readings
+// are not recorded, so the on demand reads don't change the warm-up or the
+// identical readings streak of the scheduled measurements, but the failures
+// count towards power cycling the sensor. A sensor read shortly before, on
+// demand or by the schedule, is read again once it's ready, see
+// readSensorOnce. The reads stop after the timeout, unless zero, the sensors
+// not read by then fail.
+func readHandler(rec *recorder, power map[string]*powerSwitch, timeout time.Duration) http.Handler {
+	// on demand reads are serialized, a sensor can't be read faster anyway
+	var mu sync.Mutex
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		selected := sensors
+		if names := r.URL.Query()["sensor"]; len(names) > 0 {
+			selected = nil
+			for _, name := range names {
+				s := sensorByName(name)
+				if s == nil {
+					http.Error(w, fmt.Sprintf("unknown sensor %q", name), http.StatusNotFound)
+					return
+				}
+				selected = append(selected, s)
+			}
+		}
+
+		ctx := r.Context()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		status := http.StatusOK
+		results := []readResult{}
+		for _, s := range selected {
+			var reading *reading
+			err := ctx.Err()
+			if err == nil {
+				reading, err = rec.readSensor(ctx, s)
+			}
+			// the client went away
+			if err != nil && r.Context().Err() != nil {
+				return
+			}
+			result := readResult{Sensor: s.Name, Reading: reading}
+			if err != nil {
+				log.Error("On demand sensor read failed", "sensor", s.Name, "remote", r.RemoteAddr, "err", err)
+				result.Error, result.ErrorType = err.Error(), classifyError(err)
+				status = http.StatusBadGateway
+			} else {
+				log.Info("On demand sensor read", "sensor", s.Name, "remote", r.RemoteAddr,
+					"temperature", reading.Temperature, "humidity", reading.Humidity)
+			}
+			// a read cut short by the timeout says nothing about the sensor
+			if p := power[s.Name]; p != nil && ctx.Err() == nil {
+				p.observe(ctx, err)
+			}
+			results = append(results, result)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(struct {
+			Results []readResult `json:"results"`
+		}{results})
+	})
+}
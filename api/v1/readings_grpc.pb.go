@@ -0,0 +1,184 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             v3.5.1-go
+// source: api/v1/readings.proto
+
+package apiv1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	ReadingService_GetCurrent_FullMethodName     = "/dht.v1.ReadingService/GetCurrent"
+	ReadingService_StreamReadings_FullMethodName = "/dht.v1.ReadingService/StreamReadings"
+)
+
+// ReadingServiceClient is the client API for ReadingService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ReadingServiceClient interface {
+	// GetCurrent returns the last successful reading of the sensors. Sensors
+	// whose values are stale by --max-age are left out, requesting one fails
+	// with UNAVAILABLE and a sensor without a reading with NOT_FOUND.
+	GetCurrent(ctx context.Context, in *GetCurrentRequest, opts ...grpc.CallOption) (*GetCurrentResponse, error)
+	// StreamReadings streams every successful reading of the sensors until the
+	// client cancels the call or the exporter shuts down.
+	StreamReadings(ctx context.Context, in *StreamReadingsRequest, opts ...grpc.CallOption) (ReadingService_StreamReadingsClient, error)
+}
+
+type readingServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewReadingServiceClient(cc grpc.ClientConnInterface) ReadingServiceClient {
+	return &readingServiceClient{cc}
+}
+
+func (c *readingServiceClient) GetCurrent(ctx context.Context, in *GetCurrentRequest, opts ...grpc.CallOption) (*GetCurrentResponse, error) {
+	out := new(GetCurrentResponse)
+	err := c.cc.Invoke(ctx, ReadingService_GetCurrent_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *readingServiceClient) StreamReadings(ctx context.Context, in *StreamReadingsRequest, opts ...grpc.CallOption) (ReadingService_StreamReadingsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &ReadingService_ServiceDesc.Streams[0], ReadingService_StreamReadings_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &readingServiceStreamReadingsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type ReadingService_StreamReadingsClient interface {
+	Recv() (*Reading, error)
+	grpc.ClientStream
+}
+
+type readingServiceStreamReadingsClient struct {
+	grpc.ClientStream
+}
+
+func (x *readingServiceStreamReadingsClient) Recv() (*Reading, error) {
+	m := new(Reading)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ReadingServiceServer is the server API for ReadingService service.
+// All implementations must embed UnimplementedReadingServiceServer
+// for forward compatibility
+type ReadingServiceServer interface {
+	// GetCurrent returns the last successful reading of the sensors. Sensors
+	// whose values are stale by --max-age are left out, requesting one fails
+	// with UNAVAILABLE and a sensor without a reading with NOT_FOUND.
+	GetCurrent(context.Context, *GetCurrentRequest) (*GetCurrentResponse, error)
+	// StreamReadings streams every successful reading of the sensors until the
+	// client cancels the call or the exporter shuts down.
+	StreamReadings(*StreamReadingsRequest, ReadingService_StreamReadingsServer) error
+	mustEmbedUnimplementedReadingServiceServer()
+}
+
+// UnimplementedReadingServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedReadingServiceServer struct {
+}
+
+func (UnimplementedReadingServiceServer) GetCurrent(context.Context, *GetCurrentRequest) (*GetCurrentResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetCurrent not implemented")
+}
+func (UnimplementedReadingServiceServer) StreamReadings(*StreamReadingsRequest, ReadingService_StreamReadingsServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamReadings not implemented")
+}
+func (UnimplementedReadingServiceServer) mustEmbedUnimplementedReadingServiceServer() {}
+
+// UnsafeReadingServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ReadingServiceServer will
+// result in compilation errors.
+type UnsafeReadingServiceServer interface {
+	mustEmbedUnimplementedReadingServiceServer()
+}
+
+func RegisterReadingServiceServer(s grpc.ServiceRegistrar, srv ReadingServiceServer) {
+	s.RegisterService(&ReadingService_ServiceDesc, srv)
+}
+
+func _ReadingService_GetCurrent_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetCurrentRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ReadingServiceServer).GetCurrent(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ReadingService_GetCurrent_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ReadingServiceServer).GetCurrent(ctx, req.(*GetCurrentRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ReadingService_StreamReadings_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamReadingsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ReadingServiceServer).StreamReadings(m, &readingServiceStreamReadingsServer{stream})
+}
+
+type ReadingService_StreamReadingsServer interface {
+	Send(*Reading) error
+	grpc.ServerStream
+}
+
+type readingServiceStreamReadingsServer struct {
+	grpc.ServerStream
+}
+
+func (x *readingServiceStreamReadingsServer) Send(m *Reading) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// ReadingService_ServiceDesc is the grpc.ServiceDesc for ReadingService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ReadingService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "dht.v1.ReadingService",
+	HandlerType: (*ReadingServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetCurrent",
+			Handler:    _ReadingService_GetCurrent_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamReadings",
+			Handler:       _ReadingService_StreamReadings_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "api/v1/readings.proto",
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestReadHandler(t *testing.T) {
+	tests := []struct {
+		name    string
+		rows    []simulatedRow
+		query   string
+		timeout time.Duration
+		// reads is the number of on demand reads
+		reads        int
+		wantStatus   int
+		wantResults  int
+		wantError    string
+		wantFailures int
+	}{
+		{name: "reading", rows: []simulatedRow{{temperature: 20, humidity: 50}}, reads: 3, wantStatus: http.StatusOK, wantResults: 1},
+		{name: "selected sensor", rows: []simulatedRow{{temperature: 20, humidity: 50}}, query: "?sensor=attic", reads: 1, wantStatus: http.StatusOK, wantResults: 1},
+		{name: "unknown sensor", query: "?sensor=cellar", reads: 1, wantStatus: http.StatusNotFound},
+		{name: "failure", rows: []simulatedRow{{failed: true}}, reads: 2, wantStatus: http.StatusBadGateway, wantResults: 1, wantError: errTestRead.Error(), wantFailures: 2},
+		{name: "timeout", rows: []simulatedRow{{failed: true}}, timeout: time.Nanosecond, reads: 1, wantStatus: http.StatusBadGateway, wantResults: 1, wantError: "context deadline exceeded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, exported := newTestRecorder(t, recorderOptions{warmupReadings: 1, identicalLimit: 2, suppressIdentical: true})
+			sensors[0].Bus = "test-api-" + tt.name
+			sensors[0].Driver = &simulateDriver{rows: tt.rows, failure: errTestRead}
+			power := &powerSwitch{
+				sensor:     "attic",
+				power:      &powerPin{pin: &fakePowerPin{}},
+				after:      10,
+				cycles:     rec.metrics.powerCycles.WithLabelValues("attic", ""),
+				recoveries: rec.metrics.powerRecoveries.WithLabelValues("attic", ""),
+			}
+			handler := readHandler(rec, map[string]*powerSwitch{"attic": power}, tt.timeout)
+			var w *httptest.ResponseRecorder
+			for i := 0; i < tt.reads; i++ {
+				w = httptest.NewRecorder()
+				handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/read"+tt.query, nil))
+			}
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantResults > 0 {
+				var body struct {
+					Results []readResult `json:"results"`
+				}
+				if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+					t.Fatal(err)
+				}
+				if len(body.Results) != tt.wantResults {
+					t.Fatalf("got %d results, want %d", len(body.Results), tt.wantResults)
+				}
+				if got := body.Results[0]; got.Error != tt.wantError || (len(tt.wantError) == 0 && got.Reading == nil) {
+					t.Errorf("got result %+v, want error %q", got, tt.wantError)
+				}
+			}
+			// the on demand reads leave the recorder alone
+			if len(*exported) > 0 {
+				t.Errorf("recorded %d readings, want none", len(*exported))
+			}
+			if !rec.warmingUp("attic") {
+				t.Error("the on demand reads counted towards the warm-up")
+			}
+			if got := testutil.ToFloat64(rec.metrics.identicalReadingsStreak.WithLabelValues("attic", "")); got != 0 {
+				t.Errorf("identical readings streak = %g, want 0", got)
+			}
+			if power.failures != tt.wantFailures {
+				t.Errorf("the power switch counted %d failures, want %d", power.failures, tt.wantFailures)
+			}
+		})
+	}
+}
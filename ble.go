@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Advertisement formats of the supported BLE thermometers.
+const (
+	// bleEnvironmentalSensingUUID is the service data UUID used by the custom
+	// ATC1441 and pvvx firmwares of the Xiaomi LYWSD03MMC.
+	bleEnvironmentalSensingUUID = 0x181a
+	// bleGoveeCompanyID is the manufacturer data company ID used by the Govee
+	// H5072, H5075 and compatible thermometers.
+	bleGoveeCompanyID = 0xec88
+)
+
+// bleSensorSpec is the value of a --ble-sensor option, a comma separated list
+// of key=value pairs.
+type bleSensorSpec struct {
+	raw    string
+	values map[string]string
+}
+
+// bleSensorSpecKeys lists the keys supported in a --ble-sensor value.
+var bleSensorSpecKeys = []string{"mac", "name", "location"}
+
+func (s *bleSensorSpec) UnmarshalFlag(value string) error {
+	values, err := parseSpec(value, bleSensorSpecKeys)
+	if err != nil {
+		return err
+	}
+	s.raw, s.values = value, values
+	return nil
+}
+
+func (s bleSensorSpec) MarshalFlag() (string, error) {
+	return s.raw, nil
+}
+
+// bleSensor is a BLE thermometer identified by its MAC address.
+type bleSensor struct {
+	mac      string
+	name     string
+	location string
+}
+
+// configureBLESensors validates the --ble-sensor options and returns the
+// sensors by their upper case MAC address.
+func configureBLESensors(specs []bleSensorSpec) (map[string]*bleSensor, error) {
+	result := map[string]*bleSensor{}
+	names := map[string]bool{}
+	for _, s := range sensors {
+		names[s.Name] = true
+	}
+	for _, spec := range specs {
+		s := &bleSensor{
+			mac:      strings.ToUpper(spec.values["mac"]),
+			name:     spec.values["name"],
+			location: spec.values["location"],
+		}
+		if !isBLEAddress(s.mac) {
+			return nil, fmt.Errorf("invalid mac in --ble-sensor %q", spec.raw)
+		}
+		if len(s.name) == 0 {
+			s.name = s.mac
+		}
+		if strings.Contains(s.name, "/") {
+			return nil, fmt.Errorf("name must not contain / in --ble-sensor %q", spec.raw)
+		}
+		if names[s.name] {
+			return nil, fmt.Errorf("duplicate sensor name %s in --ble-sensor %q", s.name, spec.raw)
+		}
+		names[s.name] = true
+		result[s.mac] = s
+	}
+	return result, nil
+}
+
+// isBLEAddress returns whether the name is an upper case MAC address like
+// A4:C1:38:12:34:56, the name of the discovered thermometers.
+func isBLEAddress(name string) bool {
+	return len(name) == len("A4:C1:38:00:00:00") && strings.Count(name, ":") == 5 && name == strings.ToUpper(name)
+}
+
+// bleAdvertisement is the sensor data decoded from an advertisement.
+type bleAdvertisement struct {
+	model        string
+	temperature  float64
+	humidity     float64
+	batteryLevel float64
+}
+
+// decodeEnvironmentalSensing decodes the 0x181A service data of the ATC1441
+// and pvvx firmwares.
+func decodeEnvironmentalSensing(data []byte) (*bleAdvertisement, bool) {
+	switch len(data) {
+	case 13:
+		// ATC1441: MAC, temperature in 0.1°C, humidity and battery in %,
+		// battery in mV and a counter, big endian
+		return &bleAdvertisement{
+			model:        "LYWSD03MMC-atc1441",
+			temperature:  float64(int16(binary.BigEndian.Uint16(data[6:8]))) / 10,
+			humidity:     float64(data[8]),
+			batteryLevel: float64(data[9]),
+		}, true
+	case 15:
+		// pvvx: MAC, temperature and humidity in 0.01 units, battery in mV
+		// and %, a counter and flags, little endian
+		return &bleAdvertisement{
+			model:        "LYWSD03MMC-pvvx",
+			temperature:  float64(int16(binary.LittleEndian.Uint16(data[6:8]))) / 100,
+			humidity:     float64(binary.LittleEndian.Uint16(data[8:10])) / 100,
+			batteryLevel: float64(data[12]),
+		}, true
+	default:
+		return nil, false
+	}
+}
+
+// decodeGovee decodes the manufacturer data of the Govee H5072/H5075. Both
+// values are packed into three bytes as temperature*10000 + humidity*10, the
+// highest bit marks negative temperatures.
+func decodeGovee(data []byte) (*bleAdvertisement, bool) {
+	if len(data) < 5 {
+		return nil, false
+	}
+	value := uint32(data[1])<<16 | uint32(data[2])<<8 | uint32(data[3])
+	sign := 1.0
+	if value&0x800000 != 0 {
+		value ^= 0x800000
+		sign = -1
+	}
+	return &bleAdvertisement{
+		model:        "govee-h5075",
+		temperature:  sign * float64(value/1000) / 10,
+		humidity:     float64(value%1000) / 10,
+		batteryLevel: float64(data[4]),
+	}, true
+}
+
+// bleListener records the readings decoded from the advertisements.
+type bleListener struct {
+	// sensors are the configured sensors
+	sensors map[string]*bleSensor
+	// discover is the number of recognized devices recorded when no sensors
+	// are configured
+	discover int
+	rec      *recorder
+	interval time.Duration
+
+	mu sync.Mutex
+	// last is the time of the last recorded reading per MAC address
+	last map[string]time.Time
+	// full is set once discover devices were recorded
+	full bool
+}
+
+// handle records the advertisement of the device, at most once per interval.
+func (l *bleListener) handle(mac string, rssi int16, adv *bleAdvertisement) {
+	mac = strings.ToUpper(mac)
+	s, ok := l.sensors[mac]
+	if !ok {
+		if l.discover == 0 {
+			return
+		}
+		s = &bleSensor{mac: mac, name: mac}
+	}
+	// a partial or garbled advertisement doesn't take the slot of the interval
+	if err := validateValues(adv.temperature, adv.humidity); err != nil {
+		log.Debug("Invalid BLE advertisement", "mac", mac, "model", adv.model, "err", err)
+		return
+	}
+
+	l.mu.Lock()
+	last, seen := l.last[mac]
+	if !seen && !ok && len(l.last) >= l.discover {
+		if !l.full {
+			log.Warn("Ignoring further BLE thermometers, raise --ble-discover to export them", "discovered", len(l.last), "mac", mac)
+			l.full = true
+		}
+		l.mu.Unlock()
+		return
+	}
+	if seen && time.Since(last) < l.interval {
+		l.mu.Unlock()
+		return
+	}
+	l.last[mac] = time.Now()
+	l.mu.Unlock()
+
+	if !seen {
+		l.rec.metrics.sensorInfo.WithLabelValues(s.name, adv.model, "", "ble", s.location, "").Set(1)
+	}
+	r := newReading(s.name, adv.temperature, adv.humidity, 0)
+	r.Location = s.location
+	battery, signal := adv.batteryLevel, float64(rssi)
+	r.BatteryLevel, r.RSSI = &battery, &signal
+	l.rec.record(s.name, r, nil)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// scanBLE enables the default adapter and passes the advertisements of the
+// supported thermometers to the listener until the context is cancelled.
+func scanBLE(ctx context.Context, l *bleListener) error {
+	adapter := bluetooth.DefaultAdapter
+	if err := adapter.Enable(); err != nil {
+		return fmt.Errorf("unable to enable the Bluetooth adapter: %v", err)
+	}
+	go func() {
+		<-ctx.Done()
+		if err := adapter.StopScan(); err != nil {
+			log.Warn("Unable to stop the BLE scan", "err", err)
+		}
+	}()
+	go func() {
+		log.Info("Listening for BLE advertisements", "sensors", len(l.sensors))
+		err := adapter.Scan(func(_ *bluetooth.Adapter, result bluetooth.ScanResult) {
+			for _, data := range result.ServiceData() {
+				if !data.UUID.Is16Bit() || data.UUID.Get16Bit() != bleEnvironmentalSensingUUID {
+					continue
+				}
+				if adv, ok := decodeEnvironmentalSensing(data.Data); ok {
+					l.handle(result.Address.MAC.String(), result.RSSI, adv)
+				}
+			}
+			for _, data := range result.ManufacturerData() {
+				if data.CompanyID != bleGoveeCompanyID {
+					continue
+				}
+				if adv, ok := decodeGovee(data.Data); ok {
+					l.handle(result.Address.MAC.String(), result.RSSI, adv)
+				}
+			}
+		})
+		if err != nil && ctx.Err() == nil {
+			log.Error("BLE scan failed", "err", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+func scanBLE(_ context.Context, _ *bleListener) error {
+	return errors.New("--ble is only supported on Linux")
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeBLEAdvertisements(t *testing.T) {
+	mac := []byte{0xa4, 0xc1, 0x38, 0x01, 0x02, 0x03}
+	tests := []struct {
+		name   string
+		decode func([]byte) (*bleAdvertisement, bool)
+		data   []byte
+		want   *bleAdvertisement
+	}{
+		{
+			name:   "atc1441",
+			decode: decodeEnvironmentalSensing,
+			// 22.5°C, 45%, 87%, 2950 mV, counter
+			data: append(append([]byte{}, mac...), 0x00, 0xe1, 45, 87, 0x0b, 0x86, 0x01),
+			want: &bleAdvertisement{model: "LYWSD03MMC-atc1441", temperature: 22.5, humidity: 45, batteryLevel: 87},
+		},
+		{
+			name:   "atc1441 below zero",
+			decode: decodeEnvironmentalSensing,
+			// -5.0°C
+			data: append(append([]byte{}, mac...), 0xff, 0xce, 80, 50, 0x0b, 0x86, 0x01),
+			want: &bleAdvertisement{model: "LYWSD03MMC-atc1441", temperature: -5, humidity: 80, batteryLevel: 50},
+		},
+		{
+			name:   "pvvx",
+			decode: decodeEnvironmentalSensing,
+			// 22.5°C, 45.5%, 2950 mV, 90%, counter, flags
+			data: append(append([]byte{}, mac...), 0xca, 0x08, 0xc6, 0x11, 0x86, 0x0b, 90, 0x01, 0x00),
+			want: &bleAdvertisement{model: "LYWSD03MMC-pvvx", temperature: 22.5, humidity: 45.5, batteryLevel: 90},
+		},
+		{
+			name:   "pvvx below zero",
+			decode: decodeEnvironmentalSensing,
+			// -12.34°C, 60%
+			data: append(append([]byte{}, mac...), 0x2e, 0xfb, 0x70, 0x17, 0x86, 0x0b, 90, 0x01, 0x00),
+			want: &bleAdvertisement{model: "LYWSD03MMC-pvvx", temperature: -12.34, humidity: 60, batteryLevel: 90},
+		},
+		{
+			name:   "unknown environmental sensing length",
+			decode: decodeEnvironmentalSensing,
+			data:   append(append([]byte{}, mac...), 0x00, 0xe1),
+		},
+		{
+			name:   "govee",
+			decode: decodeGovee,
+			// 225455: 22.5°C, 45.5%, battery 95%
+			data: []byte{0x00, 0x03, 0x70, 0xaf, 95, 0x00},
+			want: &bleAdvertisement{model: "govee-h5075", temperature: 22.5, humidity: 45.5, batteryLevel: 95},
+		},
+		{
+			name:   "govee below zero",
+			decode: decodeGovee,
+			// 50455 with the sign bit: -5.0°C, 45.5%
+			data: []byte{0x00, 0x80, 0xc5, 0x17, 64},
+			want: &bleAdvertisement{model: "govee-h5075", temperature: -5, humidity: 45.5, batteryLevel: 64},
+		},
+		{
+			name:   "govee too short",
+			decode: decodeGovee,
+			data:   []byte{0x00, 0x03, 0x70, 0xaf},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.decode(tt.data)
+			if tt.want == nil {
+				if ok {
+					t.Fatalf("decoded %+v, want no advertisement", got)
+				}
+				return
+			}
+			if !ok {
+				t.Fatal("advertisement not decoded")
+			}
+			if got.model != tt.want.model ||
+				math.Abs(got.temperature-tt.want.temperature) > 1e-9 ||
+				math.Abs(got.humidity-tt.want.humidity) > 1e-9 ||
+				got.batteryLevel != tt.want.batteryLevel {
+				t.Errorf("decoded %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBLEListenerHandle(t *testing.T) {
+	valid := &bleAdvertisement{model: "govee-h5075", temperature: 22.5, humidity: 45.5, batteryLevel: 95}
+	type advertisement struct {
+		mac string
+		adv *bleAdvertisement
+	}
+	tests := []struct {
+		name     string
+		sensors  map[string]*bleSensor
+		discover int
+		adverts  []advertisement
+		want     []string
+	}{
+		{
+			name:    "configured sensor",
+			sensors: map[string]*bleSensor{"A4:C1:38:00:00:01": {mac: "A4:C1:38:00:00:01", name: "bedroom"}},
+			adverts: []advertisement{{"a4:c1:38:00:00:01", valid}, {"A4:C1:38:00:00:02", valid}},
+			want:    []string{"bedroom"},
+		},
+		{
+			name:    "invalid values",
+			sensors: map[string]*bleSensor{"A4:C1:38:00:00:01": {mac: "A4:C1:38:00:00:01", name: "bedroom"}},
+			adverts: []advertisement{
+				{"A4:C1:38:00:00:01", &bleAdvertisement{model: "govee-h5075", temperature: 22.5, humidity: 0}},
+				{"A4:C1:38:00:00:01", &bleAdvertisement{model: "LYWSD03MMC-atc1441", temperature: 22.5, humidity: 255}},
+				{"A4:C1:38:00:00:01", valid},
+			},
+			want: []string{"bedroom"},
+		},
+		{
+			name:     "discovery limit",
+			discover: 2,
+			adverts: []advertisement{
+				{"A4:C1:38:00:00:01", valid},
+				{"A4:C1:38:00:00:02", valid},
+				{"A4:C1:38:00:00:03", valid},
+				{"A4:C1:38:00:00:01", valid},
+			},
+			want: []string{"A4:C1:38:00:00:01", "A4:C1:38:00:00:02", "A4:C1:38:00:00:01"},
+		},
+		{
+			name:     "invalid values don't take a discovery slot",
+			discover: 1,
+			adverts: []advertisement{
+				{"A4:C1:38:00:00:01", &bleAdvertisement{model: "govee-h5075", temperature: 22.5, humidity: 0}},
+				{"A4:C1:38:00:00:02", valid},
+			},
+			want: []string{"A4:C1:38:00:00:02"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, exported := newTestRecorder(t, recorderOptions{})
+			l := &bleListener{sensors: tt.sensors, discover: tt.discover, rec: rec, last: map[string]time.Time{}}
+			for _, a := range tt.adverts {
+				l.handle(a.mac, -60, a.adv)
+			}
+			var got []string
+			for _, r := range *exported {
+				got = append(got, r.Sensor)
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("exported %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// bleSpecs parses the --ble-sensor values.
+func bleSpecs(t *testing.T, raw ...string) []bleSensorSpec {
+	t.Helper()
+	specs := make([]bleSensorSpec, len(raw))
+	for i := range raw {
+		if err := specs[i].UnmarshalFlag(raw[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return specs
+}
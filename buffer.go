@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// diskBuffer is a FIFO of JSON entries kept in memory and in a file, one entry
+// per line, so the entries survive restarts. Entries are appended to the file
+// and the file is rewritten once the removed entries outnumber the pending
+// ones or on sync, to spare the SD card. It's not safe for concurrent use.
+type diskBuffer struct {
+	path       string
+	size       int
+	dropNewest bool
+
+	file    *os.File
+	entries [][]byte
+	// removed is the number of delivered or dropped entries still in the file
+	removed int
+}
+
+// openDiskBuffer loads the entries left in the file by the previous run. Lines
+// that aren't valid JSON, e.g. written partially on a power loss, are skipped.
+func openDiskBuffer(path string, size int, dropNewest bool) (*diskBuffer, error) {
+	b := &diskBuffer{path: path, size: size, dropNewest: dropNewest}
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			if line := scanner.Bytes(); json.Valid(line) {
+				b.entries = append(b.entries, bytes.Clone(line))
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("unable to read %s: %v", path, err)
+		}
+		if len(b.entries) > size {
+			b.entries = b.entries[len(b.entries)-size:]
+		}
+	}
+	if err := b.compact(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *diskBuffer) len() int {
+	return len(b.entries)
+}
+
+// push appends the entry, a full buffer drops the oldest entry or the new one
+// depending on the drop policy.
+func (b *diskBuffer) push(entry []byte) (dropped bool, err error) {
+	if len(b.entries) >= b.size {
+		if b.dropNewest {
+			return true, nil
+		}
+		b.entries[0] = nil
+		b.entries = b.entries[1:]
+		b.removed++
+		dropped = true
+	}
+	if _, err := b.file.Write(append(entry, '\n')); err != nil {
+		return dropped, err
+	}
+	b.entries = append(b.entries, entry)
+	return dropped, b.maybeCompact()
+}
+
+// peek returns the oldest entry.
+func (b *diskBuffer) peek() []byte {
+	return b.entries[0]
+}
+
+// pop removes the oldest entry.
+func (b *diskBuffer) pop() error {
+	b.entries[0] = nil
+	b.entries = b.entries[1:]
+	b.removed++
+	return b.maybeCompact()
+}
+
+// sync rewrites the file when it still has removed entries, so they are not
+// loaded again after a restart.
+func (b *diskBuffer) sync() error {
+	if b.removed == 0 {
+		return nil
+	}
+	return b.compact()
+}
+
+func (b *diskBuffer) maybeCompact() error {
+	if len(b.entries) > 0 && b.removed <= len(b.entries) {
+		return nil
+	}
+	return b.compact()
+}
+
+// compact replaces the file with the pending entries.
+func (b *diskBuffer) compact() error {
+	tmp, err := os.CreateTemp(filepath.Dir(b.path), "."+filepath.Base(b.path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	for _, entry := range b.entries {
+		w.Write(entry)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), b.path); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(b.path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	if b.file != nil {
+		b.file.Close()
+	}
+	b.file, b.removed = f, 0
+	return nil
+}
+
+// close writes the pending entries and closes the file.
+func (b *diskBuffer) close() error {
+	if err := b.compact(); err != nil {
+		return err
+	}
+	return b.file.Close()
+}
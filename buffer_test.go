@@ -0,0 +1,195 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readBufferFile(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Fields(string(data))
+}
+
+func bufferEntries(b *diskBuffer) []string {
+	var entries []string
+	for _, entry := range b.entries {
+		entries = append(entries, string(entry))
+	}
+	return entries
+}
+
+func TestDiskBufferDrop(t *testing.T) {
+	tests := []struct {
+		name        string
+		dropNewest  bool
+		push        []string
+		wantDropped []bool
+		want        []string
+	}{
+		{
+			name:        "not full",
+			push:        []string{"1", "2"},
+			wantDropped: []bool{false, false},
+			want:        []string{"1", "2"},
+		},
+		{
+			name:        "drop oldest",
+			push:        []string{"1", "2", "3", "4"},
+			wantDropped: []bool{false, false, false, true},
+			want:        []string{"2", "3", "4"},
+		},
+		{
+			name:        "drop newest",
+			dropNewest:  true,
+			push:        []string{"1", "2", "3", "4"},
+			wantDropped: []bool{false, false, false, true},
+			want:        []string{"1", "2", "3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "buffer.jsonl")
+			b, err := openDiskBuffer(path, 3, tt.dropNewest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, entry := range tt.push {
+				dropped, err := b.push([]byte(entry))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if dropped != tt.wantDropped[i] {
+					t.Errorf("push(%s) dropped = %v, want %v", entry, dropped, tt.wantDropped[i])
+				}
+			}
+			if got := bufferEntries(b); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("entries = %v, want %v", got, tt.want)
+			}
+			if err := b.close(); err != nil {
+				t.Fatal(err)
+			}
+			if got := readBufferFile(t, path); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("file = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiskBufferCompaction(t *testing.T) {
+	tests := []struct {
+		name string
+		pops int
+		sync bool
+		// wantFile are the lines left in the file
+		wantFile []string
+	}{
+		{
+			name:     "removed entries don't outnumber the pending ones",
+			pops:     2,
+			wantFile: []string{"1", "2", "3", "4"},
+		},
+		{
+			name:     "removed entries outnumber the pending ones",
+			pops:     3,
+			wantFile: []string{"4"},
+		},
+		{
+			name:     "all entries removed",
+			pops:     4,
+			wantFile: nil,
+		},
+		{
+			name:     "sync",
+			pops:     1,
+			sync:     true,
+			wantFile: []string{"2", "3", "4"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "buffer.jsonl")
+			b, err := openDiskBuffer(path, 10, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, entry := range []string{"1", "2", "3", "4"} {
+				if _, err := b.push([]byte(entry)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < tt.pops; i++ {
+				if err := b.pop(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.sync {
+				if err := b.sync(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := readBufferFile(t, path); strings.Join(got, ",") != strings.Join(tt.wantFile, ",") {
+				t.Errorf("file = %v, want %v", got, tt.wantFile)
+			}
+		})
+	}
+}
+
+func TestOpenDiskBuffer(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		size    int
+		want    []string
+	}{
+		{
+			name: "missing file",
+			size: 10,
+		},
+		{
+			name:    "pending entries",
+			content: "{\"a\":1}\n{\"a\":2}\n",
+			size:    10,
+			want:    []string{`{"a":1}`, `{"a":2}`},
+		},
+		{
+			name:    "partially written line",
+			content: "{\"a\":1}\n{\"a\":",
+			size:    10,
+			want:    []string{`{"a":1}`},
+		},
+		{
+			name:    "more entries than the size",
+			content: "1\n2\n3\n",
+			size:    2,
+			want:    []string{"2", "3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "buffer.jsonl")
+			if len(tt.content) > 0 {
+				if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			b, err := openDiskBuffer(path, tt.size, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer b.close()
+			if got := bufferEntries(b); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("entries = %v, want %v", got, tt.want)
+			}
+			// the file is rewritten with the loaded entries only
+			if got := readBufferFile(t, path); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("file = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// calibrationSection is the INI section of the calibration options, the short
+// description of their group.
+const calibrationSection = "Calibration Options"
+
+type calibrationOptions struct {
+	Calibrations []calibrationSpec `long:"calibration" description:"linear correction of the temperature or humidity of a sensor, e.g. sensor=attic,value=humidity,scale=1.02,offset=-1.5; the exported value is measured*scale+offset, see the calibrate command (can be repeated)" env:"DHT_CALIBRATIONS" env-delim:";"`
+}
+
+// calibrationSpec is the value of a --calibration option, a comma separated
+// list of key=value pairs.
+type calibrationSpec struct {
+	raw    string
+	values map[string]string
+}
+
+// calibrationSpecKeys lists the keys supported in a --calibration value.
+var calibrationSpecKeys = []string{"sensor", "value", "scale", "offset"}
+
+func (s *calibrationSpec) UnmarshalFlag(value string) error {
+	values, err := parseSpec(value, calibrationSpecKeys)
+	if err != nil {
+		return err
+	}
+	s.raw, s.values = value, values
+	return nil
+}
+
+func (s calibrationSpec) MarshalFlag() (string, error) {
+	return s.raw, nil
+}
+
+// calibration is a linear correction of a measured value.
+type calibration struct {
+	scale, offset float64
+}
+
+func (c *calibration) apply(value float64) float64 {
+	if c == nil {
+		return value
+	}
+	return value*c.scale + c.offset
+}
+
+// configureCalibrations validates the --calibration options and sets the
+// calibrations of the sensors.
+func configureCalibrations(specs []calibrationSpec) error {
+	byName := map[string]*sensorConfig{}
+	for _, s := range sensors {
+		byName[s.Name] = s
+	}
+	for _, spec := range specs {
+		v := spec.values
+		s, ok := byName[v["sensor"]]
+		if !ok {
+			return fmt.Errorf("unknown sensor %q in --calibration %q", v["sensor"], spec.raw)
+		}
+		c := &calibration{scale: 1}
+		for key, value := range map[string]*float64{"scale": &c.scale, "offset": &c.offset} {
+			raw, ok := v[key]
+			if !ok {
+				continue
+			}
+			f, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				return fmt.Errorf("invalid %s in --calibration %q: %v", key, spec.raw, err)
+			}
+			*value = f
+		}
+		if c.scale <= 0 {
+			return fmt.Errorf("scale must be positive in --calibration %q", spec.raw)
+		}
+		var target **calibration
+		switch v["value"] {
+		case "temperature":
+			target = &s.TemperatureCalibration
+		case "humidity":
+			target = &s.HumidityCalibration
+		default:
+			return fmt.Errorf("unsupported value %q in --calibration %q, supported: temperature, humidity", v["value"], spec.raw)
+		}
+		if *target != nil {
+			return fmt.Errorf("duplicate %s calibration of sensor %s", v["value"], s.Name)
+		}
+		*target = c
+	}
+	return nil
+}
+
+type calibrateCommand struct {
+	Value string `long:"value" description:"value to calibrate" choice:"humidity" choice:"temperature" default:"humidity"`
+	Reads uint   `long:"reads" description:"number of readings averaged at every reference condition" default:"5"`
+	Args  struct {
+		Sensor string `positional-arg-name:"sensor" description:"name of the sensor to calibrate, required with multiple sensors"`
+	} `positional-args:"yes"`
+}
+
+func (c *calibrateCommand) Execute(_ []string) error {
+	if c.Reads == 0 {
+		return errors.New("--reads must be at least 1")
+	}
+	var s *sensorConfig
+	for _, sensor := range sensors {
+		if sensor.Name == c.Args.Sensor || (len(c.Args.Sensor) == 0 && len(sensors) == 1) {
+			s = sensor
+		}
+	}
+	if s == nil {
+		return fmt.Errorf("unknown sensor %q, configured: %s", c.Args.Sensor, strings.Join(sensorNames(), ", "))
+	}
+	quietDriverLogs()
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	detectSensorTypes(ctx)
+
+	// the existing calibration would skew the measured values
+	s.TemperatureCalibration, s.HumidityCalibration = nil, nil
+
+	unit, example := "%", "e.g. 75.3 over a saturated sodium chloride solution or 33.1 over magnesium chloride at 20°C"
+	if c.Value == "temperature" {
+		unit, example = "°C", "e.g. 0 in an ice bath or the value of a reference thermometer"
+	}
+	fmt.Printf("Calibrating the %s of sensor %s with two reference conditions.\n", c.Value, s.Name)
+	fmt.Println("For every reference place the sensor in it and wait until the readings settle,")
+	fmt.Println("salt solutions in a sealed container take a few hours.")
+
+	input := bufio.NewScanner(os.Stdin)
+	var references, measured [2]float64
+	for i := range references {
+		fmt.Printf("\nReference %d in %s (%s): ", i+1, unit, example)
+		if !input.Scan() {
+			return errors.New("calibration aborted")
+		}
+		reference, err := strconv.ParseFloat(strings.TrimSpace(input.Text()), 64)
+		if err != nil {
+			return fmt.Errorf("invalid reference value: %v", err)
+		}
+		value, err := c.measure(ctx, s)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Measured %.2f%s, reference %.2f%s\n", value, unit, reference, unit)
+		references[i], measured[i] = reference, value
+	}
+	if math.Abs(references[1]-references[0]) < 1 || math.Abs(measured[1]-measured[0]) < 0.1 {
+		return errors.New("the reference conditions are too close to compute the scale, use two far apart references")
+	}
+	scale := (references[1] - references[0]) / (measured[1] - measured[0])
+	offset := references[0] - scale*measured[0]
+	if scale <= 0 {
+		return errors.New("the measured values change in the opposite direction than the references, check the sensor and the references")
+	}
+	spec := fmt.Sprintf("sensor=%s,value=%s,scale=%.4f,offset=%.3f", s.Name, c.Value, scale, offset)
+	fmt.Printf("\nScale %.4f, offset %.3f\n", scale, offset)
+
+	if len(opts.Config) == 0 {
+		fmt.Printf("Add the calibration to the config file:\n\n[%s]\ncalibration = %s\n\nor pass --calibration %s\n", calibrationSection, spec, spec)
+		return nil
+	}
+	if err := writeCalibration(opts.Config, s.Name, c.Value, spec); err != nil {
+		return fmt.Errorf("unable to update %s: %v", opts.Config, err)
+	}
+	fmt.Printf("Calibration written to %s.\n", opts.Config)
+	return nil
+}
+
+// measure returns the average of the measured value over the reads.
+func (c *calibrateCommand) measure(ctx context.Context, s *sensorConfig) (float64, error) {
+	var sum float64
+	for i := 0; i < int(c.Reads); i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			case <-time.After(retryDelay(s)):
+			}
+		}
+		r, err := readSensor(ctx, s)
+		if err != nil {
+			return 0, fmt.Errorf("unable to read sensor %s: %v", s.Name, err)
+		}
+		value := r.Humidity
+		if c.Value == "temperature" {
+			value = r.Temperature
+		}
+		fmt.Printf("  read %d/%d: %.2f\n", i+1, c.Reads, value)
+		sum += value
+	}
+	return sum / float64(c.Reads), nil
+}
+
+// writeCalibration replaces the calibration of the sensor value in the config
+// file, adding the calibration section when missing. The other lines are kept
+// as they are.
+func writeCalibration(path, sensor, value, spec string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var lines []string
+	if len(data) > 0 {
+		lines = strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	}
+	section, insert := "", -1
+	var result []string
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			section = strings.TrimSpace(trimmed[1 : len(trimmed)-1])
+		}
+		if section == calibrationSection {
+			if key, val, ok := strings.Cut(trimmed, "="); ok && strings.TrimSpace(key) == "calibration" {
+				values, err := parseSpec(strings.TrimSpace(val), calibrationSpecKeys)
+				if err == nil && values["sensor"] == sensor && values["value"] == value {
+					continue
+				}
+			}
+		}
+		result = append(result, line)
+		if section == calibrationSection && len(trimmed) > 0 {
+			insert = len(result)
+		}
+	}
+	entry := "calibration = " + spec
+	if insert < 0 {
+		if len(result) > 0 {
+			result = append(result, "")
+		}
+		result = append(result, "["+calibrationSection+"]", entry)
+	} else {
+		result = append(result[:insert], append([]string{entry}, result[insert:]...)...)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(strings.Join(result, "\n")+"\n"), info.Mode())
+}
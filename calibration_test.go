@@ -0,0 +1,134 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteCalibration(t *testing.T) {
+	const spec = "sensor=attic,value=humidity,scale=1.0200,offset=-1.500"
+	tests := []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{
+			name:   "empty file",
+			config: "",
+			want:   "[Calibration Options]\ncalibration = " + spec + "\n",
+		},
+		{
+			name:   "section added",
+			config: "[Application Options]\ninterval = 1m\n",
+			want:   "[Application Options]\ninterval = 1m\n\n[Calibration Options]\ncalibration = " + spec + "\n",
+		},
+		{
+			name:   "calibration replaced",
+			config: "[Calibration Options]\ncalibration = sensor=attic,value=humidity,scale=1.1,offset=0\n",
+			want:   "[Calibration Options]\ncalibration = " + spec + "\n",
+		},
+		{
+			name: "other calibrations kept",
+			config: "[Calibration Options]\n" +
+				"calibration = sensor=attic,value=temperature,offset=-0.5\n" +
+				"calibration = sensor=cellar,value=humidity,scale=0.98\n" +
+				"\n[Application Options]\ninterval = 1m\n",
+			want: "[Calibration Options]\n" +
+				"calibration = sensor=attic,value=temperature,offset=-0.5\n" +
+				"calibration = sensor=cellar,value=humidity,scale=0.98\n" +
+				"calibration = " + spec + "\n" +
+				"\n[Application Options]\ninterval = 1m\n",
+		},
+		{
+			name:   "comments and other sections kept",
+			config: "; exporter settings\n[Application Options]\ninterval = 1m\n\n[Calibration Options]\n; salt test 2024\ncalibration = sensor=attic,value=humidity,scale=1.1\n\n[Metrics Options]\nnamespace = home\n",
+			want:   "; exporter settings\n[Application Options]\ninterval = 1m\n\n[Calibration Options]\n; salt test 2024\ncalibration = " + spec + "\n\n[Metrics Options]\nnamespace = home\n",
+		},
+		{
+			name:   "calibration in another section kept",
+			config: "[Other]\ncalibration = sensor=attic,value=humidity,scale=1.1\n",
+			want:   "[Other]\ncalibration = sensor=attic,value=humidity,scale=1.1\n\n[Calibration Options]\ncalibration = " + spec + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "dht.ini")
+			if err := os.WriteFile(path, []byte(tt.config), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if err := writeCalibration(path, "attic", "humidity", spec); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("got config\n%s\nwant\n%s", data, tt.want)
+			}
+			if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+				t.Errorf("the file mode was not kept: %v %v", info.Mode(), err)
+			}
+		})
+	}
+}
+
+func TestConfigureCalibrations(t *testing.T) {
+	tests := []struct {
+		name            string
+		specs           []string
+		wantTemperature float64
+		wantHumidity    float64
+		wantErr         string
+	}{
+		{name: "none", wantTemperature: 20, wantHumidity: 50},
+		{
+			name:            "temperature and humidity",
+			specs:           []string{"sensor=attic,value=temperature,offset=-0.5", "sensor=attic,value=humidity,scale=1.5,offset=-2"},
+			wantTemperature: 19.5,
+			wantHumidity:    73,
+		},
+		{name: "unknown sensor", specs: []string{"sensor=cellar,value=humidity,scale=1.1"}, wantErr: "unknown sensor"},
+		{name: "invalid scale", specs: []string{"sensor=attic,value=humidity,scale=x"}, wantErr: "invalid scale"},
+		{name: "negative scale", specs: []string{"sensor=attic,value=humidity,scale=-1"}, wantErr: "scale must be positive"},
+		{name: "unsupported value", specs: []string{"sensor=attic,value=vpd,offset=1"}, wantErr: "unsupported value"},
+		{
+			name:    "duplicate",
+			specs:   []string{"sensor=attic,value=humidity,offset=1", "sensor=attic,value=humidity,offset=2"},
+			wantErr: "duplicate humidity calibration",
+		},
+	}
+	defer func(s []*sensorConfig) { sensors = s }(sensors)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &sensorConfig{Name: "attic"}
+			sensors = []*sensorConfig{s}
+			var specs []calibrationSpec
+			for _, value := range tt.specs {
+				var spec calibrationSpec
+				if err := spec.UnmarshalFlag(value); err != nil {
+					t.Fatal(err)
+				}
+				specs = append(specs, spec)
+			}
+			err := configureCalibrations(specs)
+			if len(tt.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.TemperatureCalibration.apply(20); got != tt.wantTemperature {
+				t.Errorf("calibrated temperature = %g, want %g", got, tt.wantTemperature)
+			}
+			if got := s.HumidityCalibration.apply(50); got != tt.wantHumidity {
+				t.Errorf("calibrated humidity = %g, want %g", got, tt.wantHumidity)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import "errors"
+
+// comfortStates lists the values of the state label of comfort_state.
+var comfortStates = []string{"too_cold", "too_hot", "dry", "humid", "comfortable"}
+
+// comfortBands are the temperature and humidity ranges considered comfortable.
+type comfortBands struct {
+	minTemperature, maxTemperature float64
+	minHumidity, maxHumidity       float64
+}
+
+// comfortBands returns the bands configured by the --comfort-* options, nil
+// when the comfort metrics are disabled.
+func (c *serveCommand) comfortBands() (*comfortBands, error) {
+	if !c.EnableComfortMetrics {
+		return nil, nil
+	}
+	b := &comfortBands{
+		minTemperature: c.ComfortTemperatureMin,
+		maxTemperature: c.ComfortTemperatureMax,
+		minHumidity:    c.ComfortHumidityMin,
+		maxHumidity:    c.ComfortHumidityMax,
+	}
+	if b.minTemperature >= b.maxTemperature {
+		return nil, errors.New("--comfort-temperature-min must be lower than --comfort-temperature-max")
+	}
+	if b.minHumidity >= b.maxHumidity {
+		return nil, errors.New("--comfort-humidity-min must be lower than --comfort-humidity-max")
+	}
+	return b, nil
+}
+
+// classify returns the comfort state of the reading. The temperature takes
+// precedence over the humidity, a hot and humid room is too_hot.
+func (b *comfortBands) classify(r *reading) string {
+	switch {
+	case r.Temperature < b.minTemperature:
+		return "too_cold"
+	case r.Temperature > b.maxTemperature:
+		return "too_hot"
+	case r.Humidity < b.minHumidity:
+		return "dry"
+	case r.Humidity > b.maxHumidity:
+		return "humid"
+	default:
+		return "comfortable"
+	}
+}
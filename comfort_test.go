@@ -0,0 +1,69 @@
+package main
+
+import "testing"
+
+func TestComfortBandsClassify(t *testing.T) {
+	bands := &comfortBands{minTemperature: 20, maxTemperature: 24, minHumidity: 40, maxHumidity: 60}
+	tests := []struct {
+		name        string
+		temperature float64
+		humidity    float64
+		want        string
+	}{
+		{name: "comfortable", temperature: 22, humidity: 50, want: "comfortable"},
+		{name: "on the bounds", temperature: 20, humidity: 60, want: "comfortable"},
+		{name: "too cold", temperature: 19.9, humidity: 50, want: "too_cold"},
+		{name: "too hot", temperature: 24.1, humidity: 50, want: "too_hot"},
+		{name: "dry", temperature: 22, humidity: 39, want: "dry"},
+		{name: "humid", temperature: 22, humidity: 61, want: "humid"},
+		{name: "hot and humid", temperature: 30, humidity: 80, want: "too_hot"},
+		{name: "cold and dry", temperature: 15, humidity: 20, want: "too_cold"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bands.classify(newReading("attic", tt.temperature, tt.humidity, 0)); got != tt.want {
+				t.Errorf("classify(%g, %g) = %s, want %s", tt.temperature, tt.humidity, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestComfortBandsOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		command serveCommand
+		wantNil bool
+		wantErr bool
+	}{
+		{
+			name:    "disabled",
+			command: serveCommand{ComfortTemperatureMin: 24, ComfortTemperatureMax: 20},
+			wantNil: true,
+		},
+		{
+			name:    "enabled",
+			command: serveCommand{EnableComfortMetrics: true, ComfortTemperatureMin: 20, ComfortTemperatureMax: 24, ComfortHumidityMin: 40, ComfortHumidityMax: 60},
+		},
+		{
+			name:    "temperature bounds swapped",
+			command: serveCommand{EnableComfortMetrics: true, ComfortTemperatureMin: 24, ComfortTemperatureMax: 20, ComfortHumidityMin: 40, ComfortHumidityMax: 60},
+			wantErr: true,
+		},
+		{
+			name:    "empty humidity band",
+			command: serveCommand{EnableComfortMetrics: true, ComfortTemperatureMin: 20, ComfortTemperatureMax: 24, ComfortHumidityMin: 50, ComfortHumidityMax: 50},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bands, err := tt.command.comfortBands()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (bands == nil) != tt.wantNil {
+				t.Errorf("bands = %+v, want nil %v", bands, tt.wantNil)
+			}
+		})
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+)
+
+// configFilePath returns the config file passed via -c/--config or the
+// DHT_CONFIG environment variable.
+func configFilePath(args []string) string {
+	for i, arg := range args {
+		switch {
+		case arg == "--":
+			return os.Getenv("DHT_CONFIG")
+		case arg == "-c" || arg == "--config":
+			if i+1 < len(args) {
+				return args[i+1]
+			}
+		case strings.HasPrefix(arg, "--config="):
+			return strings.TrimPrefix(arg, "--config=")
+		case strings.HasPrefix(arg, "-c") && !strings.HasPrefix(arg, "--"):
+			return strings.TrimPrefix(arg, "-c")
+		}
+	}
+	return os.Getenv("DHT_CONFIG")
+}
+
+// loadConfigFile reads the INI config file (if any) before the command line
+// is parsed. Values from the file are used as option defaults, so command line
+// options still take precedence. Note that values from the file also take
+// precedence over environment variables.
+func loadConfigFile(parser *flags.Parser, args []string) error {
+	path := configFilePath(args)
+	if len(path) == 0 {
+		return nil
+	}
+	ini := flags.NewIniParser(parser)
+	ini.ParseAsDefaults = true
+	if err := ini.ParseFile(path); err != nil {
+		return fmt.Errorf("unable to load config file %s: %v", path, err)
+	}
+	return nil
+}
+
+type configValidateCommand struct {
+	SkipEndpoints   bool          `long:"skip-endpoints" description:"don't check that the output endpoints are reachable"`
+	EndpointTimeout time.Duration `long:"endpoint-timeout" description:"timeout of a single endpoint check" default:"3s"`
+}
+
+func (c *configValidateCommand) Execute(_ []string) error {
+	if err := checkConfig(os.Stdout, !c.SkipEndpoints, c.EndpointTimeout); err != nil {
+		return err
+	}
+	if len(opts.Config) > 0 {
+		fmt.Printf("Configuration %s is valid.\n", opts.Config)
+	} else {
+		fmt.Println("Configuration is valid.")
+	}
+	return nil
+}
+
+// checkConfig validates the serve options including the pin conflicts,
+// optionally checks whether the endpoints are reachable, and prints the
+// resolved configuration to w. Nothing is read from the sensors.
+func checkConfig(w io.Writer, endpoints bool, timeout time.Duration) error {
+	if err := serveOpts.validate(); err != nil {
+		return err
+	}
+	var problems []string
+	check := func(name, address string) string {
+		if !endpoints || len(address) == 0 {
+			return ""
+		}
+		conn, err := net.DialTimeout("tcp", address, timeout)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s is not reachable: %v", name, err))
+			return " (unreachable)"
+		}
+		conn.Close()
+		return " (reachable)"
+	}
+
+	c := &serveOpts
+	fmt.Fprintln(w, "Sensors:")
+	for _, s := range sensors {
+		model, pin, driver := s.Driver.info()
+		interval := c.ReadSeconds
+		if s.Interval > 0 {
+			interval = s.Interval
+		}
+		status := ""
+		if d, ok := s.Driver.(*modbusDriver); ok && strings.HasPrefix(d.address, "tcp://") {
+			status = check("Modbus "+d.address, strings.TrimPrefix(d.address, "tcp://"))
+		}
+		if s.Detect {
+			model = "auto"
+		}
+		if len(s.PowerPIN) > 0 {
+			status = fmt.Sprintf(" power-pin=%s", s.PowerPIN) + status
+		}
+		fmt.Fprintf(w, "  %s: driver=%s model=%s pin=%s bus=%s interval=%v max-retries=%d location=%q%s\n",
+			s.Name, driver, model, pin, s.Bus, interval, s.MaxRetries, s.Location, status)
+	}
+	mqttSensors, _ := configureMQTTSensors(c.MQTTSensors)
+	for _, s := range mqttSensors {
+		fmt.Fprintf(w, "  %s: driver=mqtt format=%s location=%q\n", s.name, s.format, s.location)
+	}
+	bleSensors, _ := configureBLESensors(c.BLESensors)
+	for _, s := range bleSensors {
+		fmt.Fprintf(w, "  %s: driver=ble mac=%s location=%q\n", s.name, s.mac, s.location)
+	}
+	if c.BLE && c.BLEDiscover > 0 {
+		fmt.Fprintf(w, "  up to %d recognized BLE thermometers\n", c.BLEDiscover)
+	}
+
+	thresholds, _ := configureThresholds(c.Thresholds)
+	if len(thresholds) > 0 {
+		fmt.Fprintln(w, "Thresholds:")
+		for _, t := range thresholds {
+			sensor := t.sensor
+			if len(sensor) == 0 {
+				sensor = "all sensors"
+			}
+			fmt.Fprintf(w, "  %s: %s on %s\n", t.name, t, sensor)
+		}
+	}
+
+	fmt.Fprintln(w, "Outputs:")
+	fmt.Fprintf(w, "  metrics: http://%s/metrics every %v\n", c.ListenAddr, c.ReadSeconds)
+	if len(c.APIToken) > 0 {
+		fmt.Fprintf(w, "  api: http://%s/api/v1/read\n", c.ListenAddr)
+	}
+	if c.PushReceiver {
+		fmt.Fprintf(w, "  push receiver: http://%s/api/v1/push\n", c.ListenAddr)
+	}
+	if len(c.GRPCListenAddr) > 0 {
+		fmt.Fprintf(w, "  grpc: %s\n", c.GRPCListenAddr)
+	}
+	if len(c.WebhookURL) > 0 {
+		u, _ := url.Parse(c.WebhookURL)
+		fmt.Fprintf(w, "  webhook: %s%s\n", u.Redacted(), check("webhook", urlHostPort(u)))
+		if len(c.WebhookBufferFile) > 0 {
+			fmt.Fprintf(w, "  webhook buffer: %s up to %d readings, dropping the %s\n", c.WebhookBufferFile, c.WebhookBufferSize, c.WebhookBufferDrop)
+		}
+	}
+	for _, raw := range c.AlertmanagerURLs {
+		u, _ := url.Parse(raw)
+		fmt.Fprintf(w, "  alertmanager: %s%s\n", u.Redacted(), check("Alertmanager", urlHostPort(u)))
+	}
+	if len(c.ConsulAddr) > 0 {
+		u, err := url.Parse(c.ConsulAddr)
+		address := ""
+		if err == nil {
+			address = urlHostPort(u)
+		}
+		fmt.Fprintf(w, "  consul: %s service %s%s\n", c.ConsulAddr, c.ConsulServiceName, check("Consul", address))
+	}
+	if len(c.MQTTBroker) > 0 {
+		u, err := url.Parse(c.MQTTBroker)
+		address := ""
+		if err == nil {
+			address = u.Host
+		}
+		fmt.Fprintf(w, "  mqtt: %s%s\n", c.MQTTBroker, check("MQTT broker", address))
+	}
+	if len(c.Display) > 0 {
+		fmt.Fprintf(w, "  display: %s\n", c.Display)
+	}
+	if len(c.StatusPIN) > 0 {
+		fmt.Fprintf(w, "  status: %s on pin %s\n", c.StatusMode, c.StatusPIN)
+	}
+	if c.MDNS {
+		fmt.Fprintf(w, "  mdns: %s\n", c.MDNSService)
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// checkPinConflicts makes sure no GPIO pin is used twice. Sensors on a
+// different driver have no GPIO pin.
+func (c *serveCommand) checkPinConflicts() error {
+	used := map[int]string{}
+	use := func(pin int, user string) error {
+		if other, ok := used[pin]; ok {
+			return fmt.Errorf("GPIO pin %d is used by %s and %s", pin, other, user)
+		}
+		used[pin] = user
+		return nil
+	}
+	for _, s := range sensors {
+		if d, ok := s.Driver.(*dhtDriver); ok {
+			if err := use(d.pin, "sensor "+s.Name); err != nil {
+				return err
+			}
+		}
+	}
+	if pin, ok := gpioNumber(c.StatusPIN); ok {
+		if err := use(pin, "--status-pin"); err != nil {
+			return err
+		}
+	}
+	// sensors can share a power pin, e.g. a MOSFET powering all of them
+	power := map[int]bool{}
+	for _, s := range sensors {
+		if pin, ok := gpioNumber(s.PowerPIN); ok && !power[pin] {
+			if err := use(pin, "power of sensor "+s.Name); err != nil {
+				return err
+			}
+			power[pin] = true
+		}
+	}
+	pins := displayPins[c.Display]
+	displayed := make([]int, 0, len(pins))
+	for pin := range pins {
+		displayed = append(displayed, pin)
+	}
+	sort.Ints(displayed)
+	for _, pin := range displayed {
+		if err := use(pin, fmt.Sprintf("the %s of --display", pins[pin])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkThresholdSensors makes sure the thresholds limited to a sensor refer to
+// a configured one, a misspelled sensor would never breach the threshold. The
+// pushed sensors and the discovered BLE thermometers are only known once they
+// report, their names are accepted when they are enabled.
+func (c *serveCommand) checkThresholdSensors(thresholds []*threshold) error {
+	names := map[string]bool{}
+	for _, s := range sensors {
+		names[s.Name] = true
+	}
+	mqttSensors, err := configureMQTTSensors(c.MQTTSensors)
+	if err != nil {
+		return err
+	}
+	for _, s := range mqttSensors {
+		names[s.name] = true
+	}
+	bleSensors, err := configureBLESensors(c.BLESensors)
+	if err != nil {
+		return err
+	}
+	for _, s := range bleSensors {
+		names[s.name] = true
+	}
+	for _, t := range thresholds {
+		switch {
+		case len(t.sensor) == 0 || names[t.sensor]:
+		case c.PushReceiver && strings.Contains(t.sensor, "/"):
+		case c.BLEDiscover > 0 && isBLEAddress(t.sensor):
+		default:
+			return fmt.Errorf("unknown sensor %s in threshold %s", t.sensor, t.name)
+		}
+	}
+	return nil
+}
+
+// gpioNumber returns the number of a GPIO pin name like 17 or GPIO17.
+func gpioNumber(name string) (int, bool) {
+	pin, err := strconv.Atoi(strings.TrimPrefix(strings.ToUpper(name), "GPIO"))
+	return pin, err == nil
+}
+
+// urlHostPort returns the host and port of the URL, with the default port of
+// the http and https schemes.
+func urlHostPort(u *url.URL) string {
+	if len(u.Port()) > 0 {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
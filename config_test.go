@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCheckPinConflicts(t *testing.T) {
+	tests := []struct {
+		name      string
+		pins      []int
+		powerPins []string
+		statusPIN string
+		display   string
+		wantErr   string
+	}{
+		{name: "distinct pins", pins: []int{4, 17}, statusPIN: "GPIO27"},
+		{name: "shared power pin", pins: []int{4, 17}, powerPins: []string{"22", "GPIO22"}},
+		{name: "two sensors", pins: []int{4, 4}, wantErr: "GPIO pin 4 is used by sensor s0 and sensor s1"},
+		{name: "sensor and status pin", pins: []int{4}, statusPIN: "gpio4", wantErr: "GPIO pin 4 is used by sensor s0 and --status-pin"},
+		{name: "sensor and power pin", pins: []int{4, 17}, powerPins: []string{"17", ""}, wantErr: "GPIO pin 17 is used by sensor s1 and power of sensor s0"},
+		{name: "oled", pins: []int{4}, statusPIN: "17", display: displaySSD1306},
+		{name: "sensor and oled", pins: []int{3}, display: displaySSD1306, wantErr: "GPIO pin 3 is used by sensor s0 and the I2C SCL of --display"},
+		{name: "e-paper", pins: []int{4}, statusPIN: "27", display: displayEPD2in13v2},
+		{name: "status pin and e-paper", pins: []int{4}, statusPIN: "GPIO17", display: displayEPD2in13v2, wantErr: "GPIO pin 17 is used by --status-pin and the reset of --display"},
+		{name: "power pin and e-paper", pins: []int{4}, powerPins: []string{"25"}, display: displayEPD2in13v2, wantErr: "GPIO pin 25 is used by power of sensor s0 and the data/command of --display"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previous := sensors
+			t.Cleanup(func() { sensors = previous })
+			sensors = nil
+			for i, pin := range tt.pins {
+				s := &sensorConfig{Name: fmt.Sprintf("s%d", i), Driver: &dhtDriver{pin: pin}}
+				if i < len(tt.powerPins) {
+					s.PowerPIN = tt.powerPins[i]
+				}
+				sensors = append(sensors, s)
+			}
+			c := &serveCommand{StatusPIN: tt.statusPIN, Display: tt.display}
+			err := c.checkPinConflicts()
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckThresholdSensors(t *testing.T) {
+	tests := []struct {
+		name       string
+		command    serveCommand
+		thresholds []string
+		wantErr    string
+	}{
+		{name: "all sensors", thresholds: []string{"name=cold,value=temperature,min=5"}},
+		{name: "local sensor", thresholds: []string{"name=cold,sensor=attic,value=temperature,min=5"}},
+		{
+			name:       "misspelled sensor",
+			thresholds: []string{"name=cold,sensor=atic,value=temperature,min=5"},
+			wantErr:    "unknown sensor atic in threshold cold",
+		},
+		{
+			name:       "mqtt sensor",
+			command:    serveCommand{MQTTSensors: mqttSpecs(t, "name=shed,format=json,topic=shed")},
+			thresholds: []string{"name=cold,sensor=shed,value=temperature,min=5"},
+		},
+		{
+			name:       "ble sensor",
+			command:    serveCommand{BLESensors: bleSpecs(t, "mac=a4:c1:38:12:34:56")},
+			thresholds: []string{"name=cold,sensor=A4:C1:38:12:34:56,value=temperature,min=5"},
+		},
+		{
+			name:       "discovered ble sensor",
+			command:    serveCommand{BLEDiscover: 5},
+			thresholds: []string{"name=cold,sensor=A4:C1:38:12:34:56,value=temperature,min=5"},
+		},
+		{
+			name:       "ble sensor without discovery",
+			thresholds: []string{"name=cold,sensor=A4:C1:38:12:34:56,value=temperature,min=5"},
+			wantErr:    "unknown sensor A4:C1:38:12:34:56",
+		},
+		{
+			name:       "pushed sensor",
+			command:    serveCommand{PushReceiver: true},
+			thresholds: []string{"name=cold,sensor=garage/dht,value=temperature,min=5"},
+		},
+		{
+			name:       "pushed sensor without the push receiver",
+			thresholds: []string{"name=cold,sensor=garage/dht,value=temperature,min=5"},
+			wantErr:    "unknown sensor garage/dht",
+		},
+	}
+	previous := sensors
+	t.Cleanup(func() { sensors = previous })
+	sensors = []*sensorConfig{{Name: "attic"}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			thresholds, err := parseThresholds(t, tt.thresholds...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tt.command.checkThresholdSensors(thresholds)
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
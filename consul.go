@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// consulFailureThreshold is the number of consecutive failed reads of a sensor
+// after which the health check turns critical. A single failed read only sets
+// a warning.
+const consulFailureThreshold = 3
+
+// consulRegistration registers the exporter as a Consul service with a TTL
+// health check that follows the sensor read results.
+type consulRegistration struct {
+	client    *http.Client
+	addr      string
+	token     string
+	serviceID string
+	checkID   string
+	ttl       time.Duration
+
+	// deregistered makes sure the service is deregistered only once
+	deregistered sync.Once
+
+	mu sync.Mutex
+	// failures counts the consecutive failed reads of every sensor
+	failures map[string]int
+	outputs  map[string]string
+	// changed wakes up the heartbeat to update the check, the readings are
+	// observed without waiting for Consul
+	changed chan struct{}
+}
+
+type consulServiceRegistration struct {
+	ID      string
+	Name    string
+	Tags    []string          `json:",omitempty"`
+	Address string            `json:",omitempty"`
+	Port    int               `json:",omitempty"`
+	Meta    map[string]string `json:",omitempty"`
+	Check   consulCheck
+}
+
+type consulCheck struct {
+	CheckID                        string
+	Name                           string
+	TTL                            string
+	DeregisterCriticalServiceAfter string `json:",omitempty"`
+}
+
+// registerConsul registers the service listening on addr with the Consul agent.
+func (c *serveCommand) registerConsul(addr net.Addr) (*consulRegistration, error) {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("unsupported listener address %v", addr)
+	}
+	serviceAddress := c.ConsulServiceAddress
+	if len(serviceAddress) == 0 && tcpAddr.IP != nil && !tcpAddr.IP.IsUnspecified() {
+		serviceAddress = tcpAddr.IP.String()
+	}
+	serviceID := c.ConsulServiceID
+	if len(serviceID) == 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("unable to get hostname: %v", err)
+		}
+		serviceID = c.ConsulServiceName + "-" + hostname
+	}
+
+	r := &consulRegistration{
+		client:    &http.Client{Timeout: 10 * time.Second},
+		addr:      strings.TrimSuffix(c.ConsulAddr, "/"),
+		token:     c.ConsulToken,
+		serviceID: serviceID,
+		checkID:   "service:" + serviceID,
+		ttl:       c.ConsulTTL,
+		failures:  map[string]int{},
+		outputs:   map[string]string{},
+		changed:   make(chan struct{}, 1),
+	}
+
+	meta := map[string]string{
+		"metrics_path": "/metrics",
+		"sensor":       strings.Join(sensorNames(), ","),
+	}
+	if locations := sensorLocations(); len(locations) > 0 {
+		meta["location"] = strings.Join(locations, ",")
+	}
+	err := r.put("/v1/agent/service/register", consulServiceRegistration{
+		ID:      serviceID,
+		Name:    c.ConsulServiceName,
+		Tags:    c.ConsulTags,
+		Address: serviceAddress,
+		Port:    tcpAddr.Port,
+		Meta:    meta,
+		Check: consulCheck{
+			CheckID:                        r.checkID,
+			Name:                           "DHT sensor reads",
+			TTL:                            c.ConsulTTL.String(),
+			DeregisterCriticalServiceAfter: c.ConsulDeregisterAfter.String(),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Registered with Consul", "addr", r.addr, "service", c.ConsulServiceName, "id", serviceID)
+	return r, nil
+}
+
+// observeReading updates the health check status with the read result, the
+// heartbeat sends it to Consul.
+func (r *consulRegistration) observeReading(sensor string, _ *reading, err error) {
+	r.mu.Lock()
+	if err != nil {
+		r.failures[sensor]++
+		r.outputs[sensor] = fmt.Sprintf("%s: %d consecutive failed reads, last error: %v", sensor, r.failures[sensor], err)
+	} else {
+		r.failures[sensor] = 0
+		r.outputs[sensor] = fmt.Sprintf("%s: read succeeded", sensor)
+	}
+	r.mu.Unlock()
+	select {
+	case r.changed <- struct{}{}:
+	default:
+	}
+}
+
+// checkStatus returns the status of the health check, which is the worst
+// status of all sensors. Sensors are warning until they are read.
+func (r *consulRegistration) checkStatus() (status, output string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status = "passing"
+	var lines []string
+	for _, name := range sensorNames() {
+		failures, ok := r.failures[name]
+		switch {
+		case !ok:
+			if status == "passing" {
+				status = "warning"
+			}
+			lines = append(lines, name+": waiting for the first measurement")
+			continue
+		case failures >= consulFailureThreshold:
+			status = "critical"
+		case failures > 0 && status == "passing":
+			status = "warning"
+		}
+		lines = append(lines, r.outputs[name])
+	}
+	return status, strings.Join(lines, "\n")
+}
+
+func (r *consulRegistration) updateCheck() {
+	status, output := r.checkStatus()
+	err := r.put("/v1/agent/check/update/"+r.checkID, map[string]string{
+		"Status": status,
+		"Output": output,
+	})
+	if err != nil {
+		log.Warn("Unable to update Consul health check", "err", err)
+	}
+}
+
+// heartbeat updates the TTL check when a read result changes it and refreshes
+// it periodically until the context is cancelled, so the check doesn't expire
+// when the measurement interval is longer than the TTL.
+func (r *consulRegistration) heartbeat(ctx context.Context) {
+	ticker := time.NewTicker(r.ttl / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.changed:
+		case <-ticker.C:
+		}
+		r.updateCheck()
+	}
+}
+
+// deregister removes the service from Consul, repeated calls do nothing.
+func (r *consulRegistration) deregister() {
+	r.deregistered.Do(func() {
+		if err := r.put("/v1/agent/service/deregister/"+r.serviceID, nil); err != nil {
+			log.Warn("Unable to deregister from Consul", "err", err)
+			return
+		}
+		log.Info("Deregistered from Consul", "id", r.serviceID)
+	})
+}
+
+func (r *consulRegistration) put(path string, body interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(http.MethodPut, r.addr+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(r.token) > 0 {
+		req.Header.Set("X-Consul-Token", r.token)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("consul returned %s for %s", resp.Status, path)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// consulResult is a read result of a sensor observed by the registration.
+type consulResult struct {
+	sensor string
+	err    error
+}
+
+func TestConsulRegistrationCheckStatus(t *testing.T) {
+	errRead := errors.New("CRCs doesn't match")
+	tests := []struct {
+		name    string
+		results []consulResult
+		want    string
+	}{
+		{name: "no reading", want: "warning"},
+		{name: "success", results: []consulResult{{"attic", nil}, {"cellar", nil}}, want: "passing"},
+		{name: "sensor not read yet", results: []consulResult{{"attic", nil}}, want: "warning"},
+		{name: "single failure", results: []consulResult{{"attic", errRead}, {"cellar", nil}}, want: "warning"},
+		{
+			name:    "failures at the threshold",
+			results: []consulResult{{"attic", errRead}, {"attic", errRead}, {"attic", errRead}, {"cellar", nil}},
+			want:    "critical",
+		},
+		{
+			name:    "failures counted per sensor",
+			results: []consulResult{{"attic", errRead}, {"cellar", errRead}, {"attic", errRead}, {"cellar", errRead}},
+			want:    "warning",
+		},
+		{
+			name:    "success resets the failures",
+			results: []consulResult{{"attic", errRead}, {"attic", errRead}, {"attic", nil}, {"attic", errRead}, {"cellar", nil}},
+			want:    "warning",
+		},
+		{
+			name:    "recovered",
+			results: []consulResult{{"attic", errRead}, {"attic", errRead}, {"attic", errRead}, {"attic", nil}, {"cellar", nil}},
+			want:    "passing",
+		},
+	}
+	defer func(s []*sensorConfig) { sensors = s }(sensors)
+	sensors = []*sensorConfig{{Name: "attic"}, {Name: "cellar"}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var updates []map[string]string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPut || r.URL.Path != "/v1/agent/check/update/service:dht" {
+					t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+				}
+				if token := r.Header.Get("X-Consul-Token"); token != "secret" {
+					t.Errorf("got token %q, want secret", token)
+				}
+				var update map[string]string
+				if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+					t.Errorf("invalid check update: %v", err)
+				}
+				updates = append(updates, update)
+			}))
+			defer server.Close()
+			r := &consulRegistration{
+				client:    server.Client(),
+				addr:      server.URL,
+				token:     "secret",
+				serviceID: "dht",
+				checkID:   "service:dht",
+				ttl:       time.Minute,
+				failures:  map[string]int{},
+				outputs:   map[string]string{},
+			}
+			for _, result := range tt.results {
+				var rd *reading
+				if result.err == nil {
+					rd = newReading(result.sensor, 21, 40, 0)
+				}
+				r.observeReading(result.sensor, rd, result.err)
+			}
+			r.updateCheck()
+			if len(updates) == 0 {
+				t.Fatal("the check was not updated")
+			}
+			if status := updates[len(updates)-1]["Status"]; status != tt.want {
+				t.Errorf("got status %q, want %q", status, tt.want)
+			}
+		})
+	}
+}
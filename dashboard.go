@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+type dashboardCommand struct {
+	Title string `long:"title" description:"dashboard title" default:"DHT Sensors"`
+	UID   string `long:"uid" description:"dashboard UID" default:"dht-sensors"`
+}
+
+type dashboardPanel struct {
+	Type        string                 `json:"type"`
+	Title       string                 `json:"title"`
+	GridPos     map[string]int         `json:"gridPos"`
+	Datasource  map[string]string      `json:"datasource"`
+	FieldConfig map[string]interface{} `json:"fieldConfig"`
+	Targets     []dashboardTarget      `json:"targets"`
+}
+
+type dashboardTarget struct {
+	Expr         string `json:"expr"`
+	LegendFormat string `json:"legendFormat"`
+	RefID        string `json:"refId"`
+}
+
+var dashboardDatasource = map[string]string{"type": "prometheus", "uid": "${datasource}"}
+
+func (c *dashboardCommand) Execute(_ []string) error {
+	panels := []struct {
+		title  string
+		metric string
+		unit   string
+	}{
+		{"Temperature", "last_temperature", "celsius"},
+		{"Humidity", "last_humidity", "humidity"},
+		{"Vapor pressure deficit", "last_vapor_pressure_deficit", "pressurekpa"},
+		{"Dew point", "last_dew_point", "celsius"},
+		{"Seconds between successful measurements", "last_successful_measurement_seconds", "s"},
+		{"Measurement retries", "last_measurement_retries", "short"},
+	}
+
+	var dashboardPanels []dashboardPanel
+	for i, p := range panels {
+		dashboardPanels = append(dashboardPanels, dashboardPanel{
+			Type:       "timeseries",
+			Title:      p.title,
+			GridPos:    map[string]int{"h": 8, "w": 12, "x": (i % 2) * 12, "y": (i / 2) * 8},
+			Datasource: dashboardDatasource,
+			FieldConfig: map[string]interface{}{
+				"defaults": map[string]interface{}{"unit": p.unit},
+			},
+			Targets: []dashboardTarget{{
+				Expr:         fmt.Sprintf(`%s{sensor=~"$sensor"}`, fullMetricName(p.metric)),
+				LegendFormat: "{{sensor}}",
+				RefID:        "A",
+			}},
+		})
+	}
+
+	dashboard := map[string]interface{}{
+		"title":         c.Title,
+		"uid":           c.UID,
+		"schemaVersion": 38,
+		"editable":      true,
+		"refresh":       "1m",
+		"time":          map[string]string{"from": "now-24h", "to": "now"},
+		"templating": map[string]interface{}{
+			"list": []map[string]interface{}{
+				{
+					"name":  "datasource",
+					"label": "Data source",
+					"type":  "datasource",
+					"query": "prometheus",
+				},
+				{
+					"name":       "sensor",
+					"label":      "Sensor",
+					"type":       "query",
+					"datasource": dashboardDatasource,
+					"query":      fmt.Sprintf("label_values(%s, sensor)", fullMetricName("sensor_info")),
+					"refresh":    2,
+					"multi":      true,
+					"includeAll": true,
+				},
+			},
+		},
+		"panels": dashboardPanels,
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(dashboard)
+}
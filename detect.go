@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/d2r2/go-dht"
+)
+
+// detectSensorTypes probes the DHT sensors configured with detection and sets
+// their type. Sensors that can't be detected keep the configured type.
+func detectSensorTypes(ctx context.Context) {
+	for _, s := range sensors {
+		d, ok := s.Driver.(*dhtDriver)
+		if !ok || !s.Detect {
+			continue
+		}
+		sensorType, err := detectSensorType(ctx, s, d.pin)
+		if err != nil {
+			log.Warn("Unable to detect the sensor type, using the configured one", "sensor", s.Name, "type", sensorModel(s.Type), "err", err)
+			continue
+		}
+		log.Info("Detected sensor type", "sensor", s.Name, "pin", d.pin, "type", sensorModel(sensorType))
+		s.Type = sensorType
+		d.sensorType = sensorType
+	}
+}
+
+// detectSensorType reads the sensor as a DHT22 first. A DHT11 answers with
+// the humidity in the first byte, which decoded as a DHT22 is always above
+// 100%, while the DHT22 values decoded as a DHT11 would be implausible. The
+// DHT11 is confirmed by a successful read.
+func detectSensorType(ctx context.Context, s *sensorConfig, pin int) (dht.SensorType, error) {
+	var lastErr error
+	for attempt := 0; attempt <= s.MaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			case <-time.After(dht.DHT22.GetRetryTimeout()):
+			}
+		}
+		candidate := dht.DHT22
+		_, _, err := readDHT(s, dht.DHT22, pin)
+		if err != nil && strings.Contains(err.Error(), "Humidity value exceed 100%") {
+			select {
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			case <-time.After(dht.DHT11.GetRetryTimeout()):
+			}
+			candidate = dht.DHT11
+			_, _, err = readDHT(s, dht.DHT11, pin)
+		}
+		if err == nil {
+			return candidate, nil
+		}
+		log.Debug("Sensor type detection attempt failed", "sensor", s.Name, "attempt", attempt+1, "err", err)
+		lastErr = err
+	}
+	return 0, lastErr
+}
+
+// readDHT performs a single read of the sensor as the given type with the
+// bus locked.
+func readDHT(s *sensorConfig, sensorType dht.SensorType, pin int) (temperature, humidity float64, err error) {
+	lock := busLock(s.Bus)
+	lock.Lock()
+	defer lock.Unlock()
+	return (&dhtDriver{sensorType: sensorType, pin: pin}).read()
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Exit codes of the test command.
+const (
+	exitTestOther      = 1
+	exitTestPermission = 2
+	exitTestWiring     = 3
+	exitTestTimeout    = 4
+)
+
+type testCommand struct {
+	Count          uint          `short:"n" long:"count" description:"number of reads to perform" default:"5"`
+	Delay          time.Duration `long:"delay" description:"delay between reads, the sensor needs at least 1.5s between reads" default:"2s"`
+	MaxFailureRate float64       `long:"max-failure-rate" description:"fail the test when the ratio of failed reads is higher than this" default:"0.5"`
+}
+
+func (c *testCommand) Execute(_ []string) error {
+	// the driver logs every failed read to stdout, the report below covers them
+	quietDriverLogs()
+	if c.Count == 0 {
+		return errors.New("--count must be greater than zero")
+	}
+
+	if usesGPIO() {
+		if err := checkGPIOAccess(); err != nil {
+			fmt.Printf("GPIO access:      FAILED (%v)\n", err)
+			return &exitError{code: exitTestPermission, err: err}
+		}
+		fmt.Println("GPIO access:      OK")
+	}
+
+	detectSensorTypes(context.Background())
+
+	// all sensors are tested, the exit code reports the first failing one
+	var testErr error
+	for _, s := range sensors {
+		fmt.Println()
+		if err := c.testSensor(s); err != nil && testErr == nil {
+			testErr = err
+		}
+	}
+	return testErr
+}
+
+// testSensor reads the sensor --count times and reports the results.
+func (c *testCommand) testSensor(s *sensorConfig) error {
+	model, pin, driver := s.Driver.info()
+	fmt.Printf("Testing %s sensor %q (%s, pin %s)\n", model, s.Name, driver, pin)
+
+	var (
+		durations []time.Duration
+		failures  = map[string]int{}
+		noReply   int
+		lastErr   error
+	)
+	for i := uint(0); i < c.Count; i++ {
+		if i > 0 {
+			time.Sleep(c.Delay)
+		}
+		start := time.Now()
+		temperature, humidity, err := readSensorOnce(s)
+		duration := time.Since(start)
+		durations = append(durations, duration)
+		if err != nil {
+			errorType := classifyError(err)
+			failures[errorType]++
+			if isNoResponse(err) {
+				noReply++
+			}
+			lastErr = err
+			fmt.Printf("Read %d/%d:       %s error after %v: %v\n", i+1, c.Count, errorType, duration.Round(time.Millisecond), err)
+			continue
+		}
+		fmt.Printf("Read %d/%d:       %.1f°C, %.1f%% in %v\n", i+1, c.Count, temperature, humidity, duration.Round(time.Millisecond))
+	}
+
+	failed := 0
+	for _, n := range failures {
+		failed += n
+	}
+	min, avg, max := durationStats(durations)
+	fmt.Printf("Failed reads:     %d/%d (%.0f%%)\n", failed, c.Count, 100*float64(failed)/float64(c.Count))
+	fmt.Printf("Checksum errors:  %d (%.0f%%)\n", failures[errorTypeChecksum], 100*float64(failures[errorTypeChecksum])/float64(c.Count))
+	fmt.Printf("Timing errors:    %d\n", failures[errorTypeTimeout])
+	fmt.Printf("GPIO errors:      %d\n", failures[errorTypeGPIO])
+	fmt.Printf("Read duration:    min %v, avg %v, max %v\n", min.Round(time.Millisecond), avg.Round(time.Millisecond), max.Round(time.Millisecond))
+
+	if float64(failed)/float64(c.Count) <= c.MaxFailureRate {
+		fmt.Println("Result:           OK")
+		return nil
+	}
+
+	// report the most likely cause of the failures
+	switch {
+	case failures[errorTypeGPIO] > 0:
+		return &exitError{code: exitTestPermission, err: fmt.Errorf("pin %s of sensor %s is not accessible: %v", pin, s.Name, lastErr)}
+	case noReply*2 >= failed || failures[errorTypeChecksum]*2 >= failed:
+		return &exitError{code: exitTestWiring, err: fmt.Errorf("sensor %s is not responding reliably, check the wiring and the pull-up resistor: %v", s.Name, lastErr)}
+	case failures[errorTypeTimeout] > 0:
+		return &exitError{code: exitTestTimeout, err: fmt.Errorf("sensor %s responses timed out, the system may be too loaded for bit-banging: %v", s.Name, lastErr)}
+	default:
+		return &exitError{code: exitTestOther, err: lastErr}
+	}
+}
+
+// usesGPIO reports whether any of the configured sensors is read over GPIO.
+func usesGPIO() bool {
+	for _, s := range sensors {
+		if _, ok := s.Driver.(*dhtDriver); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkGPIOAccess verifies the sysfs GPIO interface used by the driver is
+// available and writable.
+func checkGPIOAccess() error {
+	if _, err := os.Stat("/sys/class/gpio"); err != nil {
+		return fmt.Errorf("sysfs GPIO interface is not available: %v", err)
+	}
+	f, err := os.OpenFile("/sys/class/gpio/export", os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("unable to open GPIO export for writing, run as root or add the user to the gpio group: %v", err)
+	}
+	return f.Close()
+}
+
+func durationStats(durations []time.Duration) (min, avg, max time.Duration) {
+	if len(durations) == 0 {
+		return 0, 0, 0
+	}
+	var sum time.Duration
+	min = durations[0]
+	for _, d := range durations {
+		sum += d
+		if d < min {
+			min = d
+		}
+		if d > max {
+			max = d
+		}
+	}
+	return min, sum / time.Duration(len(durations)), max
+}
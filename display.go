@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"sync"
+	"time"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+	"periph.io/x/conn/v3/display"
+	"periph.io/x/conn/v3/i2c/i2creg"
+	"periph.io/x/conn/v3/spi/spireg"
+	"periph.io/x/devices/v3/ssd1306"
+	"periph.io/x/devices/v3/ssd1306/image1bit"
+	"periph.io/x/devices/v3/waveshare2in13v2"
+	"periph.io/x/host/v3"
+)
+
+// Supported displays.
+const (
+	// displaySSD1306 is a 128x64 SSD1306 OLED at the I2C address 0x3C.
+	displaySSD1306 = "ssd1306"
+	// displayEPD2in13v2 is the Waveshare 2.13" e-paper HAT V2 on SPI.
+	displayEPD2in13v2 = "epd2in13v2"
+)
+
+// displayPins lists the GPIO pins used by the displays and what they are used
+// for. The SSD1306 is on the I2C1 bus, the e-paper HAT on SPI0 with the reset,
+// busy and data/command pins wired by the HAT.
+var displayPins = map[string]map[int]string{
+	displaySSD1306:    {2: "I2C SDA", 3: "I2C SCL"},
+	displayEPD2in13v2: {8: "SPI CE0", 10: "SPI MOSI", 11: "SPI SCLK", 17: "reset", 24: "busy", 25: "data/command"},
+}
+
+// localDisplay renders the last reading of the measured sensor on a display
+// attached to the Pi.
+type localDisplay struct {
+	dev display.Drawer
+	// paper and ink are the background and text colors, lit pixels are the
+	// text on an OLED but the background on e-paper
+	paper, ink color.Color
+	closeBus   func() error
+
+	// pages receives the page to render, only the latest one is kept when the
+	// display is slower than the measurements
+	pages chan displayPage
+	done  chan struct{}
+
+	// mu guards the pages queue against concurrent observers and readings
+	// pushed after it was closed
+	mu     sync.Mutex
+	closed bool
+	// last is the last reading per sensor
+	last map[string]*reading
+}
+
+// displayPage is the content of the display for a single sensor.
+type displayPage struct {
+	sensor string
+	r      *reading
+	status string
+}
+
+// openDisplay initializes the display configured by the --display options.
+func (c *serveCommand) openDisplay() (*localDisplay, error) {
+	if _, err := host.Init(); err != nil {
+		return nil, fmt.Errorf("unable to initialize periph: %v", err)
+	}
+	d := &localDisplay{
+		pages: make(chan displayPage, 1),
+		done:  make(chan struct{}),
+		last:  map[string]*reading{},
+	}
+	switch c.Display {
+	case displaySSD1306:
+		bus, err := i2creg.Open(c.DisplayBus)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open I2C bus: %v", err)
+		}
+		o := ssd1306.DefaultOpts
+		o.Rotated = c.DisplayRotate
+		dev, err := ssd1306.NewI2C(bus, &o)
+		if err != nil {
+			bus.Close()
+			return nil, err
+		}
+		d.dev, d.closeBus = dev, bus.Close
+		d.paper, d.ink = image1bit.Off, image1bit.On
+	case displayEPD2in13v2:
+		port, err := spireg.Open(c.DisplayBus)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open SPI port: %v", err)
+		}
+		o := waveshare2in13v2.EPD2in13v2
+		if c.DisplayRotate {
+			o.Origin = waveshare2in13v2.BottomRight
+		}
+		dev, err := waveshare2in13v2.NewHat(port, &o)
+		if err == nil {
+			err = dev.Init()
+		}
+		if err != nil {
+			port.Close()
+			return nil, err
+		}
+		// the first page is drawn with a full refresh, the next ones only
+		// update the changed pixels to keep the flicker and wear low
+		d.dev, d.closeBus = &epaperDisplay{Dev: dev}, port.Close
+		d.paper, d.ink = image1bit.On, image1bit.Off
+	default:
+		return nil, fmt.Errorf("unsupported display %q", c.Display)
+	}
+	go d.run()
+	return d, nil
+}
+
+// epaperDisplay switches the e-paper display to partial updates after the
+// first page.
+type epaperDisplay struct {
+	*waveshare2in13v2.Dev
+	partial bool
+}
+
+func (d *epaperDisplay) Draw(r image.Rectangle, src image.Image, sp image.Point) error {
+	if err := d.Dev.Draw(r, src, sp); err != nil {
+		return err
+	}
+	if !d.partial {
+		d.partial = true
+		return d.Dev.SetUpdateMode(waveshare2in13v2.Partial)
+	}
+	return nil
+}
+
+// observeReading shows the measured sensor. Failed reads keep the last values
+// of the sensor with the error type as the status.
+func (d *localDisplay) observeReading(sensor string, r *reading, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return
+	}
+	page := displayPage{sensor: sensor, r: r, status: "OK"}
+	if err != nil {
+		page.r, page.status = d.last[sensor], "ERROR "+classifyError(err)
+	} else {
+		d.last[sensor] = r
+	}
+	select {
+	case <-d.pages:
+	default:
+	}
+	d.pages <- page
+}
+
+func (d *localDisplay) run() {
+	defer close(d.done)
+	for page := range d.pages {
+		img := image1bit.NewVerticalLSB(d.dev.Bounds())
+		d.render(img, page)
+		if err := d.dev.Draw(img.Bounds(), img, image.Point{}); err != nil {
+			log.Warn("Unable to update the display", "err", err)
+		}
+	}
+}
+
+// render draws the page with the 7x13 font, one value per line. The time of
+// the reading is left out on the smaller displays.
+func (d *localDisplay) render(img draw.Image, page displayPage) {
+	draw.Draw(img, img.Bounds(), &image.Uniform{d.paper}, image.Point{}, draw.Src)
+	face := basicfont.Face7x13
+	lines := []string{page.sensor + " " + page.status}
+	if page.r != nil {
+		lines = append(lines,
+			fmt.Sprintf("T   %.1f C", page.r.Temperature),
+			fmt.Sprintf("RH  %.1f %%", page.r.Humidity),
+			fmt.Sprintf("VPD %.2f kPa", page.r.VaporPressureDeficit),
+			page.r.Time.Format(time.TimeOnly),
+		)
+	}
+	drawer := font.Drawer{Dst: img, Src: &image.Uniform{d.ink}, Face: face}
+	for i, line := range lines {
+		if (i+1)*face.Height > img.Bounds().Dy() {
+			break
+		}
+		drawer.Dot = fixed.P(1, (i+1)*face.Height-face.Descent)
+		drawer.DrawString(line)
+	}
+}
+
+// closer clears the display and releases the bus, so the display doesn't show
+// values that are no longer updated.
+func (d *localDisplay) closer() outputCloser {
+	return outputCloser{
+		name: "display",
+		close: func(ctx context.Context) error {
+			d.mu.Lock()
+			d.closed = true
+			close(d.pages)
+			d.mu.Unlock()
+			select {
+			case <-d.done:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			img := image1bit.NewVerticalLSB(d.dev.Bounds())
+			draw.Draw(img, img.Bounds(), &image.Uniform{d.paper}, image.Point{}, draw.Src)
+			if err := d.dev.Draw(img.Bounds(), img, image.Point{}); err != nil {
+				return err
+			}
+			if err := d.dev.Halt(); err != nil {
+				return err
+			}
+			return d.closeBus()
+		},
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Types of read errors reported by the DHT driver.
+const (
+	errorTypeChecksum = "checksum"
+	errorTypeTimeout  = "timeout"
+	errorTypeGPIO     = "gpio"
+	errorTypeOther    = "other"
+)
+
+// errorTypes lists the error types in the order they are exported.
+var errorTypes = []string{errorTypeChecksum, errorTypeTimeout, errorTypeGPIO, errorTypeOther}
+
+// classifyError maps an error returned by the DHT driver to one of the error
+// types. The driver only returns plain errors, so this is based on the error
+// messages.
+func classifyError(err error) string {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return errorTypeOther
+	}
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "CRCs doesn't match"):
+		return errorTypeChecksum
+	case strings.Contains(msg, "failed to open GPIO"),
+		strings.Contains(msg, "export pin"),
+		strings.Contains(msg, "failed to open pin"),
+		strings.Contains(msg, "failed to set direction"),
+		strings.Contains(msg, "failed to write value"),
+		strings.Contains(msg, "failed to read value"),
+		strings.Contains(msg, "SCHED_FIFO"):
+		return errorTypeGPIO
+	case strings.Contains(msg, "Can't decode"),
+		strings.Contains(msg, "edge value"),
+		strings.Contains(msg, "pulse count exceed"):
+		return errorTypeTimeout
+	default:
+		return errorTypeOther
+	}
+}
+
+var pulseCountRegexp = regexp.MustCompile(`incorrect length: (\d+)`)
+
+// isNoResponse returns true when the sensor didn't answer the handshake at
+// all, which usually means it is not connected to the configured pin.
+func isNoResponse(err error) bool {
+	match := pulseCountRegexp.FindStringSubmatch(err.Error())
+	if match == nil {
+		return false
+	}
+	count, _ := strconv.Atoi(match[1])
+	return count < 10
+}
+
+// exitError makes the process exit with the given code.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
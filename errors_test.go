@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{errors.New("CRCs doesn't match: checksum from sensor(12) != calculated checksum(13=1+2+3+7)"), errorTypeChecksum},
+		{errors.New("Error during call C.dial_DHTxx_and_read(): failed to open GPIO export for writing"), errorTypeGPIO},
+		{errors.New("Error during call C.dial_DHTxx_and_read(): failed to open pin 17 value for reading"), errorTypeGPIO},
+		{errors.New("Error during call C.dial_DHTxx_and_read(): unable to set SCHED_FIFO priority to the thread"), errorTypeGPIO},
+		{errors.New("Can't decode pulse array received from DHTxx sensor, since incorrect length: 3"), errorTypeTimeout},
+		{errors.New("Low edge value expected at index 12"), errorTypeTimeout},
+		{errors.New("Error during call C.dial_DHTxx_and_read(): pulse count exceed limit in 16000"), errorTypeTimeout},
+		{fmt.Errorf("attempt 2: %w", errors.New("CRCs doesn't match")), errorTypeChecksum},
+		{errors.New("Humidity value cannot be zero"), errorTypeOther},
+		{context.Canceled, errorTypeOther},
+		{fmt.Errorf("read aborted: %w", context.DeadlineExceeded), errorTypeOther},
+	}
+	for _, tt := range tests {
+		t.Run(tt.err.Error(), func(t *testing.T) {
+			if got := classifyError(tt.err); got != tt.want {
+				t.Errorf("classifyError = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsNoResponse(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{errors.New("Can't decode pulse array received from DHTxx sensor, since incorrect length: 1"), true},
+		{errors.New("Can't decode pulse array received from DHTxx sensor, since incorrect length: 9"), true},
+		{errors.New("Can't decode pulse array received from DHTxx sensor, since incorrect length: 70"), false},
+		{errors.New("CRCs doesn't match"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.err.Error(), func(t *testing.T) {
+			if got := isNoResponse(tt.err); got != tt.want {
+				t.Errorf("isNoResponse = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/mdns"
+	"github.com/prometheus/common/model"
+)
+
+type fileSDCommand struct {
+	Output       string            `short:"o" long:"output" description:"file_sd JSON file to write, - for stdout" default:"-" env:"DHT_FILE_SD_OUTPUT"`
+	Targets      []string          `long:"target" description:"exporter host, e.g. attic-pi or attic-pi:2112 (can be repeated)" env:"DHT_FILE_SD_TARGETS" env-delim:","`
+	TargetLabels map[string]string `long:"target-label" description:"label added to all targets, e.g. site:greenhouse (can be repeated)" env:"DHT_FILE_SD_TARGET_LABELS" env-delim:","`
+	MDNS         bool              `long:"mdns" description:"add the exporters advertised via mDNS, see serve --mdns" env:"DHT_FILE_SD_MDNS"`
+	MDNSService  string            `long:"mdns-service" description:"mDNS service type to look up" default:"_prometheus-http._tcp" env:"DHT_FILE_SD_MDNS_SERVICE"`
+	MDNSTimeout  time.Duration     `long:"mdns-timeout" description:"how long to wait for mDNS responses" default:"3s" env:"DHT_FILE_SD_MDNS_TIMEOUT"`
+	Refresh      time.Duration     `long:"refresh" description:"keep running and update the file at this interval, e.g. to follow the exporters coming and going" env:"DHT_FILE_SD_REFRESH"`
+}
+
+// fileSDDefaultPort is the port added to the targets without one.
+const fileSDDefaultPort = "2112"
+
+// fileSDGroup is a target group of the Prometheus file_sd format.
+type fileSDGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+func (c *fileSDCommand) Execute(_ []string) error {
+	if len(c.Targets) == 0 && !c.MDNS {
+		return errors.New("at least one --target or --mdns is required")
+	}
+	for name := range c.TargetLabels {
+		if !model.LabelName(name).IsValid() {
+			return fmt.Errorf("%q is not a valid label name", name)
+		}
+	}
+	if c.Refresh > 0 && c.Output == "-" {
+		return errors.New("--refresh requires an --output file")
+	}
+	if c.Refresh == 0 {
+		return c.update()
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	ticker := time.NewTicker(c.Refresh)
+	defer ticker.Stop()
+	for {
+		// Prometheus keeps the last targets of a file it can't read, so a
+		// failed update only needs to be logged
+		if err := c.update(); err != nil {
+			log.Error("Unable to update the file_sd file", "file", c.Output, "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// update writes the target groups, the file is only replaced when they
+// changed, so Prometheus doesn't reload it needlessly.
+func (c *fileSDCommand) update() error {
+	groups, err := c.groups()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(groups, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if c.Output == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	if current, err := os.ReadFile(c.Output); err == nil && bytes.Equal(current, data) {
+		return nil
+	}
+	// Prometheus watches the file, replace it at once so it never reads a
+	// partial file
+	tmp, err := os.CreateTemp(filepath.Dir(c.Output), ".file_sd-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), c.Output); err != nil {
+		return err
+	}
+	log.Info("Updated the file_sd file", "file", c.Output, "targets", len(groups))
+	return nil
+}
+
+// groups returns one target group per exporter ordered by the target, so the
+// labels of every exporter can differ.
+func (c *fileSDCommand) groups() ([]fileSDGroup, error) {
+	byTarget := map[string]fileSDGroup{}
+	for _, target := range c.Targets {
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			target = net.JoinHostPort(target, fileSDDefaultPort)
+		}
+		byTarget[target] = fileSDGroup{Targets: []string{target}, Labels: c.labels(nil)}
+	}
+	if c.MDNS {
+		entries, err := c.lookupMDNS()
+		if err != nil {
+			return nil, fmt.Errorf("mDNS lookup failed: %v", err)
+		}
+		for _, entry := range entries {
+			host := strings.TrimSuffix(entry.Host, ".")
+			if entry.AddrV4 != nil {
+				host = entry.AddrV4.String()
+			}
+			target := net.JoinHostPort(host, fmt.Sprint(entry.Port))
+			// the static targets take precedence
+			if _, ok := byTarget[target]; !ok {
+				byTarget[target] = fileSDGroup{Targets: []string{target}, Labels: c.labels(entry.InfoFields)}
+			}
+		}
+	}
+	groups := []fileSDGroup{}
+	for _, group := range byTarget {
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Targets[0] < groups[j].Targets[0] })
+	return groups, nil
+}
+
+// labels returns the target labels from the TXT records advertised by the
+// exporter and the --target-label options. The metrics path becomes the
+// __metrics_path__ label.
+func (c *fileSDCommand) labels(txt []string) map[string]string {
+	labels := map[string]string{}
+	for _, field := range txt {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || len(value) == 0 {
+			continue
+		}
+		switch key {
+		case "path":
+			if value != "/metrics" {
+				labels[model.MetricsPathLabel] = value
+			}
+		case "sensor":
+			labels["sensors"] = value
+		case "location":
+			labels["location"] = value
+		}
+	}
+	for name, value := range c.TargetLabels {
+		labels[name] = value
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+	return labels
+}
+
+// lookupMDNS returns the exporters that answered within the timeout.
+func (c *fileSDCommand) lookupMDNS() ([]*mdns.ServiceEntry, error) {
+	found := make(chan *mdns.ServiceEntry, 32)
+	var entries []*mdns.ServiceEntry
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for entry := range found {
+			entries = append(entries, entry)
+		}
+	}()
+	params := mdns.DefaultParams(c.MDNSService)
+	params.Entries = found
+	params.Timeout = c.MDNSTimeout
+	params.DisableIPv6 = true
+	err := mdns.Query(params)
+	close(found)
+	<-done
+	return entries, err
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFileSDGroups(t *testing.T) {
+	tests := []struct {
+		name    string
+		command fileSDCommand
+		want    []fileSDGroup
+	}{
+		{
+			name:    "default port",
+			command: fileSDCommand{Targets: []string{"attic-pi"}},
+			want:    []fileSDGroup{{Targets: []string{"attic-pi:2112"}}},
+		},
+		{
+			name:    "ordered and deduplicated",
+			command: fileSDCommand{Targets: []string{"cellar-pi:9100", "attic-pi", "attic-pi:2112", "[fd00::1]:2112"}},
+			want: []fileSDGroup{
+				{Targets: []string{"[fd00::1]:2112"}},
+				{Targets: []string{"attic-pi:2112"}},
+				{Targets: []string{"cellar-pi:9100"}},
+			},
+		},
+		{
+			name:    "target labels",
+			command: fileSDCommand{Targets: []string{"attic-pi", "cellar-pi"}, TargetLabels: map[string]string{"site": "greenhouse"}},
+			want: []fileSDGroup{
+				{Targets: []string{"attic-pi:2112"}, Labels: map[string]string{"site": "greenhouse"}},
+				{Targets: []string{"cellar-pi:2112"}, Labels: map[string]string{"site": "greenhouse"}},
+			},
+		},
+		{
+			name:    "no targets",
+			command: fileSDCommand{},
+			want:    []fileSDGroup{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			groups, err := tt.command.groups()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(groups, tt.want) {
+				t.Errorf("got groups %+v, want %+v", groups, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileSDLabels(t *testing.T) {
+	tests := []struct {
+		name         string
+		txt          []string
+		targetLabels map[string]string
+		want         map[string]string
+	}{
+		{name: "no labels", txt: []string{"path=/metrics"}},
+		{
+			name: "advertised fields",
+			txt:  []string{"path=/dht/metrics", "sensor=attic,cellar", "location=house", "version=1.0", "broken"},
+			want: map[string]string{"__metrics_path__": "/dht/metrics", "sensors": "attic,cellar", "location": "house"},
+		},
+		{name: "empty values skipped", txt: []string{"sensor=", "location="}},
+		{
+			name:         "target labels override",
+			txt:          []string{"location=house"},
+			targetLabels: map[string]string{"location": "greenhouse", "site": "north"},
+			want:         map[string]string{"location": "greenhouse", "site": "north"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &fileSDCommand{TargetLabels: tt.targetLabels}
+			if got := c.labels(tt.txt); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got labels %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileSDUpdate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dht.json")
+	c := &fileSDCommand{Output: path, Targets: []string{"attic-pi"}}
+	if err := c.update(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "[\n  {\n    \"targets\": [\n      \"attic-pi:2112\"\n    ]\n  }\n]\n"; string(data) != want {
+		t.Errorf("got file\n%s\nwant\n%s", data, want)
+	}
+
+	// an unchanged file is not replaced, so Prometheus doesn't reload it
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(path, past, past); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.update(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || !info.ModTime().Equal(past) {
+		t.Errorf("the unchanged file was replaced: %v", err)
+	}
+
+	c.Targets = append(c.Targets, "cellar-pi")
+	if err := c.update(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.ModTime().Equal(past) {
+		t.Errorf("the changed file was not replaced: %v", err)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(filepath.Dir(path), ".file_sd-*")); len(matches) > 0 {
+		t.Errorf("temporary files left behind: %v", matches)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	apiv1 "github.com/mfojtik/go-dht-prometheus/api/v1"
+)
+
+// grpcStreamBuffer is the number of readings buffered per stream. Readings
+// are dropped for clients that don't keep up.
+const grpcStreamBuffer = 64
+
+// readingService implements the gRPC ReadingService. It keeps the last
+// reading of every sensor and fans out new readings to the streams.
+type readingService struct {
+	apiv1.UnimplementedReadingServiceServer
+	// stale reports whether the values of the sensor expired, their last
+	// reading is not returned like it's not exported
+	stale func(sensor string) bool
+
+	mu          sync.Mutex
+	current     map[string]*apiv1.Reading
+	subscribers map[chan *apiv1.Reading]struct{}
+	done        chan struct{}
+}
+
+func newReadingService(stale func(sensor string) bool) *readingService {
+	return &readingService{
+		stale:       stale,
+		current:     map[string]*apiv1.Reading{},
+		subscribers: map[chan *apiv1.Reading]struct{}{},
+		done:        make(chan struct{}),
+	}
+}
+
+// observeReading publishes the successful readings.
+func (s *readingService) observeReading(_ string, r *reading, err error) {
+	if err != nil {
+		return
+	}
+	msg := &apiv1.Reading{
+		Sensor:               r.Sensor,
+		Temperature:          r.Temperature,
+		Humidity:             r.Humidity,
+		VaporPressureDeficit: r.VaporPressureDeficit,
+		DewPoint:             r.DewPoint,
+		Retries:              uint32(r.Retries),
+		Time:                 timestamppb.New(r.Time),
+		BatteryLevel:         r.BatteryLevel,
+		Rssi:                 r.RSSI,
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current[r.Sensor] = msg
+	for ch := range s.subscribers {
+		select {
+		case ch <- msg:
+		default:
+			log.Warn("Dropping reading for a slow gRPC client", "sensor", r.Sensor)
+		}
+	}
+}
+
+// currentReadings returns the last readings of the sensors ordered by name,
+// the stale sensors are left out.
+func (s *readingService) currentReadings(sensors []string) []*apiv1.Reading {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var readings []*apiv1.Reading
+	for name, r := range s.current {
+		if matchesSensor(sensors, name) && !s.stale(name) {
+			readings = append(readings, r)
+		}
+	}
+	sort.Slice(readings, func(i, j int) bool { return readings[i].Sensor < readings[j].Sensor })
+	return readings
+}
+
+// GetCurrent fails with NotFound for a requested sensor without a reading
+// and with Unavailable for a requested stale sensor.
+func (s *readingService) GetCurrent(_ context.Context, req *apiv1.GetCurrentRequest) (*apiv1.GetCurrentResponse, error) {
+	s.mu.Lock()
+	for _, name := range req.GetSensors() {
+		if _, ok := s.current[name]; !ok {
+			s.mu.Unlock()
+			return nil, status.Errorf(codes.NotFound, "no reading of sensor %s", name)
+		}
+		if s.stale(name) {
+			s.mu.Unlock()
+			return nil, status.Errorf(codes.Unavailable, "the values of sensor %s are stale", name)
+		}
+	}
+	s.mu.Unlock()
+	return &apiv1.GetCurrentResponse{Readings: s.currentReadings(req.GetSensors())}, nil
+}
+
+func (s *readingService) StreamReadings(req *apiv1.StreamReadingsRequest, stream apiv1.ReadingService_StreamReadingsServer) error {
+	ch := make(chan *apiv1.Reading, grpcStreamBuffer)
+	s.mu.Lock()
+	s.subscribers[ch] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.subscribers, ch)
+		s.mu.Unlock()
+	}()
+
+	if req.GetSendCurrent() {
+		for _, r := range s.currentReadings(req.GetSensors()) {
+			if err := stream.Send(r); err != nil {
+				return err
+			}
+		}
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-s.done:
+			return nil
+		case r := <-ch:
+			if !matchesSensor(req.GetSensors(), r.Sensor) {
+				continue
+			}
+			if err := stream.Send(r); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// matchesSensor reports whether the sensor is in the list, an empty list
+// matches all sensors.
+func matchesSensor(sensors []string, name string) bool {
+	if len(sensors) == 0 {
+		return true
+	}
+	for _, s := range sensors {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// serveGRPC starts the gRPC server and returns the closer stopping it. The
+// streams are ended first, so the graceful stop doesn't wait for them.
+func serveGRPC(listener net.Listener, service *readingService) outputCloser {
+	server := grpc.NewServer()
+	apiv1.RegisterReadingServiceServer(server, service)
+	go func() {
+		log.Info("Starting gRPC server", "addr", listener.Addr().String())
+		if err := server.Serve(listener); err != nil {
+			log.Error("gRPC server error", "err", err)
+		}
+	}()
+	return outputCloser{
+		name: "grpc",
+		close: func(ctx context.Context) error {
+			close(service.done)
+			stopped := make(chan struct{})
+			go func() {
+				server.GracefulStop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+				return nil
+			case <-ctx.Done():
+				server.Stop()
+				return ctx.Err()
+			}
+		},
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	apiv1 "github.com/mfojtik/go-dht-prometheus/api/v1"
+)
+
+func TestReadingServiceGetCurrent(t *testing.T) {
+	stale := map[string]bool{"cellar": true}
+	s := newReadingService(func(sensor string) bool { return stale[sensor] })
+	s.observeReading("attic", newReading("attic", 21.5, 45, 0), nil)
+	s.observeReading("cellar", newReading("cellar", 12, 80, 0), nil)
+	tests := []struct {
+		name     string
+		sensors  []string
+		want     []string
+		wantCode codes.Code
+	}{
+		{name: "all sensors leave out stale ones", want: []string{"attic"}},
+		{name: "fresh sensor", sensors: []string{"attic"}, want: []string{"attic"}},
+		{name: "stale sensor", sensors: []string{"attic", "cellar"}, wantCode: codes.Unavailable},
+		{name: "unknown sensor", sensors: []string{"garage"}, wantCode: codes.NotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := s.GetCurrent(context.Background(), &apiv1.GetCurrentRequest{Sensors: tt.sensors})
+			if tt.wantCode != codes.OK {
+				if status.Code(err) != tt.wantCode {
+					t.Fatalf("error = %v, want code %v", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, r := range resp.GetReadings() {
+				got = append(got, r.Sensor)
+			}
+			if len(got) != len(tt.want) || (len(got) > 0 && got[0] != tt.want[0]) {
+				t.Errorf("readings of %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRateLimiterHandler(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   float64
+		burst   int
+		remotes []string
+		want    []int
+	}{
+		{
+			name:    "burst allowed",
+			limit:   0.1,
+			burst:   2,
+			remotes: []string{"10.0.0.1:1000", "10.0.0.1:1001"},
+			want:    []int{http.StatusOK, http.StatusOK},
+		},
+		{
+			name:    "over the burst",
+			limit:   0.1,
+			burst:   1,
+			remotes: []string{"10.0.0.1:1000", "10.0.0.1:1001", "10.0.0.1:1002"},
+			want:    []int{http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests},
+		},
+		{
+			name:    "limited per client address",
+			limit:   0.1,
+			burst:   1,
+			remotes: []string{"10.0.0.1:1000", "10.0.0.2:1000", "10.0.0.1:1001"},
+			want:    []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := newRateLimiter(tt.limit, tt.burst).handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			for i, remote := range tt.remotes {
+				req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+				req.RemoteAddr = remote
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, req)
+				if w.Code != tt.want[i] {
+					t.Errorf("request %d from %s: got status %d, want %d", i+1, remote, w.Code, tt.want[i])
+				}
+				if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "10" {
+					t.Errorf("request %d: got Retry-After %q, want 10", i+1, w.Header().Get("Retry-After"))
+				}
+			}
+		})
+	}
+}
+
+func TestConcurrencyLimitHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		max      int
+		inFlight int
+		want     int
+	}{
+		{name: "under the limit", max: 2, inFlight: 1, want: http.StatusOK},
+		{name: "at the limit", max: 2, inFlight: 2, want: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			started, release := make(chan struct{}), make(chan struct{})
+			handler := concurrencyLimitHandler(tt.max, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/slow" {
+					started <- struct{}{}
+					<-release
+				}
+			}))
+			done := make(chan struct{})
+			for i := 0; i < tt.inFlight; i++ {
+				go func() {
+					handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slow", nil))
+					done <- struct{}{}
+				}()
+				<-started
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+			close(release)
+			for i := 0; i < tt.inFlight; i++ {
+				<-done
+			}
+			if w.Code != tt.want {
+				t.Errorf("got status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/d2r2/go-logger"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+type loggingOptions struct {
+	Level  string `long:"log-level" description:"log level, also applied to the DHT driver" choice:"debug" choice:"info" choice:"warn" choice:"error" default:"info" env:"DHT_LOG_LEVEL"`
+	Format string `long:"log-format" description:"log output format" choice:"text" choice:"json" default:"text" env:"DHT_LOG_FORMAT"`
+
+	File           string `long:"log-file" description:"write logs to this file instead of stderr" env:"DHT_LOG_FILE"`
+	FileMaxSize    int    `long:"log-file-max-size" description:"size in megabytes at which the log file is rotated" default:"10" env:"DHT_LOG_FILE_MAX_SIZE"`
+	FileMaxAge     int    `long:"log-file-max-age" description:"days to keep rotated log files, 0 keeps them regardless of age" default:"7" env:"DHT_LOG_FILE_MAX_AGE"`
+	FileMaxBackups int    `long:"log-file-max-backups" description:"number of rotated log files to keep, 0 keeps all of them" default:"3" env:"DHT_LOG_FILE_MAX_BACKUPS"`
+	FileCompress   bool   `long:"log-file-compress" description:"gzip rotated log files" env:"DHT_LOG_FILE_COMPRESS"`
+
+	Journald bool `long:"log-journald" description:"send logs to the systemd journal with proper priorities, falling back to syslog when journald is not available" env:"DHT_LOG_JOURNALD"`
+}
+
+var (
+	logLevel = new(slog.LevelVar)
+	log      = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+
+	// logWriter is where the logs are written to, closed by closeLogging
+	logWriter io.Writer = os.Stderr
+)
+
+// setupLogging configures the logger according to the logging options.
+func setupLogging() error {
+	level := opts.Logging.Level
+	if len(opts.Verbose) > 0 {
+		level = "debug"
+	}
+
+	driverLevel := logger.InfoLevel
+	switch level {
+	case "debug":
+		logLevel.Set(slog.LevelDebug)
+		driverLevel = logger.DebugLevel
+	case "warn":
+		logLevel.Set(slog.LevelWarn)
+		driverLevel = logger.WarnLevel
+	case "error":
+		logLevel.Set(slog.LevelError)
+		driverLevel = logger.ErrorLevel
+	default:
+		logLevel.Set(slog.LevelInfo)
+	}
+
+	if len(opts.Logging.File) > 0 {
+		logWriter = &lumberjack.Logger{
+			Filename:   opts.Logging.File,
+			MaxSize:    opts.Logging.FileMaxSize,
+			MaxAge:     opts.Logging.FileMaxAge,
+			MaxBackups: opts.Logging.FileMaxBackups,
+			Compress:   opts.Logging.FileCompress,
+		}
+	}
+
+	handlerOptions := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	switch {
+	case opts.Logging.Journald:
+		var err error
+		if handler, err = newSystemLogHandler(logLevel); err != nil {
+			return err
+		}
+	case opts.Logging.Format == "json":
+		handler = slog.NewJSONHandler(logWriter, handlerOptions)
+	default:
+		handler = slog.NewTextHandler(logWriter, handlerOptions)
+	}
+	if opts.Logging.routesDriverLogs() {
+		if err := routeDriverLogs(); err != nil {
+			driverLevel = logger.FatalLevel
+		}
+	}
+	log = slog.New(handler)
+	slog.SetDefault(log)
+
+	// the DHT driver registers its package logger as "dht"
+	logger.ChangePackageLogLevel("dht", driverLevel)
+	return nil
+}
+
+// routesDriverLogs reports whether the DHT driver messages are logged by the
+// handler. The driver prints plain text to stdout, which is only fine next to
+// the default text logs on stderr; otherwise its messages are logged by the
+// handler, or dropped where stdout can't be redirected.
+func (o loggingOptions) routesDriverLogs() bool {
+	return o.Journald || o.Format == "json" || len(o.File) > 0
+}
+
+var routeDriverLogsOnce sync.Once
+
+// routeDriverLogs logs the DHT driver messages with the slog logger instead of
+// printing them to stdout.
+func routeDriverLogs() (err error) {
+	routeDriverLogsOnce.Do(func() {
+		if err = discardDriverStdout(); err != nil {
+			return
+		}
+		logger.AddCustomLog(driverLogWriter{}, false, logger.DebugLevel)
+	})
+	return err
+}
+
+// driverLevels maps the levels of the DHT driver messages to the slog levels.
+var driverLevels = map[string]slog.Level{
+	"DEBUG":  slog.LevelDebug,
+	"INFO":   slog.LevelInfo,
+	"NOTICE": slog.LevelInfo,
+	"WARN":   slog.LevelWarn,
+	"ERROR":  slog.LevelError,
+	"PANIC":  slog.LevelError,
+	"FATAL":  slog.LevelError,
+}
+
+// driverLogWriter logs the lines of the DHT driver logger, formatted like
+// "2006-01-02T15:04:05.000 [dht     ] DEBUG  message".
+type driverLogWriter struct{}
+
+func (driverLogWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		level, message := slog.LevelDebug, line
+		if _, rest, ok := strings.Cut(line, "] "); ok {
+			name, text, _ := strings.Cut(rest, "  ")
+			if l, ok := driverLevels[name]; ok {
+				level, message = l, strings.TrimLeft(text, " ")
+			}
+		}
+		log.Log(context.Background(), level, message, "logger", "dht")
+	}
+	return len(p), nil
+}
+
+// closeLogging closes the log file, if any.
+func closeLogging() {
+	if closer, ok := logWriter.(io.Closer); ok && logWriter != os.Stderr {
+		closer.Close()
+	}
+}
+
+// quietDriverLogs silences the DHT driver, which logs to stdout, unless debug
+// logging was requested. Used by commands printing their results to stdout.
+func quietDriverLogs() {
+	if logLevel.Level() > slog.LevelDebug {
+		logger.ChangePackageLogLevel("dht", logger.FatalLevel)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// discardDriverStdout points the stdout file descriptor, which the DHT driver
+// logger holds on to, to /dev/null. os.Stdout is replaced by a duplicate of
+// the original, so the output of the commands is not affected.
+func discardDriverStdout() error {
+	stdout, err := unix.FcntlInt(uintptr(unix.Stdout), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	devNull, err := unix.Open(os.DevNull, unix.O_WRONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		unix.Close(stdout)
+		return err
+	}
+	defer unix.Close(devNull)
+	if err := unix.Dup2(devNull, unix.Stdout); err != nil {
+		unix.Close(stdout)
+		return err
+	}
+	os.Stdout = os.NewFile(uintptr(stdout), "/dev/stdout")
+	return nil
+}
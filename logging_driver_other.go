@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func discardDriverStdout() error {
+	return errors.New("the DHT driver output can only be redirected on Linux")
+}
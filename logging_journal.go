@@ -0,0 +1,172 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"log/syslog"
+	"strings"
+
+	"github.com/coreos/go-systemd/v22/journal"
+)
+
+const syslogIdentifier = "dht-prometheus"
+
+// systemLogHandler sends log records to journald, or to syslog when the journal
+// is not available, mapping the slog levels to the syslog priorities.
+type systemLogHandler struct {
+	level  slog.Leveler
+	syslog *syslog.Writer
+	attrs  []slog.Attr
+	group  string
+}
+
+func newSystemLogHandler(level slog.Leveler) (slog.Handler, error) {
+	if journal.Enabled() {
+		return &systemLogHandler{level: level}, nil
+	}
+	w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, syslogIdentifier)
+	if err != nil {
+		return nil, fmt.Errorf("neither journald nor syslog is available: %v", err)
+	}
+	return &systemLogHandler{level: level, syslog: w}, nil
+}
+
+func (h *systemLogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *systemLogHandler) Handle(_ context.Context, record slog.Record) error {
+	var fields []logField
+	for _, attr := range h.attrs {
+		fields = appendLogField(fields, "", attr)
+	}
+	record.Attrs(func(attr slog.Attr) bool {
+		fields = appendLogField(fields, h.group, attr)
+		return true
+	})
+
+	if h.syslog == nil {
+		vars := map[string]string{"SYSLOG_IDENTIFIER": syslogIdentifier}
+		for _, field := range fields {
+			vars[journalFieldName(field.key)] = field.value
+		}
+		return journal.Send(record.Message, journalPriority(record.Level), vars)
+	}
+
+	var b strings.Builder
+	b.WriteString(record.Message)
+	for _, field := range fields {
+		fmt.Fprintf(&b, " %s=%q", field.key, field.value)
+	}
+	msg := b.String()
+	switch {
+	case record.Level >= slog.LevelError:
+		return h.syslog.Err(msg)
+	case record.Level >= slog.LevelWarn:
+		return h.syslog.Warning(msg)
+	case record.Level >= slog.LevelInfo:
+		return h.syslog.Info(msg)
+	default:
+		return h.syslog.Debug(msg)
+	}
+}
+
+func (h *systemLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handler := *h
+	handler.attrs = append([]slog.Attr{}, h.attrs...)
+	for _, attr := range attrs {
+		if len(h.group) > 0 {
+			attr.Key = h.group + "." + attr.Key
+		}
+		handler.attrs = append(handler.attrs, attr)
+	}
+	return &handler
+}
+
+func (h *systemLogHandler) WithGroup(name string) slog.Handler {
+	handler := *h
+	if len(h.group) > 0 {
+		handler.group = h.group + "." + name
+	} else {
+		handler.group = name
+	}
+	return &handler
+}
+
+type logField struct {
+	key, value string
+}
+
+func appendLogField(fields []logField, prefix string, attr slog.Attr) []logField {
+	attr.Value = attr.Value.Resolve()
+	key := attr.Key
+	if len(prefix) > 0 {
+		key = prefix + "." + key
+	}
+	if attr.Value.Kind() == slog.KindGroup {
+		for _, a := range attr.Value.Group() {
+			fields = appendLogField(fields, key, a)
+		}
+		return fields
+	}
+	return append(fields, logField{key: key, value: attr.Value.String()})
+}
+
+// journalFields are the fields with a meaning to journald that attributes must
+// not overwrite.
+var journalFields = map[string]bool{
+	"MESSAGE":           true,
+	"MESSAGE_ID":        true,
+	"PRIORITY":          true,
+	"CODE_FILE":         true,
+	"CODE_LINE":         true,
+	"CODE_FUNC":         true,
+	"ERRNO":             true,
+	"INVOCATION_ID":     true,
+	"DOCUMENTATION":     true,
+	"TID":               true,
+	"SYSLOG_FACILITY":   true,
+	"SYSLOG_IDENTIFIER": true,
+	"SYSLOG_PID":        true,
+	"SYSLOG_TIMESTAMP":  true,
+	"SYSLOG_RAW":        true,
+}
+
+// journalFieldName converts the attribute key to a valid journal field name,
+// which may only contain uppercase letters, digits and underscores and must
+// start with a letter. Names that are not valid or collide with the journal
+// fields get the DHT_ prefix.
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+	// fields starting with an underscore are trusted fields set by journald
+	name = strings.TrimLeft(name, "_")
+	if len(name) == 0 || (name[0] >= '0' && name[0] <= '9') || journalFields[name] {
+		name = "DHT_" + name
+	}
+	return name
+}
+
+func journalPriority(level slog.Level) journal.Priority {
+	switch {
+	case level >= slog.LevelError:
+		return journal.PriErr
+	case level >= slog.LevelWarn:
+		return journal.PriWarning
+	case level >= slog.LevelInfo:
+		return journal.PriInfo
+	default:
+		return journal.PriDebug
+	}
+}
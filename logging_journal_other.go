@@ -0,0 +1,12 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"errors"
+	"log/slog"
+)
+
+func newSystemLogHandler(_ slog.Leveler) (slog.Handler, error) {
+	return nil, errors.New("journald and syslog are not supported on this platform")
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestRoutesDriverLogs(t *testing.T) {
+	tests := []struct {
+		name    string
+		options loggingOptions
+		want    bool
+	}{
+		{name: "text on stderr", options: loggingOptions{Format: "text"}},
+		{name: "json", options: loggingOptions{Format: "json"}, want: true},
+		{name: "log file", options: loggingOptions{Format: "text", File: "/var/log/dht.log"}, want: true},
+		{name: "journald", options: loggingOptions{Format: "text", Journald: true}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.options.routesDriverLogs(); got != tt.want {
+				t.Errorf("routesDriverLogs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDriverLogWriter(t *testing.T) {
+	var buf bytes.Buffer
+	previous := log
+	log = slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	t.Cleanup(func() { log = previous })
+
+	driverLogWriter{}.Write([]byte("2026-10-14T10:00:00.000 [dht     ] WARN   Sensor doesn't respond\n" +
+		"2026-10-14T10:00:01.000 [dht     ] DEBUG  Pulse count 83\n" +
+		"unexpected line\n"))
+	want := []string{
+		`level=WARN msg="Sensor doesn't respond" logger=dht`,
+		`level=DEBUG msg="Pulse count 83" logger=dht`,
+		`level=DEBUG msg="unexpected line" logger=dht`,
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("got %d log lines, want %d:\n%s", len(lines), len(want), buf.String())
+	}
+	for i, line := range lines {
+		if !strings.HasSuffix(line, want[i]) {
+			t.Errorf("got log line %q, want it to end with %q", line, want[i])
+		}
+	}
+}
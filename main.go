@@ -1,153 +1,195 @@
 package main
 
 import (
-	"context"
 	"errors"
-	"math"
-	"net/http"
+	"fmt"
 	"os"
-	"os/signal"
-	"syscall"
 	"time"
 
-	"github.com/d2r2/go-dht"
 	"github.com/d2r2/go-logger"
 	"github.com/jessevdk/go-flags"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/model"
 )
 
-var (
-	lastTemperatureGauge = promauto.NewGauge(prometheus.GaugeOpts{
-		Namespace: "dht",
-		Name:      "last_temperature",
-		Help:      "Last measured temperature by DHT sensor",
-	})
-	lastHumidityGauge = promauto.NewGauge(prometheus.GaugeOpts{
-		Namespace: "dht",
-		Name:      "last_humidity",
-		Help:      "Last measured humidity by DHT sensor",
-	})
-	lastVaporPressureDeficitGauge = promauto.NewGauge(prometheus.GaugeOpts{
-		Namespace: "dht",
-		Name:      "last_vapor_pressure_deficit",
-		Help:      "Last vapor deficit value",
-	})
-	lastDewPointGauge = promauto.NewGauge(prometheus.GaugeOpts{
-		Namespace: "dht",
-		Name:      "last_dew_point",
-		Help:      "Last dew point value",
-	})
-	last_successful_measurement_seconds = promauto.NewGauge(prometheus.GaugeOpts{
-		Namespace: "dht",
-		Name:      "last_successful_measurement_seconds",
-		Help:      "Number of seconds that passed from the last successfully measurement",
-	})
-	last_measurement_retries = promauto.NewGauge(prometheus.GaugeOpts{
-		Namespace: "dht",
-		Name:      "last_measurement_retries",
-		Help:      "Number of retries by DHT sensor since it got values",
-	})
-)
+type sensorOptions struct {
+	Type        string        `long:"sensor-type" description:"DHT sensor type: dht11, dht12, dht22, am2302 or auto to detect it; the numeric 1, 2 and 3 are still accepted" default:"dht22" env:"DHT_SENSOR_TYPE"`
+	PIN         uint          `long:"sensor-pin" description:"DHT sensor PIN" default:"4" env:"DHT_SENSOR_PIN"`
+	MaxRetries  uint          `long:"sensor-max-retries" description:"maximum sensor retries" default:"5" env:"DHT_SENSOR_MAX_RETRIES"`
+	Detect      bool          `long:"sensor-detect" description:"detect whether the DHT sensors are DHT11 or DHT22/AM2302 at startup, same as --sensor-type=auto" env:"DHT_SENSOR_DETECT"`
+	RetryDelay  time.Duration `long:"sensor-retry-delay" description:"delay between retries, defaults to the 1.5s the DHT sensors need between reads and 1s for Modbus" env:"DHT_SENSOR_RETRY_DELAY"`
+	RetryJitter time.Duration `long:"sensor-retry-jitter" description:"random delay of up to this duration added to every retry delay" env:"DHT_SENSOR_RETRY_JITTER"`
+	RetryOn     []string      `long:"sensor-retry-on" description:"types of read errors that are retried: checksum, timeout, gpio or other (can be repeated)" default:"checksum" default:"timeout" default:"other" env:"DHT_SENSOR_RETRY_ON" env-delim:","`
+	Name        string        `long:"sensor-name" description:"sensor name used in the sensor label" default:"dht" env:"DHT_SENSOR_NAME"`
+	Location    string        `long:"sensor-location" description:"sensor location exported in dht_sensor_info" env:"DHT_SENSOR_LOCATION"`
+
+	BoostPerformance bool `long:"sensor-boost-performance" description:"read with SCHED_FIFO real-time priority; makes the bit-banged timing reliable on loaded systems, but requires root and starves other processes for the duration of a read" env:"DHT_SENSOR_BOOST_PERFORMANCE"`
+	LockMemory       bool `long:"sensor-lock-memory" description:"lock the process memory with mlockall(2) while reading to avoid page faults breaking the timing; requires root or CAP_IPC_LOCK and keeps the whole process resident" env:"DHT_SENSOR_LOCK_MEMORY"`
+
+	PowerPIN         string        `long:"sensor-power-pin" description:"GPIO pin powering the sensor through a MOSFET or a relay, e.g. 27 or GPIO27; serve cuts the power to recover a sensor that locked up after --sensor-power-cycle-after consecutive failed measurements" env:"DHT_SENSOR_POWER_PIN"`
+	PowerCycleAfter  uint          `long:"sensor-power-cycle-after" description:"number of consecutive failed measurements after which the sensor is power cycled" default:"3" env:"DHT_SENSOR_POWER_CYCLE_AFTER"`
+	PowerOffDuration time.Duration `long:"sensor-power-off" description:"how long the power is cut when power cycling the sensor" default:"5s" env:"DHT_SENSOR_POWER_OFF"`
+
+	Sensors []sensorSpec `long:"sensor" description:"read multiple sensors, e.g. name=attic,pin=17,location=attic,interval=30s; supported keys are name, driver, type, pin, max-retries, location, interval, bus and power-pin, unset keys default to the --sensor-* options; sensors on the same bus (gpio by default) are read one at a time; driver=modbus polls a transmitter with the address (tcp://host:502 or rtu:///dev/ttyUSB0), slave, register-type (holding or input), temperature-register, humidity-register, temperature-scale, humidity-scale (0.1 by default), baud-rate, parity and stop-bits keys; driver=simulate replays the temperature and humidity columns of a CSV file or generates a daily cycle around temperature and humidity with their -amplitude and -noise keys over the period, failures are injected with failure-rate, failure-every and failure-for and failure-type (can be repeated)" env:"DHT_SENSORS" env-delim:";"`
+}
 
-var opts struct {
-	Verbose []bool `short:"v" long:"verbose" description:"Show verbose debug information"`
+type metricsOptions struct {
+	Namespace string            `long:"metrics-namespace" description:"namespace prepended to all exported metric names" default:"dht" env:"DHT_METRICS_NAMESPACE"`
+	Names     map[string]string `long:"metric-name" description:"override a metric name, e.g. last_temperature:temperature_celsius (can be repeated)" env:"DHT_METRIC_NAMES" env-delim:","`
+	Labels    map[string]string `long:"label" description:"constant label added to all exported series, e.g. room:greenhouse (can be repeated)" env:"DHT_LABELS" env-delim:","`
 
-	SensorType       uint          `long:"sensor-type" description:"DHT sensor type" default:"3"`
-	SensorPIN        uint          `long:"sensor-pin" description:"DHT sensor PIN" default:"4"`
-	SensorMaxRetries uint          `long:"sensor-max-retries" description:"maximum sensor retries" default:"5"`
-	ListenAddr       string        `short:"l" long:"listen-addr" description:"listen address:port" required:"true" default:":2112"`
-	ReadSeconds      time.Duration `long:"interval" description:"interval between measurements" default:"15s"`
+	NativeHistograms bool `long:"metrics-native-histograms" description:"export the histograms as native histograms instead of classic buckets; native histograms are only exposed in the protobuf format, so the scraper must negotiate it, e.g. Prometheus with native histograms enabled" env:"DHT_METRICS_NATIVE_HISTOGRAMS"`
 }
 
-var log = logger.NewPackageLogger("dht",
-	//logger.DebugLevel,
-	logger.InfoLevel,
-)
+var opts struct {
+	Verbose []bool `short:"v" long:"verbose" description:"Show verbose debug information, same as --log-level=debug" no-ini:"true"`
+	Version bool   `long:"version" description:"Print version information and exit" no-ini:"true"`
+	Config  string `short:"c" long:"config" description:"INI file with option values; command line options take precedence" env:"DHT_CONFIG" no-ini:"true"`
+
+	Sensor      sensorOptions      `group:"Sensor Options"`
+	Calibration calibrationOptions `group:"Calibration Options"`
+	Metrics     metricsOptions     `group:"Metrics Options"`
+	Logging     loggingOptions     `group:"Logging Options"`
+}
 
-func recordMetrics() {
-	last_measurement_time := time.Now()
-	for {
-		temperature, humidity, retried, err := dht.ReadDHTxxWithRetry(
-			dht.SensorType(opts.SensorType),
-			int(opts.SensorPIN),
-			false,
-			int(opts.SensorMaxRetries),
-		)
-		if err != nil {
-			log.Infof("ERROR: DHT sensor reported: %v", err)
-			time.Sleep(opts.ReadSeconds)
-			continue
+// validateOptions checks the global options shared by all commands.
+func validateOptions() error {
+	if opts.Logging.Journald && len(opts.Logging.File) > 0 {
+		return errors.New("--log-file and --log-journald can't be used together")
+	}
+	var err error
+	if sensors, err = configureSensors(opts.Sensor); err != nil {
+		return fmt.Errorf("invalid sensor configuration: %v", err)
+	}
+	if err := configureCalibrations(opts.Calibration.Calibrations); err != nil {
+		return fmt.Errorf("invalid calibration: %v", err)
+	}
+	for _, errorType := range opts.Sensor.RetryOn {
+		switch errorType {
+		case errorTypeChecksum, errorTypeTimeout, errorTypeGPIO, errorTypeOther:
+		default:
+			return fmt.Errorf("unsupported --sensor-retry-on %q, supported: checksum, timeout, gpio, other", errorType)
 		}
-
-		temperature64 := float64(temperature)
-		humidity64 := float64(humidity)
-		es := 0.6108 * math.Exp(17.27*temperature64/(temperature64+237.3))
-		ea := humidity64 / 100 * es
-		// this equation returns a negative value (in kPa), which while technically correct,
-		// is invalid in this case because we are talking about a deficit.
-		vpd := (ea - es) * -1
-
-		dewPoint := dewPoint(temperature64, humidity64)
-
-		log.Infof("DHT: %.2f°C, %.2f%%, VPD: %.2f, DP: %.2f°C", temperature, humidity, vpd, dewPoint)
-
-		// record amount of seconds since the last successful measurement
-		last_successful_measurement_seconds.Set(float64(time.Now().Unix() - last_measurement_time.Unix()))
-		last_measurement_time = time.Now()
-		lastTemperatureGauge.Set(float64(temperature))
-		lastHumidityGauge.Set(float64(humidity))
-		last_measurement_retries.Set(float64(retried))
-		lastVaporPressureDeficitGauge.Set(vpd)
-		lastDewPointGauge.Set(dewPoint)
-
-		time.Sleep(opts.ReadSeconds)
 	}
+	if opts.Sensor.PowerCycleAfter == 0 || opts.Sensor.PowerOffDuration <= 0 {
+		return errors.New("--sensor-power-cycle-after and --sensor-power-off must be positive")
+	}
+	if opts.Sensor.RetryDelay < 0 || opts.Sensor.RetryJitter < 0 {
+		return errors.New("--sensor-retry-delay and --sensor-retry-jitter must not be negative")
+	}
+	if len(opts.Metrics.Namespace) > 0 && !model.IsValidMetricName(model.LabelValue(opts.Metrics.Namespace)) {
+		return fmt.Errorf("invalid --metrics-namespace %q", opts.Metrics.Namespace)
+	}
+	if err := validateMetricNames(opts.Metrics.Namespace, opts.Metrics.Names); err != nil {
+		return fmt.Errorf("invalid --metric-name: %v", err)
+	}
+	if err := validateConstLabels(opts.Metrics.Labels); err != nil {
+		return fmt.Errorf("invalid --label: %v", err)
+	}
+	return nil
 }
 
-func dewPoint(temperature, humidity float64) float64 {
-	// Constants for the dew point calculation
-	a := 17.27
-	b := 237.7
-
-	// Calculate intermediate values
-	alpha := ((a * temperature) / (b + temperature)) + math.Log(humidity/100.0)
-	dewPoint := (b * alpha) / (a - alpha)
-
-	return dewPoint
+func newParser() *flags.Parser {
+	parser := flags.NewParser(&opts, flags.Default)
+	parser.SubcommandsOptional = true
+
+	parser.AddCommand("serve",
+		"Serve Prometheus metrics",
+		"Periodically read the sensor and serve the measurements as Prometheus metrics. This is the default command.\n\n"+
+			"With --push-receiver, remote field units POST their readings to /api/v1/push with the --api-token as a bearer token, e.g. other exporters with "+
+			"--webhook-url 'http://collector:2112/api/v1/push?origin=attic' --webhook-header 'Authorization:Bearer <token>'. "+
+			"The body is a reading in the webhook format or an array of them, e.g. {\"sensor\": \"dht\", \"temperature\": 21.5, \"humidity\": 45, \"time\": \"2026-10-14T10:00:00Z\"}; "+
+			"temperature and humidity are required, time defaults to the time of receipt and readings not newer than the last one of the sensor are skipped. "+
+			"The origin is the origin query parameter or the client IP address, the origin and sensor names are limited to 1 to 64 letters, digits, _, ., : and -. "+
+			"The series of a pushed sensor have the origin in the origin label, which is empty for the local sensors, and --threshold refers to it as <origin>/<sensor>, e.g. sensor=attic/dht.",
+		&serveOpts)
+	parser.AddCommand("read",
+		"Perform a single measurement",
+		"Read the sensors once, print the measurements to stdout and exit. Exits with a non-zero code when a sensor can't be read.",
+		&readCommand{})
+	parser.AddCommand("test",
+		"Run sensor diagnostics",
+		"Check GPIO access and perform a few reads of every sensor to report error rates and timing. Exits with 2 for GPIO permission problems, 3 for wiring problems and 4 for timeouts.",
+		&testCommand{})
+	parser.AddCommand("calibrate",
+		"Calibrate a sensor",
+		"Compute the scale and offset of the humidity or temperature of a sensor from readings at two reference conditions, e.g. saturated salt solutions, and write the calibration to the config file.",
+		&calibrateCommand{})
+	config, _ := parser.AddCommand("config",
+		"Configuration tools",
+		"Inspect and validate the exporter configuration.",
+		&struct{}{})
+	config.AddCommand("validate",
+		"Validate the configuration",
+		"Parse the configuration from the command line, environment and config file, check it for conflicts and unreachable endpoints and print the resolved configuration.",
+		&configValidateCommand{})
+	parser.AddCommand("aggregate",
+		"Aggregate metrics of other exporters",
+		"Scrape the metrics of peer exporters and serve them on a single endpoint. Every series gets an instance label with the peer address and sensor series also the location of the sensor.",
+		&aggregateCommand{})
+	parser.AddCommand("file-sd",
+		"Write Prometheus file_sd targets",
+		"Write a Prometheus file_sd JSON file with the given exporters and the exporters advertised via mDNS. The sensors and locations advertised by an exporter become target labels.",
+		&fileSDCommand{})
+	parser.AddCommand("dashboard",
+		"Print a Grafana dashboard",
+		"Print a Grafana dashboard JSON model for the exported metrics.",
+		&dashboardCommand{})
+	parser.AddCommand("rules",
+		"Print Prometheus alerting rules",
+		"Print Prometheus alerting rules for the exported metrics.",
+		&rulesCommand{})
+
+	// validate the global options before running any command
+	parser.CommandHandler = func(command flags.Commander, args []string) error {
+		if opts.Version {
+			fmt.Println(versionString())
+			return nil
+		}
+		if command == nil {
+			return nil
+		}
+		if err := validateOptions(); err != nil {
+			return err
+		}
+		if err := setupLogging(); err != nil {
+			return err
+		}
+		return command.Execute(args)
+	}
+	return parser
 }
 
 func main() {
 	defer logger.FinalizeLogger()
-	if _, err := flags.Parse(&opts); err != nil {
+	defer closeLogging()
+
+	parser := newParser()
+	if err := loadConfigFile(parser, os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
-	logger.ChangePackageLogLevel("dht", logger.InfoLevel)
-
-	server := &http.Server{
-		Addr: opts.ListenAddr,
+	if _, err := parser.ParseArgs(defaultCommandArgs(parser, os.Args[1:])); err != nil {
+		var exitErr *exitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.code)
+		}
+		os.Exit(1)
 	}
+}
 
-	go recordMetrics()
-	http.Handle("/metrics", promhttp.Handler())
-
-	go func() {
-		log.Infof("Starting HTTP server on %s ...", opts.ListenAddr)
-		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
-			log.Fatalf("HTTP server error: %v", err)
+// defaultCommandArgs prepends the serve command to args when no command was
+// given, so the exporter keeps working when invoked without a command.
+func defaultCommandArgs(parser *flags.Parser, args []string) []string {
+	for _, arg := range args {
+		switch arg {
+		case "-h", "--help", "--version":
+			return args
+		case "--":
+			return append([]string{"serve"}, args...)
+		}
+		if parser.Find(arg) != nil {
+			return args
 		}
-		log.Infof("Stopped serving new connections.")
-	}()
-
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
-
-	shutdownCtx, shutdownRelease := context.WithTimeout(context.Background(), 10*time.Second)
-	defer shutdownRelease()
-
-	if err := server.Shutdown(shutdownCtx); err != nil {
-		log.Fatalf("HTTP shutdown error: %v", err)
 	}
+	return append([]string{"serve"}, args...)
 }
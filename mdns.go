@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/hashicorp/mdns"
+)
+
+// advertiseMDNS announces the exporter listening on addr via mDNS. The TXT
+// records carry the metrics path and sensor metadata, so discovery tooling can
+// turn them into target labels.
+func (c *serveCommand) advertiseMDNS(addr net.Addr) (*mdns.Server, error) {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("unsupported listener address %v", addr)
+	}
+
+	instance := c.MDNSInstance
+	if len(instance) == 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("unable to get hostname: %v", err)
+		}
+		instance = hostname
+	}
+
+	var ips []net.IP
+	if tcpAddr.IP != nil && !tcpAddr.IP.IsUnspecified() {
+		ips = []net.IP{tcpAddr.IP}
+	} else {
+		// don't rely on resolving the hostname, which is often mapped to
+		// 127.0.1.1 on Raspberry Pi OS
+		var err error
+		if ips, err = localIPs(); err != nil {
+			return nil, err
+		}
+	}
+
+	txt := []string{
+		"path=/metrics",
+		"sensor=" + strings.Join(sensorNames(), ","),
+	}
+	if locations := sensorLocations(); len(locations) > 0 {
+		txt = append(txt, "location="+strings.Join(locations, ","))
+	}
+	service, err := mdns.NewMDNSService(instance, c.MDNSService, "", "", tcpAddr.Port, ips, txt)
+	if err != nil {
+		return nil, err
+	}
+	server, err := mdns.NewServer(&mdns.Config{Zone: service})
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Advertising via mDNS", "instance", instance, "service", c.MDNSService, "port", tcpAddr.Port)
+	return server, nil
+}
+
+// localIPs returns the addresses of all interfaces that are up, except the
+// loopback.
+func localIPs() ([]net.IP, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.IsGlobalUnicast() {
+				ips = append(ips, ipNet.IP)
+			}
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no network interface with an IP address found")
+	}
+	return ips, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func lockMemory() error {
+	return errors.New("locking memory is only supported on Linux")
+}
+
+func unlockMemory() error {
+	return nil
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+)
+
+// metrics holds all series exported by the exporter.
+type metrics struct {
+	temperature                      *prometheus.GaugeVec
+	humidity                         *prometheus.GaugeVec
+	vaporPressureDeficit             *prometheus.GaugeVec
+	dewPoint                         *prometheus.GaugeVec
+	lastSuccessfulMeasurementSeconds *prometheus.GaugeVec
+	measurementRetries               *prometheus.GaugeVec
+	readFailures                     *prometheus.CounterVec
+	readErrors                       *prometheus.CounterVec
+	readDuration                     *prometheus.HistogramVec
+	temperatureDistribution          *prometheus.HistogramVec
+	humidityDistribution             *prometheus.HistogramVec
+	identicalReadingsStreak          *prometheus.GaugeVec
+	measurementStale                 *prometheus.GaugeVec
+	powerCycles                      *prometheus.CounterVec
+	powerRecoveries                  *prometheus.CounterVec
+	thresholdBreached                *prometheus.GaugeVec
+	comfortState                     *prometheus.GaugeVec
+	batteryLevel                     *prometheus.GaugeVec
+	rssi                             *prometheus.GaugeVec
+	sensorInfo                       *prometheus.GaugeVec
+	buildInfo                        prometheus.Gauge
+
+	// comfort classifies the readings in comfortState when set
+	comfort *comfortBands
+}
+
+// defaultMetricNames lists the metric names that can be overridden using
+// --metric-name. Names are used without the namespace prefix.
+var defaultMetricNames = []string{
+	"last_temperature",
+	"last_humidity",
+	"last_vapor_pressure_deficit",
+	"last_dew_point",
+	"last_successful_measurement_seconds",
+	"last_measurement_retries",
+	"read_failures_total",
+	"read_errors_total",
+	"read_duration_seconds",
+	"temperature_distribution_celsius",
+	"humidity_distribution_percent",
+	"identical_readings_streak",
+	"measurement_stale",
+	"power_cycles_total",
+	"power_recoveries_total",
+	"threshold_breached",
+	"comfort_state",
+	"last_battery_level_percent",
+	"last_rssi_dbm",
+	"sensor_info",
+	"exporter_build_info",
+	"pi_throttled",
+	"pi_throttled_occurred",
+	"pi_cpu_temperature_celsius",
+	"webhook_deliveries_total",
+	"webhook_delivery_failures_total",
+	"webhook_dropped_total",
+	"webhook_buffered_readings",
+	"webhook_buffer_dropped_total",
+	"alertmanager_notifications_total",
+	"alertmanager_notification_failures_total",
+	"push_origin_up",
+	"push_origin_last_seen_timestamp_seconds",
+	"push_readings_total",
+	"push_rejected_total",
+	"aggregate_peer_up",
+	"aggregate_peer_scrape_duration_seconds",
+}
+
+// validateMetricNames makes sure every override refers to a known metric and
+// results in a valid metric name that no other metric uses.
+func validateMetricNames(namespace string, names map[string]string) error {
+	known := map[string]bool{}
+	for _, name := range defaultMetricNames {
+		known[name] = true
+	}
+	var unknown []string
+	for name := range names {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown metric name(s) %s, supported: %s", strings.Join(unknown, ", "), strings.Join(defaultMetricNames, ", "))
+	}
+	// used maps the full metric names to the default name of the metric
+	used := map[string]string{}
+	for _, defaultName := range defaultMetricNames {
+		name := prometheus.BuildFQName(namespace, "", metricName(names, defaultName))
+		if !model.IsValidMetricName(model.LabelValue(name)) {
+			return fmt.Errorf("%q of %s is not a valid metric name", name, defaultName)
+		}
+		if other, ok := used[name]; ok {
+			return fmt.Errorf("%s and %s would both be named %s", other, defaultName, name)
+		}
+		used[name] = defaultName
+	}
+	return nil
+}
+
+// metricName returns the name of the metric without the namespace, taking the
+// overrides into account.
+func metricName(names map[string]string, defaultName string) string {
+	if override, ok := names[defaultName]; ok {
+		return override
+	}
+	return defaultName
+}
+
+// fullMetricName returns the fully qualified name of the metric as configured by
+// the metrics options.
+func fullMetricName(defaultName string) string {
+	return prometheus.BuildFQName(opts.Metrics.Namespace, "", metricName(opts.Metrics.Names, defaultName))
+}
+
+// sensorLabels returns the sensor and origin label values of the sensor
+// followed by the other label values. The pushed sensors are named
+// <origin>/<sensor> by the exporter, the local ones have no origin.
+func sensorLabels(name string, values ...string) []string {
+	sensor, origin := name, ""
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		origin, sensor = name[:i], name[i+1:]
+	}
+	return append([]string{sensor, origin}, values...)
+}
+
+// sensorKey returns the name of the sensor with the sensor and origin labels,
+// the reverse of sensorLabels.
+func sensorKey(sensor, origin string) string {
+	if len(origin) == 0 {
+		return sensor
+	}
+	return origin + "/" + sensor
+}
+
+// reservedLabelNames are used by the exporter metrics and can't be set as
+// constant labels.
+var reservedLabelNames = []string{"sensor", "cause", "type", "threshold", "state", "flag", "model", "pin", "driver", "location", "origin", "version", "commit", "goversion"}
+
+// validateConstLabels makes sure the constant labels are valid Prometheus label
+// names that don't collide with the labels set by the exporter.
+func validateConstLabels(labels map[string]string) error {
+	for name := range labels {
+		if !model.LabelName(name).IsValid() || strings.HasPrefix(name, model.ReservedLabelPrefix) {
+			return fmt.Errorf("%q is not a valid label name", name)
+		}
+		for _, reserved := range reservedLabelNames {
+			if name == reserved {
+				return fmt.Errorf("label %q is reserved by the exporter", name)
+			}
+		}
+	}
+	return nil
+}
+
+// newMetrics registers all exporter metrics with reg. The namespace is prepended
+// to every metric name, names maps the default metric name to its replacement.
+// With nativeHistograms the histograms have no classic buckets.
+func newMetrics(reg prometheus.Registerer, namespace string, names map[string]string, nativeHistograms bool) *metrics {
+	name := func(defaultName string) string {
+		return metricName(names, defaultName)
+	}
+	histogram := func(defaultName, help string, buckets []float64) prometheus.HistogramOpts {
+		o := prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      name(defaultName),
+			Help:      help,
+			Buckets:   buckets,
+		}
+		if nativeHistograms {
+			// a factor of 1.1 keeps the relative error of the quantiles under
+			// 5%, the bucket limit bounds the series size for noisy sensors
+			o.Buckets = nil
+			o.NativeHistogramBucketFactor = 1.1
+			o.NativeHistogramMaxBucketNumber = 100
+			o.NativeHistogramMinResetDuration = time.Hour
+		}
+		return o
+	}
+	factory := promauto.With(reg)
+
+	m := &metrics{
+		temperature: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      name("last_temperature"),
+			Help:      "Last measured temperature by DHT sensor",
+		}, []string{"sensor", "origin"}),
+		humidity: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      name("last_humidity"),
+			Help:      "Last measured humidity by DHT sensor",
+		}, []string{"sensor", "origin"}),
+		vaporPressureDeficit: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      name("last_vapor_pressure_deficit"),
+			Help:      "Last vapor deficit value",
+		}, []string{"sensor", "origin"}),
+		dewPoint: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      name("last_dew_point"),
+			Help:      "Last dew point value",
+		}, []string{"sensor", "origin"}),
+		lastSuccessfulMeasurementSeconds: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      name("last_successful_measurement_seconds"),
+			Help:      "Number of seconds that passed from the last successfully measurement",
+		}, []string{"sensor", "origin"}),
+		measurementRetries: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      name("last_measurement_retries"),
+			Help:      "Number of retries by DHT sensor since it got values",
+		}, []string{"sensor", "origin"}),
+		readFailures: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      name("read_failures_total"),
+			Help:      "Number of measurements that failed after all retries by the cause of the last error",
+		}, []string{"sensor", "origin", "cause"}),
+		readErrors: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      name("read_errors_total"),
+			Help:      "Number of failed read attempts including the retried ones by the error type, checksum and timeout errors usually mean wiring noise, gpio errors missing permissions",
+		}, []string{"sensor", "origin", "type"}),
+		readDuration: factory.NewHistogramVec(histogram("read_duration_seconds",
+			"Duration of the successful measurements including retries",
+			prometheus.ExponentialBuckets(0.01, 2, 12)), []string{"sensor", "origin"}),
+		temperatureDistribution: factory.NewHistogramVec(histogram("temperature_distribution_celsius",
+			"Distribution of the measured temperatures",
+			prometheus.LinearBuckets(-20, 5, 13)), []string{"sensor", "origin"}),
+		humidityDistribution: factory.NewHistogramVec(histogram("humidity_distribution_percent",
+			"Distribution of the measured humidity",
+			prometheus.LinearBuckets(10, 10, 9)), []string{"sensor", "origin"}),
+		identicalReadingsStreak: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      name("identical_readings_streak"),
+			Help:      "Number of consecutive readings identical to the previous one",
+		}, []string{"sensor", "origin"}),
+		measurementStale: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      name("measurement_stale"),
+			Help:      "Whether the values of the sensor are not exported because the last successful reading is older than the max age",
+		}, []string{"sensor", "origin"}),
+		powerCycles: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      name("power_cycles_total"),
+			Help:      "Number of times the sensor was power cycled after consecutive failed measurements",
+		}, []string{"sensor", "origin"}),
+		powerRecoveries: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      name("power_recoveries_total"),
+			Help:      "Number of power cycles followed by a successful measurement",
+		}, []string{"sensor", "origin"}),
+		thresholdBreached: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      name("threshold_breached"),
+			Help:      "Whether the last reading of the sensor is outside of the range of the threshold",
+		}, []string{"sensor", "origin", "threshold"}),
+		comfortState: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      name("comfort_state"),
+			Help:      "Comfort classification of the last reading, 1 for the current state",
+		}, []string{"sensor", "origin", "state"}),
+		batteryLevel: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      name("last_battery_level_percent"),
+			Help:      "Last battery level reported by a wireless sensor",
+		}, []string{"sensor", "origin"}),
+		rssi: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      name("last_rssi_dbm"),
+			Help:      "Signal strength of the last advertisement received from a wireless sensor",
+		}, []string{"sensor", "origin"}),
+		sensorInfo: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      name("sensor_info"),
+			Help:      "A metric with a constant '1' value labeled by sensor model, GPIO pin, driver, location and the origin of pushed readings",
+		}, []string{"sensor", "model", "pin", "driver", "location", "origin"}),
+		buildInfo: factory.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      name("exporter_build_info"),
+			Help:      "A metric with a constant '1' value labeled by version, commit and goversion from which the exporter was built",
+			ConstLabels: prometheus.Labels{
+				"version":   version,
+				"commit":    commit,
+				"goversion": runtime.Version(),
+			},
+		}),
+	}
+	m.buildInfo.Set(1)
+
+	return m
+}
+
+// setSensorInfo exports the static metadata of the configured sensors.
+func (m *metrics) setSensorInfo() {
+	for _, s := range sensors {
+		model, pin, driver := s.Driver.info()
+		m.sensorInfo.WithLabelValues(s.Name, model, pin, driver, s.Location, "").Set(1)
+		// the errors are exported from the start, so their rate is known
+		// before the first one
+		for _, t := range errorTypes {
+			m.readErrors.WithLabelValues(sensorLabels(s.Name, t)...)
+		}
+	}
+}
+
+// deleteValues removes the value gauges of the stale sensor.
+func (m *metrics) deleteValues(sensor string) {
+	for _, gauge := range []*prometheus.GaugeVec{m.temperature, m.humidity, m.vaporPressureDeficit, m.dewPoint, m.measurementRetries, m.batteryLevel, m.rssi} {
+		gauge.DeleteLabelValues(sensorLabels(sensor)...)
+	}
+	labels := sensorLabels(sensor)
+	m.comfortState.DeletePartialMatch(prometheus.Labels{"sensor": labels[0], "origin": labels[1]})
+}
+
+// observe updates the value gauges with the reading.
+func (m *metrics) observe(r *reading) {
+	m.temperature.WithLabelValues(sensorLabels(r.Sensor)...).Set(r.Temperature)
+	m.humidity.WithLabelValues(sensorLabels(r.Sensor)...).Set(r.Humidity)
+	m.measurementRetries.WithLabelValues(sensorLabels(r.Sensor)...).Set(float64(r.Retries))
+	m.vaporPressureDeficit.WithLabelValues(sensorLabels(r.Sensor)...).Set(r.VaporPressureDeficit)
+	m.dewPoint.WithLabelValues(sensorLabels(r.Sensor)...).Set(r.DewPoint)
+	m.temperatureDistribution.WithLabelValues(sensorLabels(r.Sensor)...).Observe(r.Temperature)
+	m.humidityDistribution.WithLabelValues(sensorLabels(r.Sensor)...).Observe(r.Humidity)
+	if m.comfort != nil {
+		current := m.comfort.classify(r)
+		for _, state := range comfortStates {
+			value := 0.0
+			if state == current {
+				value = 1
+			}
+			m.comfortState.WithLabelValues(sensorLabels(r.Sensor, state)...).Set(value)
+		}
+	}
+	// the pushed readings are not measured by the exporter
+	if r.Duration > 0 {
+		m.readDuration.WithLabelValues(sensorLabels(r.Sensor)...).Observe(r.Duration.Seconds())
+	}
+	if r.BatteryLevel != nil {
+		m.batteryLevel.WithLabelValues(sensorLabels(r.Sensor)...).Set(*r.BatteryLevel)
+	}
+	if r.RSSI != nil {
+		m.rssi.WithLabelValues(sensorLabels(r.Sensor)...).Set(*r.RSSI)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateMetricNames(t *testing.T) {
+	tests := []struct {
+		name      string
+		namespace string
+		names     map[string]string
+		wantErr   string
+	}{
+		{name: "defaults", namespace: "dht"},
+		{name: "override", namespace: "dht", names: map[string]string{"last_temperature": "temperature_celsius"}},
+		{name: "swapped", namespace: "dht", names: map[string]string{"last_temperature": "last_humidity", "last_humidity": "last_temperature"}},
+		{name: "no namespace", names: map[string]string{"last_temperature": "temperature_celsius"}},
+		{name: "unknown", namespace: "dht", names: map[string]string{"temperature": "x"}, wantErr: "unknown metric name(s) temperature"},
+		{name: "invalid override", namespace: "dht", names: map[string]string{"last_temperature": "bad-name"}, wantErr: `"dht_bad-name" of last_temperature is not a valid metric name`},
+		{name: "empty override", namespace: "dht", names: map[string]string{"last_temperature": ""}, wantErr: "is not a valid metric name"},
+		{name: "invalid namespace", namespace: "a-b", wantErr: "is not a valid metric name"},
+		{
+			name:      "same override",
+			namespace: "dht",
+			names:     map[string]string{"last_temperature": "x", "last_humidity": "x"},
+			wantErr:   "last_temperature and last_humidity would both be named dht_x",
+		},
+		{
+			name:      "default name",
+			namespace: "dht",
+			names:     map[string]string{"last_temperature": "last_humidity"},
+			wantErr:   "last_temperature and last_humidity would both be named dht_last_humidity",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateMetricNames(tt.namespace, tt.names)
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/goburrow/modbus"
+)
+
+// modbusSpecKeys lists the --sensor keys of the modbus driver.
+var modbusSpecKeys = []string{
+	"address", "slave", "register-type",
+	"temperature-register", "humidity-register", "temperature-scale", "humidity-scale",
+	"baud-rate", "parity", "stop-bits",
+}
+
+// modbusTimeout is the response timeout of a single request.
+const modbusTimeout = 2 * time.Second
+
+// modbusDriver polls the temperature and humidity input or holding registers
+// of a transmitter over Modbus TCP or RTU. The temperature is read as a signed
+// and the humidity as an unsigned 16-bit register, both are multiplied by
+// their scale.
+type modbusDriver struct {
+	address          string
+	connection       *modbusConnection
+	slave            byte
+	inputRegisters   bool
+	temperature      uint16
+	humidity         uint16
+	temperatureScale float64
+	humidityScale    float64
+}
+
+// newModbusDriver configures the driver from the --sensor keys, e.g.
+// driver=modbus,address=rtu:///dev/ttyUSB0,slave=1,temperature-register=1,humidity-register=0
+func newModbusDriver(values map[string]string) (*modbusDriver, error) {
+	d := &modbusDriver{
+		address:          values["address"],
+		slave:            1,
+		temperatureScale: 0.1,
+		humidityScale:    0.1,
+	}
+	u, err := url.Parse(d.address)
+	if err != nil || (u.Scheme != "tcp" && u.Scheme != "rtu") {
+		return nil, fmt.Errorf("invalid address %q, expected tcp://host:502 or rtu:///dev/ttyUSB0", d.address)
+	}
+
+	parseUint := func(key string, bits int, value *uint64) error {
+		if raw, ok := values[key]; ok {
+			v, err := strconv.ParseUint(raw, 10, bits)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %v", key, err)
+			}
+			*value = v
+		}
+		return nil
+	}
+	parseScale := func(key string, value *float64) error {
+		if raw, ok := values[key]; ok {
+			v, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %v", key, err)
+			}
+			*value = v
+		}
+		return nil
+	}
+	if _, ok := values["temperature-register"]; !ok {
+		return nil, fmt.Errorf("missing temperature-register")
+	}
+	if _, ok := values["humidity-register"]; !ok {
+		return nil, fmt.Errorf("missing humidity-register")
+	}
+	slave, temperature, humidity := uint64(d.slave), uint64(0), uint64(0)
+	baudRate, stopBits := uint64(9600), uint64(1)
+	for _, err := range []error{
+		parseUint("slave", 8, &slave),
+		parseUint("temperature-register", 16, &temperature),
+		parseUint("humidity-register", 16, &humidity),
+		parseUint("baud-rate", 32, &baudRate),
+		parseUint("stop-bits", 8, &stopBits),
+		parseScale("temperature-scale", &d.temperatureScale),
+		parseScale("humidity-scale", &d.humidityScale),
+	} {
+		if err != nil {
+			return nil, err
+		}
+	}
+	d.slave, d.temperature, d.humidity = byte(slave), uint16(temperature), uint16(humidity)
+	if stopBits != 1 && stopBits != 2 {
+		return nil, fmt.Errorf("invalid stop-bits %d, supported: 1, 2", stopBits)
+	}
+
+	switch values["register-type"] {
+	case "", "holding":
+	case "input":
+		d.inputRegisters = true
+	default:
+		return nil, fmt.Errorf("unsupported register-type %q, supported: holding, input", values["register-type"])
+	}
+	parity := "N"
+	if p, ok := values["parity"]; ok {
+		switch p {
+		case "N", "E", "O":
+			parity = p
+		default:
+			return nil, fmt.Errorf("unsupported parity %q, supported: N, E, O", p)
+		}
+	}
+	if u.Scheme == "tcp" {
+		d.connection = modbusTCPConnection(u.Host)
+	} else if d.connection, err = modbusRTUConnection(u.Path, int(baudRate), parity, int(stopBits)); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *modbusDriver) read() (temperature, humidity float64, err error) {
+	t, err := d.connection.readRegister(d.slave, d.inputRegisters, d.temperature)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to read temperature register %d: %v", d.temperature, err)
+	}
+	h, err := d.connection.readRegister(d.slave, d.inputRegisters, d.humidity)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to read humidity register %d: %v", d.humidity, err)
+	}
+	return float64(int16(t)) * d.temperatureScale, float64(h) * d.humidityScale, nil
+}
+
+func (d *modbusDriver) retryDelay() time.Duration {
+	return time.Second
+}
+
+func (d *modbusDriver) info() (model, pin, driver string) {
+	return "modbus", fmt.Sprintf("%s/%d", d.address, d.slave), "modbus"
+}
+
+// modbusConnection is a TCP connection or a serial line shared by all
+// sensors with the same address. The slave ID is switched per request.
+type modbusConnection struct {
+	// mu guards the slave ID in case the sensors are not on the same bus
+	mu       sync.Mutex
+	client   modbus.Client
+	setSlave func(slave byte)
+	// settings are the serial line settings of an RTU connection, e.g. 9600 8N1
+	settings string
+}
+
+var (
+	modbusConnectionsMu sync.Mutex
+	modbusConnections   = map[string]*modbusConnection{}
+)
+
+func modbusTCPConnection(address string) *modbusConnection {
+	modbusConnectionsMu.Lock()
+	defer modbusConnectionsMu.Unlock()
+	if c, ok := modbusConnections["tcp://"+address]; ok {
+		return c
+	}
+	handler := modbus.NewTCPClientHandler(address)
+	handler.Timeout = modbusTimeout
+	c := &modbusConnection{
+		client:   modbus.NewClient(handler),
+		setSlave: func(slave byte) { handler.SlaveId = slave },
+	}
+	modbusConnections["tcp://"+address] = c
+	return c
+}
+
+// modbusRTUConnection returns the serial line of the device. The sensors on
+// the same device must use the same serial line settings.
+func modbusRTUConnection(device string, baudRate int, parity string, stopBits int) (*modbusConnection, error) {
+	modbusConnectionsMu.Lock()
+	defer modbusConnectionsMu.Unlock()
+	settings := fmt.Sprintf("%d 8%s%d", baudRate, parity, stopBits)
+	if c, ok := modbusConnections["rtu://"+device]; ok {
+		if c.settings != settings {
+			return nil, fmt.Errorf("serial line settings %s of %s differ from the %s of another sensor on the device", settings, device, c.settings)
+		}
+		return c, nil
+	}
+	handler := modbus.NewRTUClientHandler(device)
+	handler.BaudRate = baudRate
+	handler.DataBits = 8
+	handler.Parity = parity
+	handler.StopBits = stopBits
+	handler.Timeout = modbusTimeout
+	c := &modbusConnection{
+		client:   modbus.NewClient(handler),
+		setSlave: func(slave byte) { handler.SlaveId = slave },
+		settings: settings,
+	}
+	modbusConnections["rtu://"+device] = c
+	return c, nil
+}
+
+func (c *modbusConnection) readRegister(slave byte, input bool, register uint16) (uint16, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setSlave(slave)
+	var (
+		data []byte
+		err  error
+	)
+	if input {
+		data, err = c.client.ReadInputRegisters(register, 1)
+	} else {
+		data, err = c.client.ReadHoldingRegisters(register, 1)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(data) != 2 {
+		return 0, fmt.Errorf("unexpected response length %d", len(data))
+	}
+	return binary.BigEndian.Uint16(data), nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/goburrow/modbus"
+)
+
+// fakeModbusClient answers the register reads from the registers map.
+type fakeModbusClient struct {
+	modbus.Client
+	input     bool
+	registers map[uint16][]byte
+}
+
+func (c *fakeModbusClient) ReadHoldingRegisters(address, quantity uint16) ([]byte, error) {
+	if c.input {
+		return nil, &modbus.ModbusError{ExceptionCode: modbus.ExceptionCodeIllegalFunction}
+	}
+	return c.registers[address], nil
+}
+
+func (c *fakeModbusClient) ReadInputRegisters(address, quantity uint16) ([]byte, error) {
+	if !c.input {
+		return nil, &modbus.ModbusError{ExceptionCode: modbus.ExceptionCodeIllegalFunction}
+	}
+	return c.registers[address], nil
+}
+
+func TestModbusDriverRead(t *testing.T) {
+	tests := []struct {
+		name            string
+		values          map[string]string
+		input           bool
+		registers       map[uint16][]byte
+		wantTemperature float64
+		wantHumidity    float64
+		wantErr         bool
+	}{
+		{
+			name:            "holding registers with the default scale",
+			values:          map[string]string{"temperature-register": "1", "humidity-register": "0"},
+			registers:       map[uint16][]byte{1: {0x00, 0xd7}, 0: {0x01, 0xc2}},
+			wantTemperature: 21.5,
+			wantHumidity:    45,
+		},
+		{
+			name:            "negative temperature",
+			values:          map[string]string{"temperature-register": "1", "humidity-register": "0"},
+			registers:       map[uint16][]byte{1: {0xff, 0x9c}, 0: {0x03, 0x20}},
+			wantTemperature: -10,
+			wantHumidity:    80,
+		},
+		{
+			name: "input registers with a custom scale",
+			values: map[string]string{
+				"register-type":        "input",
+				"temperature-register": "256",
+				"humidity-register":    "257",
+				"temperature-scale":    "0.01",
+				"humidity-scale":       "1",
+			},
+			input:           true,
+			registers:       map[uint16][]byte{256: {0x08, 0x34}, 257: {0x00, 0x37}},
+			wantTemperature: 21,
+			wantHumidity:    55,
+		},
+		{
+			name:      "wrong register type",
+			values:    map[string]string{"temperature-register": "1", "humidity-register": "0"},
+			input:     true,
+			registers: map[uint16][]byte{1: {0x00, 0xd7}, 0: {0x01, 0xc2}},
+			wantErr:   true,
+		},
+		{
+			name:      "short response",
+			values:    map[string]string{"temperature-register": "1", "humidity-register": "0"},
+			registers: map[uint16][]byte{1: {0xd7}, 0: {0x01, 0xc2}},
+			wantErr:   true,
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the connections are shared by address
+			tt.values["address"] = fmt.Sprintf("tcp://10.0.1.%d:502", i)
+			d, err := newModbusDriver(tt.values)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d.connection.client = &fakeModbusClient{input: tt.input, registers: tt.registers}
+			temperature, humidity, err := d.read()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if math.Abs(temperature-tt.wantTemperature) > 1e-9 || math.Abs(humidity-tt.wantHumidity) > 1e-9 {
+				t.Errorf("got %g °C and %g %%, want %g °C and %g %%", temperature, humidity, tt.wantTemperature, tt.wantHumidity)
+			}
+		})
+	}
+}
+
+func TestNewModbusDriver(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  map[string]string
+		wantErr bool
+	}{
+		{name: "tcp", values: map[string]string{"address": "tcp://10.0.0.1:502", "temperature-register": "1", "humidity-register": "0"}},
+		{name: "rtu", values: map[string]string{"address": "rtu:///dev/ttyUSB0", "temperature-register": "1", "humidity-register": "0", "parity": "E", "stop-bits": "2"}},
+		{name: "unsupported scheme", values: map[string]string{"address": "udp://10.0.0.1:502", "temperature-register": "1", "humidity-register": "0"}, wantErr: true},
+		{name: "missing temperature register", values: map[string]string{"address": "tcp://10.0.0.1:502", "humidity-register": "0"}, wantErr: true},
+		{name: "missing humidity register", values: map[string]string{"address": "tcp://10.0.0.1:502", "temperature-register": "1"}, wantErr: true},
+		{name: "register out of range", values: map[string]string{"address": "tcp://10.0.0.1:502", "temperature-register": "65536", "humidity-register": "0"}, wantErr: true},
+		{name: "invalid slave", values: map[string]string{"address": "tcp://10.0.0.1:502", "slave": "256", "temperature-register": "1", "humidity-register": "0"}, wantErr: true},
+		{name: "invalid scale", values: map[string]string{"address": "tcp://10.0.0.1:502", "temperature-register": "1", "humidity-register": "0", "humidity-scale": "x"}, wantErr: true},
+		{name: "unsupported register type", values: map[string]string{"address": "tcp://10.0.0.1:502", "register-type": "coil", "temperature-register": "1", "humidity-register": "0"}, wantErr: true},
+		{name: "unsupported parity", values: map[string]string{"address": "rtu:///dev/ttyUSB1", "parity": "X", "temperature-register": "1", "humidity-register": "0"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newModbusDriver(tt.values)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
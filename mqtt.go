@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Payload formats of the MQTT sensors.
+const (
+	// mqttFormatTasmota is the tele/<device>/SENSOR JSON published by Tasmota.
+	mqttFormatTasmota = "tasmota"
+	// mqttFormatESPHome are the plain number state topics published by ESPHome,
+	// one for the temperature and one for the humidity.
+	mqttFormatESPHome = "esphome"
+	// mqttFormatJSON is a JSON object with temperature and humidity keys.
+	mqttFormatJSON = "json"
+)
+
+// mqttDefaultMaxAge is how long the last value of an esphome sensor is paired
+// with the values of the other topic.
+const mqttDefaultMaxAge = 5 * time.Minute
+
+// mqttSensorSpec is the value of a --mqtt-sensor option, a comma separated
+// list of key=value pairs.
+type mqttSensorSpec struct {
+	raw    string
+	values map[string]string
+}
+
+// mqttSensorSpecKeys lists the keys supported in a --mqtt-sensor value.
+var mqttSensorSpecKeys = []string{"name", "location", "format", "topic", "temperature-topic", "humidity-topic", "tasmota-sensor", "max-age"}
+
+func (s *mqttSensorSpec) UnmarshalFlag(value string) error {
+	values, err := parseSpec(value, mqttSensorSpecKeys)
+	if err != nil {
+		return err
+	}
+	s.raw, s.values = value, values
+	return nil
+}
+
+func (s mqttSensorSpec) MarshalFlag() (string, error) {
+	return s.raw, nil
+}
+
+// mqttSensor is a sensor publishing its readings over MQTT.
+type mqttSensor struct {
+	name     string
+	location string
+	format   string
+	// topics maps the subscribed topics to the value they carry, empty for
+	// topics carrying both values
+	topics map[string]string
+	// tasmotaSensor is the key of the sensor in the Tasmota payload, empty
+	// for the first one reporting both values
+	tasmotaSensor string
+	// maxAge is how long a value of one topic is paired with the values of
+	// the other one
+	maxAge time.Duration
+
+	mu          sync.Mutex
+	temperature mqttValue
+	humidity    mqttValue
+}
+
+// mqttValue is the last value received on the topic of an esphome sensor.
+type mqttValue struct {
+	value    float64
+	received time.Time
+}
+
+// configureMQTTSensors validates the --mqtt-sensor options.
+func configureMQTTSensors(specs []mqttSensorSpec) ([]*mqttSensor, error) {
+	var result []*mqttSensor
+	names := map[string]bool{}
+	// topics maps the subscribed topics to the sensor, a topic is handled by
+	// a single sensor
+	topics := map[string]string{}
+	for _, s := range sensors {
+		names[s.Name] = true
+	}
+	for _, spec := range specs {
+		v := spec.values
+		s := &mqttSensor{
+			name:     v["name"],
+			location: v["location"],
+			format:   v["format"],
+			topics:   map[string]string{},
+
+			tasmotaSensor: v["tasmota-sensor"],
+			maxAge:        mqttDefaultMaxAge,
+		}
+		if len(s.name) == 0 {
+			return nil, fmt.Errorf("missing name in --mqtt-sensor %q", spec.raw)
+		}
+		if strings.Contains(s.name, "/") {
+			return nil, fmt.Errorf("name must not contain / in --mqtt-sensor %q", spec.raw)
+		}
+		if names[s.name] {
+			return nil, fmt.Errorf("duplicate sensor name %s in --mqtt-sensor %q", s.name, spec.raw)
+		}
+		names[s.name] = true
+		switch s.format {
+		case mqttFormatTasmota, mqttFormatJSON:
+			if len(v["topic"]) == 0 {
+				return nil, fmt.Errorf("missing topic in --mqtt-sensor %q", spec.raw)
+			}
+			s.topics[v["topic"]] = ""
+			if s.format != mqttFormatTasmota && len(s.tasmotaSensor) > 0 {
+				return nil, fmt.Errorf("tasmota-sensor requires the tasmota format in --mqtt-sensor %q", spec.raw)
+			}
+		case mqttFormatESPHome:
+			if len(s.tasmotaSensor) > 0 {
+				return nil, fmt.Errorf("tasmota-sensor requires the tasmota format in --mqtt-sensor %q", spec.raw)
+			}
+			if len(v["temperature-topic"]) == 0 || len(v["humidity-topic"]) == 0 {
+				return nil, fmt.Errorf("the esphome format needs temperature-topic and humidity-topic in --mqtt-sensor %q", spec.raw)
+			}
+			if v["temperature-topic"] == v["humidity-topic"] {
+				return nil, fmt.Errorf("temperature-topic and humidity-topic must differ in --mqtt-sensor %q", spec.raw)
+			}
+			s.topics[v["temperature-topic"]] = "temperature"
+			s.topics[v["humidity-topic"]] = "humidity"
+			if raw, ok := v["max-age"]; ok {
+				maxAge, err := time.ParseDuration(raw)
+				if err != nil || maxAge <= 0 {
+					return nil, fmt.Errorf("invalid max-age in --mqtt-sensor %q, want a positive duration", spec.raw)
+				}
+				s.maxAge = maxAge
+			}
+		default:
+			return nil, fmt.Errorf("unsupported format %q in --mqtt-sensor %q, supported: %s, %s, %s", s.format, spec.raw, mqttFormatTasmota, mqttFormatESPHome, mqttFormatJSON)
+		}
+		if s.format != mqttFormatESPHome {
+			if _, ok := v["max-age"]; ok {
+				return nil, fmt.Errorf("max-age requires the esphome format in --mqtt-sensor %q", spec.raw)
+			}
+		}
+		for topic := range s.topics {
+			// the messages are dispatched by their topic, a wildcard filter
+			// would never match one
+			if strings.ContainsAny(topic, "+#") {
+				return nil, fmt.Errorf("topic %s of --mqtt-sensor %q must not contain the wildcards + or #", topic, spec.raw)
+			}
+			if other, ok := topics[topic]; ok {
+				return nil, fmt.Errorf("topic %s of --mqtt-sensor %q is already used by sensor %s", topic, spec.raw, other)
+			}
+			topics[topic] = s.name
+		}
+		result = append(result, s)
+	}
+	return result, nil
+}
+
+// handle parses the payload published to the topic and returns the reading.
+// With separate topics every new value is paired with the last value of the
+// other topic, unless that one is older than the max age.
+func (s *mqttSensor) handle(topic string, payload []byte) (*reading, error) {
+	var temperature, humidity float64
+	switch s.topics[topic] {
+	case "temperature", "humidity":
+		value, err := strconv.ParseFloat(strings.TrimSpace(string(payload)), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s payload %q: %v", s.topics[topic], payload, err)
+		}
+		now := time.Now()
+		s.mu.Lock()
+		current, other := &s.temperature, &s.humidity
+		if s.topics[topic] == "humidity" {
+			current, other = other, current
+		}
+		*current = mqttValue{value: value, received: now}
+		paired := !other.received.IsZero() && now.Sub(other.received) <= s.maxAge
+		temperature, humidity = s.temperature.value, s.humidity.value
+		s.mu.Unlock()
+		if !paired {
+			return nil, nil
+		}
+	default:
+		var err error
+		if s.format == mqttFormatTasmota {
+			temperature, humidity, err = parseTasmotaPayload(payload, s.tasmotaSensor)
+		} else {
+			temperature, humidity, err = parseJSONPayload(payload)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := validateValues(temperature, humidity); err != nil {
+		return nil, err
+	}
+	r := newReading(s.name, temperature, humidity, 0)
+	r.Location = s.location
+	return r, nil
+}
+
+// parseTasmotaPayload extracts the values from a Tasmota SENSOR message, e.g.
+// {"Time":"...","AM2301":{"Temperature":21.3,"Humidity":45.2},"TempUnit":"C"}.
+// The values of the named sensor are used, without a name the first sensor in
+// the message reporting both values.
+func parseTasmotaPayload(payload []byte, name string) (temperature, humidity float64, err error) {
+	// the keys are decoded in the message order, a map would pick a random
+	// sensor of a device with several of them
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return 0, 0, fmt.Errorf("invalid Tasmota payload: %s", payload)
+	}
+	var (
+		unit  string
+		found bool
+	)
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid Tasmota payload: %v", err)
+		}
+		key, _ := token.(string)
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			return 0, 0, fmt.Errorf("invalid Tasmota payload: %v", err)
+		}
+		if key == "TempUnit" {
+			_ = json.Unmarshal(raw, &unit)
+			continue
+		}
+		if found || (len(name) > 0 && key != name) {
+			continue
+		}
+		var values struct {
+			Temperature *float64
+			Humidity    *float64
+		}
+		if json.Unmarshal(raw, &values) != nil || values.Temperature == nil || values.Humidity == nil {
+			continue
+		}
+		temperature, humidity, found = *values.Temperature, *values.Humidity, true
+	}
+	if !found {
+		if len(name) > 0 {
+			return 0, 0, fmt.Errorf("no sensor %s with Temperature and Humidity in the Tasmota payload", name)
+		}
+		return 0, 0, errors.New("no sensor with Temperature and Humidity in the Tasmota payload")
+	}
+	// TempUnit follows the sensors in the message
+	if unit == "F" {
+		temperature = (temperature - 32) * 5 / 9
+	}
+	return temperature, humidity, nil
+}
+
+// parseJSONPayload extracts the values from {"temperature":21.3,"humidity":45.2}.
+func parseJSONPayload(payload []byte) (temperature, humidity float64, err error) {
+	var values struct {
+		Temperature *float64 `json:"temperature"`
+		Humidity    *float64 `json:"humidity"`
+	}
+	if err := json.Unmarshal(payload, &values); err != nil {
+		return 0, 0, fmt.Errorf("invalid JSON payload: %v", err)
+	}
+	if values.Temperature == nil || values.Humidity == nil {
+		return 0, 0, errors.New("temperature or humidity missing in the JSON payload")
+	}
+	return *values.Temperature, *values.Humidity, nil
+}
+
+// subscribeMQTT connects to the broker and records the readings published by
+// the MQTT sensors. The client reconnects and subscribes again on its own.
+func (c *serveCommand) subscribeMQTT(mqttSensors []*mqttSensor, rec *recorder) (mqtt.Client, error) {
+	clientID := c.MQTTClientID
+	if len(clientID) == 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("unable to get hostname: %v", err)
+		}
+		clientID = "dht-exporter-" + hostname
+	}
+
+	filters := map[string]byte{}
+	handlers := map[string]*mqttSensor{}
+	for _, s := range mqttSensors {
+		for topic := range s.topics {
+			filters[topic] = 0
+			handlers[topic] = s
+		}
+	}
+	onMessage := func(_ mqtt.Client, msg mqtt.Message) {
+		s, ok := handlers[msg.Topic()]
+		if !ok {
+			return
+		}
+		r, err := s.handle(msg.Topic(), msg.Payload())
+		if err != nil {
+			log.Warn("Invalid MQTT sensor message", "sensor", s.name, "topic", msg.Topic(), "err", err)
+			return
+		}
+		if r != nil {
+			rec.record(s.name, r, nil)
+		}
+	}
+
+	options := mqtt.NewClientOptions().
+		AddBroker(c.MQTTBroker).
+		SetClientID(clientID).
+		SetUsername(c.MQTTUsername).
+		SetPassword(c.MQTTPassword).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetOnConnectHandler(func(client mqtt.Client) {
+			log.Info("Connected to MQTT broker", "broker", c.MQTTBroker, "topics", len(filters))
+			token := client.SubscribeMultiple(filters, onMessage)
+			if token.WaitTimeout(10*time.Second) && token.Error() != nil {
+				log.Error("Unable to subscribe to MQTT topics", "err", token.Error())
+			}
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Warn("Lost connection to MQTT broker", "broker", c.MQTTBroker, "err", err)
+		})
+	client := mqtt.NewClient(options)
+	// with the connect retry the token only completes once connected, the
+	// exporter keeps serving the local sensors in the meantime
+	if token := client.Connect(); token.WaitTimeout(10*time.Second) && token.Error() != nil {
+		return nil, token.Error()
+	}
+	return client, nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// mqttSpecs parses the --mqtt-sensor values.
+func mqttSpecs(t *testing.T, raw ...string) []mqttSensorSpec {
+	t.Helper()
+	specs := make([]mqttSensorSpec, len(raw))
+	for i := range raw {
+		if err := specs[i].UnmarshalFlag(raw[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return specs
+}
+
+func TestConfigureMQTTSensors(t *testing.T) {
+	tests := []struct {
+		name       string
+		specs      []string
+		wantMaxAge time.Duration
+		wantErr    string
+	}{
+		{name: "tasmota", specs: []string{"name=shed,format=tasmota,topic=tele/shed/SENSOR"}},
+		{
+			name:       "esphome",
+			specs:      []string{"name=hall,format=esphome,temperature-topic=hall/temperature,humidity-topic=hall/humidity"},
+			wantMaxAge: mqttDefaultMaxAge,
+		},
+		{
+			name:       "esphome max age",
+			specs:      []string{"name=hall,format=esphome,temperature-topic=hall/temperature,humidity-topic=hall/humidity,max-age=90s"},
+			wantMaxAge: 90 * time.Second,
+		},
+		{
+			name:    "invalid max age",
+			specs:   []string{"name=hall,format=esphome,temperature-topic=hall/temperature,humidity-topic=hall/humidity,max-age=0s"},
+			wantErr: "invalid max-age",
+		},
+		{
+			name:    "max age of tasmota",
+			specs:   []string{"name=shed,format=tasmota,topic=tele/shed/SENSOR,max-age=1m"},
+			wantErr: "max-age requires the esphome format",
+		},
+		{
+			name:    "single level wildcard",
+			specs:   []string{"name=shed,format=tasmota,topic=tele/+/SENSOR"},
+			wantErr: "must not contain the wildcards",
+		},
+		{
+			name:    "multi level wildcard",
+			specs:   []string{"name=hall,format=esphome,temperature-topic=hall/temperature,humidity-topic=hall/#"},
+			wantErr: "must not contain the wildcards",
+		},
+		{
+			name:    "shared topic",
+			specs:   []string{"name=shed,format=json,topic=shed", "name=barn,format=json,topic=shed"},
+			wantErr: "already used by sensor shed",
+		},
+	}
+	previous := sensors
+	sensors = nil
+	t.Cleanup(func() { sensors = previous })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := configureMQTTSensors(mqttSpecs(t, tt.specs...))
+			if len(tt.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result[0].format == mqttFormatESPHome && result[0].maxAge != tt.wantMaxAge {
+				t.Errorf("got max age %v, want %v", result[0].maxAge, tt.wantMaxAge)
+			}
+		})
+	}
+}
+
+func TestMQTTSensorHandleESPHome(t *testing.T) {
+	type message struct {
+		topic   string
+		payload string
+		// age makes the last value of the other topic this old before the
+		// message is handled
+		age time.Duration
+	}
+	tests := []struct {
+		name     string
+		messages []message
+		// want are the temperature and humidity of the reading of the last
+		// message, nil when there is none
+		want []float64
+	}{
+		{name: "temperature only", messages: []message{{topic: "temperature", payload: "21.5"}}},
+		{name: "paired", messages: []message{{topic: "temperature", payload: "21.5"}, {topic: "humidity", payload: "45"}}, want: []float64{21.5, 45}},
+		{
+			name:     "new value with the last other one",
+			messages: []message{{topic: "temperature", payload: "21.5"}, {topic: "humidity", payload: "45"}, {topic: "temperature", payload: "22"}},
+			want:     []float64{22, 45},
+		},
+		{
+			name:     "same topic twice",
+			messages: []message{{topic: "humidity", payload: "45"}, {topic: "humidity", payload: "46"}, {topic: "temperature", payload: "21.5"}},
+			want:     []float64{21.5, 46},
+		},
+		{
+			name:     "other value too old",
+			messages: []message{{topic: "temperature", payload: "21.5"}, {topic: "humidity", payload: "45", age: 2 * time.Minute}},
+		},
+		{
+			name:     "other value within the max age",
+			messages: []message{{topic: "temperature", payload: "21.5"}, {topic: "humidity", payload: "45", age: 30 * time.Second}},
+			want:     []float64{21.5, 45},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &mqttSensor{
+				name:   "hall",
+				format: mqttFormatESPHome,
+				topics: map[string]string{"temperature": "temperature", "humidity": "humidity"},
+				maxAge: time.Minute,
+			}
+			var (
+				r   *reading
+				err error
+			)
+			for _, m := range tt.messages {
+				for _, v := range []*mqttValue{&s.temperature, &s.humidity} {
+					if !v.received.IsZero() {
+						v.received = v.received.Add(-m.age)
+					}
+				}
+				if r, err = s.handle(m.topic, []byte(m.payload)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.want == nil {
+				if r != nil {
+					t.Errorf("got reading %+v, want none", r)
+				}
+				return
+			}
+			if r == nil {
+				t.Fatalf("got no reading, want %v", tt.want)
+			}
+			if r.Temperature != tt.want[0] || r.Humidity != tt.want[1] {
+				t.Errorf("got reading %g, %g, want %g, %g", r.Temperature, r.Humidity, tt.want[0], tt.want[1])
+			}
+		})
+	}
+}
+
+func TestParseTasmotaPayload(t *testing.T) {
+	tests := []struct {
+		name            string
+		payload         string
+		sensor          string
+		wantTemperature float64
+		wantHumidity    float64
+		wantErr         string
+	}{
+		{
+			name:            "single sensor",
+			payload:         `{"Time":"2026-10-14T10:00:00","AM2301":{"Temperature":21.3,"Humidity":45.2},"TempUnit":"C"}`,
+			wantTemperature: 21.3,
+			wantHumidity:    45.2,
+		},
+		{
+			name:            "two sensors use the first one",
+			payload:         `{"Time":"2026-10-14T10:00:00","AM2301":{"Temperature":21.3,"Humidity":45.2},"SHT3X":{"Temperature":19.8,"Humidity":51.0},"TempUnit":"C"}`,
+			wantTemperature: 21.3,
+			wantHumidity:    45.2,
+		},
+		{
+			name:            "two sensors with a name",
+			payload:         `{"Time":"2026-10-14T10:00:00","AM2301":{"Temperature":21.3,"Humidity":45.2},"SHT3X":{"Temperature":19.8,"Humidity":51.0},"TempUnit":"C"}`,
+			sensor:          "SHT3X",
+			wantTemperature: 19.8,
+			wantHumidity:    51,
+		},
+		{
+			name:            "first sensor without humidity",
+			payload:         `{"DS18B20":{"Id":"0316A2791DFF","Temperature":18.5},"SHT3X":{"Temperature":19.8,"Humidity":51.0},"TempUnit":"C"}`,
+			wantTemperature: 19.8,
+			wantHumidity:    51,
+		},
+		{
+			name:            "fahrenheit",
+			payload:         `{"AM2301":{"Temperature":68,"Humidity":45},"TempUnit":"F"}`,
+			wantTemperature: 20,
+			wantHumidity:    45,
+		},
+		{
+			name:    "named sensor missing",
+			payload: `{"AM2301":{"Temperature":21.3,"Humidity":45.2}}`,
+			sensor:  "SHT3X",
+			wantErr: "no sensor SHT3X",
+		},
+		{
+			name:    "no humidity",
+			payload: `{"DS18B20":{"Temperature":18.5},"TempUnit":"C"}`,
+			wantErr: "no sensor with Temperature and Humidity",
+		},
+		{
+			name:    "not an object",
+			payload: `[1,2]`,
+			wantErr: "invalid Tasmota payload",
+		},
+		{
+			name:    "truncated",
+			payload: `{"AM2301":{"Temperature":21.3,`,
+			wantErr: "invalid Tasmota payload",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the sensor must not change from one message to the next
+			for i := 0; i < 20; i++ {
+				temperature, humidity, err := parseTasmotaPayload([]byte(tt.payload), tt.sensor)
+				if len(tt.wantErr) > 0 {
+					if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+						t.Fatalf("error = %v, want %q", err, tt.wantErr)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if temperature != tt.wantTemperature || humidity != tt.wantHumidity {
+					t.Fatalf("parseTasmotaPayload = %g, %g, want %g, %g", temperature, humidity, tt.wantTemperature, tt.wantHumidity)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Sources of the Raspberry Pi health values.
+const (
+	// piThrottledPath is the firmware throttled state exposed by the newer
+	// kernels, the same value as vcgencmd get_throttled
+	piThrottledPath = "/sys/devices/platform/soc/soc:firmware/get_throttled"
+	// piCPUTemperaturePath is the SoC temperature in millidegrees Celsius
+	piCPUTemperaturePath = "/sys/class/thermal/thermal_zone0/temp"
+	// piVcgencmdTimeout bounds the vcgencmd call during a scrape
+	piVcgencmdTimeout = 2 * time.Second
+)
+
+// piThrottledFlags maps the flag label values to the bits of the throttled
+// state. The bits 16 and above are set when the condition occurred since the
+// boot.
+var piThrottledFlags = []struct {
+	name string
+	bit  uint
+}{
+	{"undervoltage", 0},
+	{"frequency_capped", 1},
+	{"throttled", 2},
+	{"soft_temperature_limit", 3},
+}
+
+// piCollector exports the undervoltage and throttling flags and the CPU
+// temperature of a Raspberry Pi. Values that can't be read, e.g. on other
+// boards, are left out.
+type piCollector struct {
+	throttled         *prometheus.Desc
+	throttledOccurred *prometheus.Desc
+	cpuTemperature    *prometheus.Desc
+}
+
+func newPiCollector() *piCollector {
+	return &piCollector{
+		throttled: prometheus.NewDesc(fullMetricName("pi_throttled"),
+			"Whether the Raspberry Pi firmware reports the condition, 1 for undervoltage means the power supply is too weak",
+			[]string{"flag"}, nil),
+		throttledOccurred: prometheus.NewDesc(fullMetricName("pi_throttled_occurred"),
+			"Whether the Raspberry Pi firmware reported the condition since the boot",
+			[]string{"flag"}, nil),
+		cpuTemperature: prometheus.NewDesc(fullMetricName("pi_cpu_temperature_celsius"),
+			"Temperature of the Raspberry Pi SoC",
+			nil, nil),
+	}
+}
+
+func (c *piCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.throttled
+	ch <- c.throttledOccurred
+	ch <- c.cpuTemperature
+}
+
+func (c *piCollector) Collect(ch chan<- prometheus.Metric) {
+	if state, err := readThrottled(); err != nil {
+		log.Debug("Unable to read the throttled state", "err", err)
+	} else {
+		for _, flag := range piThrottledFlags {
+			ch <- prometheus.MustNewConstMetric(c.throttled, prometheus.GaugeValue, float64(state>>flag.bit&1), flag.name)
+			ch <- prometheus.MustNewConstMetric(c.throttledOccurred, prometheus.GaugeValue, float64(state>>(flag.bit+16)&1), flag.name)
+		}
+	}
+	if raw, err := os.ReadFile(piCPUTemperaturePath); err != nil {
+		log.Debug("Unable to read the CPU temperature", "err", err)
+	} else if millis, err := strconv.ParseFloat(strings.TrimSpace(string(raw)), 64); err == nil {
+		ch <- prometheus.MustNewConstMetric(c.cpuTemperature, prometheus.GaugeValue, millis/1000)
+	}
+}
+
+// readThrottled returns the throttled state from sysfs, falling back to
+// vcgencmd on the older kernels. The undervoltage bit of the rpi_volt hwmon
+// device is merged in, as it's updated without the firmware call.
+func readThrottled() (uint64, error) {
+	var raw string
+	if data, err := os.ReadFile(piThrottledPath); err == nil {
+		raw = strings.TrimSpace(string(data))
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), piVcgencmdTimeout)
+		defer cancel()
+		out, err := exec.CommandContext(ctx, "vcgencmd", "get_throttled").Output()
+		if err != nil {
+			return 0, fmt.Errorf("vcgencmd get_throttled: %v", err)
+		}
+		// throttled=0x50005
+		_, raw, _ = strings.Cut(strings.TrimSpace(string(out)), "=")
+	}
+	state, err := strconv.ParseUint(strings.TrimPrefix(raw, "0x"), 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid throttled state %q", raw)
+	}
+	if undervoltage, ok := readHwmonUndervoltage(); ok && undervoltage {
+		state |= 1
+	}
+	return state, nil
+}
+
+// readHwmonUndervoltage reads the low voltage alarm of the rpi_volt hwmon
+// device.
+func readHwmonUndervoltage() (undervoltage, ok bool) {
+	names, _ := filepath.Glob("/sys/class/hwmon/hwmon*/name")
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil || strings.TrimSpace(string(data)) != "rpi_volt" {
+			continue
+		}
+		alarm, err := os.ReadFile(filepath.Join(filepath.Dir(name), "in0_lcrit_alarm"))
+		if err != nil {
+			return false, false
+		}
+		return strings.TrimSpace(string(alarm)) == "1", true
+	}
+	return false, false
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"periph.io/x/conn/v3/gpio"
+	"periph.io/x/conn/v3/gpio/gpioreg"
+	"periph.io/x/host/v3"
+)
+
+// powerOnDelay is how long a sensor needs after the power is restored before
+// it can be read, the DHT22 datasheet asks for at least a second.
+const powerOnDelay = 2 * time.Second
+
+// powerPin is a GPIO pin powering one or more sensors, e.g. through a MOSFET or
+// a relay. It is high while the sensors are powered.
+type powerPin struct {
+	pin gpio.PinIO
+	// buses are the buses of the powered sensors, locked while the sensors
+	// are off, sorted so that the pins sharing a bus lock them in the same
+	// order
+	buses []string
+
+	// mu prevents sensors sharing the pin from cycling it at once and guards
+	// cycles
+	mu sync.Mutex
+	// cycles counts the power cycles, the sensors reset their failures when
+	// another sensor on the pin cycled it
+	cycles int
+}
+
+// cycleCount returns the number of power cycles of the pin.
+func (p *powerPin) cycleCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.cycles
+}
+
+// powerSwitch power cycles a sensor that locked up, after the configured
+// number of consecutive failed measurements. It observes the measurement loop
+// and the on demand reads of the sensor.
+type powerSwitch struct {
+	sensor string
+	power  *powerPin
+	after  int
+	off    time.Duration
+
+	cycles     prometheus.Counter
+	recoveries prometheus.Counter
+
+	// mu serializes the observations of the measurement loop and the on
+	// demand reads
+	mu       sync.Mutex
+	failures int
+	cycled   bool
+	// seenCycles is the cycle count of the pin the failures were counted at
+	seenCycles int
+}
+
+// openPowerSwitches powers on the sensors with a power pin and returns their
+// switches by the sensor name.
+func openPowerSwitches(m *metrics) (map[string]*powerSwitch, error) {
+	switches := map[string]*powerSwitch{}
+	pins := map[string]*powerPin{}
+	for _, s := range sensors {
+		if len(s.PowerPIN) == 0 {
+			continue
+		}
+		power, ok := pins[s.PowerPIN]
+		if !ok {
+			if _, err := host.Init(); err != nil {
+				return nil, fmt.Errorf("unable to initialize periph: %v", err)
+			}
+			pin := gpioreg.ByName(s.PowerPIN)
+			if pin == nil {
+				closePowerSwitches(switches)
+				return nil, fmt.Errorf("unknown GPIO pin %q", s.PowerPIN)
+			}
+			if err := pin.Out(gpio.High); err != nil {
+				closePowerSwitches(switches)
+				return nil, err
+			}
+			power = &powerPin{pin: pin}
+			pins[s.PowerPIN] = power
+		}
+		if !slices.Contains(power.buses, s.Bus) {
+			power.buses = append(power.buses, s.Bus)
+			sort.Strings(power.buses)
+		}
+		switches[s.Name] = &powerSwitch{
+			sensor:     s.Name,
+			power:      power,
+			after:      int(opts.Sensor.PowerCycleAfter),
+			off:        opts.Sensor.PowerOffDuration,
+			cycles:     m.powerCycles.WithLabelValues(sensorLabels(s.Name)...),
+			recoveries: m.powerRecoveries.WithLabelValues(sensorLabels(s.Name)...),
+		}
+	}
+	return switches, nil
+}
+
+// closePowerSwitches releases the power pins, the sensors stay powered.
+func closePowerSwitches(switches map[string]*powerSwitch) {
+	halted := map[*powerPin]bool{}
+	for _, p := range switches {
+		if halted[p.power] {
+			continue
+		}
+		halted[p.power] = true
+		if err := p.power.pin.Halt(); err != nil {
+			log.Warn("Unable to release the sensor power pin", "pin", p.power.pin.Name(), "err", err)
+		}
+	}
+}
+
+// observe counts the consecutive failed measurements and power cycles the
+// sensor once there are enough of them. A successful measurement after a power
+// cycle counts as a recovery.
+func (p *powerSwitch) observe(ctx context.Context, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// the failures before a power cycle by another sensor on the pin are
+	// not the fault of this sensor
+	if cycles := p.power.cycleCount(); cycles != p.seenCycles {
+		p.seenCycles, p.failures = cycles, 0
+	}
+	if err == nil {
+		if p.cycled {
+			log.Info("Sensor recovered after the power cycle", "sensor", p.sensor)
+			p.recoveries.Inc()
+			p.cycled = false
+		}
+		p.failures = 0
+		return
+	}
+	p.failures++
+	if p.failures < p.after {
+		return
+	}
+	p.failures = 0
+	log.Warn("Power cycling the sensor", "sensor", p.sensor, "failures", p.after, "pin", p.power.pin.Name(), "off", p.off)
+	if err := p.cycle(ctx); err != nil {
+		log.Error("Unable to power cycle the sensor", "sensor", p.sensor, "pin", p.power.pin.Name(), "err", err)
+		return
+	}
+	p.cycles.Inc()
+	p.cycled = true
+	p.seenCycles = p.power.cycleCount()
+}
+
+// cycle cuts the power for the off duration and waits for the sensor to start.
+// The buses of all sensors on the pin are locked meanwhile, so none of them is
+// read while off or starting. The power is always restored, also when the
+// context is cancelled.
+func (p *powerSwitch) cycle(ctx context.Context) error {
+	p.power.mu.Lock()
+	defer p.power.mu.Unlock()
+	for _, bus := range p.power.buses {
+		lock := busLock(bus)
+		lock.Lock()
+		defer lock.Unlock()
+	}
+	if err := p.power.pin.Out(gpio.Low); err != nil {
+		return err
+	}
+	p.power.cycles++
+	select {
+	case <-ctx.Done():
+	case <-time.After(p.off):
+	}
+	if err := p.power.pin.Out(gpio.High); err != nil {
+		return err
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(powerOnDelay):
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"periph.io/x/conn/v3/gpio"
+)
+
+// fakePowerPin records the levels the pin was set to and whether the buses
+// were unlocked meanwhile.
+type fakePowerPin struct {
+	gpio.PinIO
+	levels []gpio.Level
+	err    error
+
+	buses    []string
+	unlocked []string
+}
+
+func (p *fakePowerPin) Name() string { return "GPIO17" }
+
+func (p *fakePowerPin) Out(l gpio.Level) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.levels = append(p.levels, l)
+	for _, bus := range p.buses {
+		if lock := busLock(bus); lock.TryLock() {
+			lock.Unlock()
+			p.unlocked = append(p.unlocked, bus)
+		}
+	}
+	return nil
+}
+
+func TestPowerSwitchObserve(t *testing.T) {
+	tests := []struct {
+		name  string
+		after int
+		// failed lists the measurements in order, true for a failed one
+		failed         []bool
+		pinErr         error
+		wantCycles     float64
+		wantRecoveries float64
+	}{
+		{name: "below the threshold", after: 3, failed: []bool{true, true}},
+		{name: "at the threshold", after: 3, failed: []bool{true, true, true}, wantCycles: 1},
+		{name: "success resets the failures", after: 3, failed: []bool{true, true, false, true, true}},
+		{name: "recovered", after: 2, failed: []bool{true, true, false, false}, wantCycles: 1, wantRecoveries: 1},
+		{name: "cycled again", after: 2, failed: []bool{true, true, true, true, false}, wantCycles: 2, wantRecoveries: 1},
+		{name: "every failure", after: 1, failed: []bool{true, true, true}, wantCycles: 3},
+		{name: "pin failure", after: 1, failed: []bool{true, false}, pinErr: errors.New("permission denied")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMetrics(prometheus.NewRegistry(), "dht", nil, false)
+			pin := &fakePowerPin{err: tt.pinErr}
+			p := &powerSwitch{
+				sensor:     "attic",
+				power:      &powerPin{pin: pin},
+				after:      tt.after,
+				cycles:     m.powerCycles.WithLabelValues("attic", ""),
+				recoveries: m.powerRecoveries.WithLabelValues("attic", ""),
+			}
+			// a cancelled context skips waiting for the sensor to start
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			for _, failed := range tt.failed {
+				var err error
+				if failed {
+					err = errTestRead
+				}
+				p.observe(ctx, err)
+			}
+			if got := testutil.ToFloat64(p.cycles); got != tt.wantCycles {
+				t.Errorf("got %g power cycles, want %g", got, tt.wantCycles)
+			}
+			if got := testutil.ToFloat64(p.recoveries); got != tt.wantRecoveries {
+				t.Errorf("got %g recoveries, want %g", got, tt.wantRecoveries)
+			}
+			// the power is cut and restored on every cycle
+			if want := 2 * int(tt.wantCycles); len(pin.levels) != want {
+				t.Fatalf("the pin was set %d times, want %d", len(pin.levels), want)
+			}
+			for i, level := range pin.levels {
+				if want := i%2 == 1; level != gpio.Level(want) {
+					t.Errorf("the pin was set to %v at %d, want %v", level, i, gpio.Level(want))
+				}
+			}
+		})
+	}
+}
+
+func TestPowerSwitchSharedPin(t *testing.T) {
+	m := newMetrics(prometheus.NewRegistry(), "dht", nil, false)
+	buses := []string{"test-power-a", "test-power-b"}
+	pin := &fakePowerPin{buses: buses}
+	power := &powerPin{pin: pin, buses: buses}
+	newSwitch := func(sensor string) *powerSwitch {
+		return &powerSwitch{
+			sensor:     sensor,
+			power:      power,
+			after:      2,
+			cycles:     m.powerCycles.WithLabelValues(sensor, ""),
+			recoveries: m.powerRecoveries.WithLabelValues(sensor, ""),
+		}
+	}
+	attic, cellar := newSwitch("attic"), newSwitch("cellar")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// cellar fails once, then attic locks up and cycles the shared pin
+	cellar.observe(ctx, errTestRead)
+	attic.observe(ctx, errTestRead)
+	attic.observe(ctx, errTestRead)
+	if got := testutil.ToFloat64(attic.cycles); got != 1 {
+		t.Fatalf("got %d power cycles of attic, want 1", int(got))
+	}
+	if len(pin.unlocked) > 0 {
+		t.Errorf("the buses %v were unlocked during the power cycle", pin.unlocked)
+	}
+	// the failure of cellar before the cycle doesn't count anymore
+	attic.observe(ctx, errTestRead)
+	cellar.observe(ctx, errTestRead)
+	if got := testutil.ToFloat64(cellar.cycles); got != 0 {
+		t.Errorf("got %d power cycles of cellar, want 0", int(got))
+	}
+	cellar.observe(ctx, errTestRead)
+	if got := testutil.ToFloat64(cellar.cycles); got != 1 {
+		t.Errorf("got %d power cycles of cellar, want 1", int(got))
+	}
+	// neither does the failure of attic before the cycle by cellar
+	attic.observe(ctx, errTestRead)
+	if got := testutil.ToFloat64(attic.cycles); got != 1 {
+		t.Errorf("got %d power cycles of attic, want 1", int(got))
+	}
+	for _, bus := range buses {
+		if !busLock(bus).TryLock() {
+			t.Errorf("bus %s is still locked", bus)
+			continue
+		}
+		busLock(bus).Unlock()
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// privilegeCalls are the system calls dropping the privileges, replaced by the
+// tests.
+var privilegeCalls = struct {
+	setrlimit func(resource int, limit *unix.Rlimit) error
+	setgroups func(gids []int) error
+	setgid    func(gid int) error
+	setuid    func(uid int) error
+}{
+	setrlimit: unix.Setrlimit,
+	setgroups: syscall.Setgroups,
+	setgid:    syscall.Setgid,
+	setuid:    syscall.Setuid,
+}
+
+// dropPrivileges switches the process to the given user and its groups. Things
+// that require root are prepared before: the memory is locked for the whole
+// process lifetime when --sensor-lock-memory is set and the real-time priority
+// limit is raised, so the unprivileged process can still use
+// --sensor-boost-performance.
+func dropPrivileges(name string) error {
+	u, err := lookupUser(name)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("invalid UID %q of user %s: %v", u.Uid, u.Username, err)
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return fmt.Errorf("invalid GID %q of user %s: %v", u.Gid, u.Username, err)
+	}
+	groupIDs, err := u.GroupIds()
+	if err != nil {
+		return fmt.Errorf("unable to get groups of user %s: %v", u.Username, err)
+	}
+	var groups []int
+	for _, id := range groupIDs {
+		group, err := strconv.Atoi(id)
+		if err != nil {
+			return fmt.Errorf("invalid group ID %q of user %s: %v", id, u.Username, err)
+		}
+		groups = append(groups, group)
+	}
+
+	if opts.Sensor.LockMemory {
+		if err := lockMemory(); err != nil {
+			return fmt.Errorf("unable to lock memory: %v", err)
+		}
+		memoryLocked = true
+	}
+	if opts.Sensor.BoostPerformance {
+		limit := &unix.Rlimit{Cur: 99, Max: 99}
+		if err := privilegeCalls.setrlimit(unix.RLIMIT_RTPRIO, limit); err != nil {
+			return fmt.Errorf("unable to raise the real-time priority limit: %v", err)
+		}
+	}
+
+	// the order matters, the groups can't be changed once the UID is dropped
+	if err := privilegeCalls.setgroups(groups); err != nil {
+		return fmt.Errorf("unable to set groups: %v", err)
+	}
+	if err := privilegeCalls.setgid(gid); err != nil {
+		return fmt.Errorf("unable to set GID %d: %v", gid, err)
+	}
+	if err := privilegeCalls.setuid(uid); err != nil {
+		return fmt.Errorf("unable to set UID %d: %v", uid, err)
+	}
+	log.Info("Dropped privileges", "user", u.Username, "uid", uid, "gid", gid)
+
+	if usesGPIO() {
+		if err := checkGPIOAccess(); err != nil {
+			return fmt.Errorf("user %s can't access GPIO: %v", u.Username, err)
+		}
+	}
+	return nil
+}
+
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		if u, err := user.LookupId(name); err == nil {
+			return u, nil
+		}
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find user %s: %v", name, err)
+	}
+	return u, nil
+}
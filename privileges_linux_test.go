@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"os/user"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestDropPrivileges(t *testing.T) {
+	current, err := user.Current()
+	if err != nil {
+		t.Skipf("unable to get the current user: %v", err)
+	}
+	errDenied := errors.New("operation not permitted")
+	tests := []struct {
+		name  string
+		user  string
+		boost bool
+		// fail is the call that fails
+		fail      string
+		wantCalls []string
+		wantErr   string
+	}{
+		{name: "dropped", user: current.Username, wantCalls: []string{"setgroups", "setgid", "setuid"}},
+		{name: "by UID", user: current.Uid, wantCalls: []string{"setgroups", "setgid", "setuid"}},
+		{name: "boost performance", user: current.Username, boost: true, wantCalls: []string{"setrlimit", "setgroups", "setgid", "setuid"}},
+		{name: "unknown user", user: "no-such-user-dht", wantErr: "unable to find user no-such-user-dht"},
+		{name: "rlimit failure", user: current.Username, boost: true, fail: "setrlimit", wantCalls: []string{"setrlimit"}, wantErr: "unable to raise the real-time priority limit"},
+		{name: "groups failure", user: current.Username, fail: "setgroups", wantCalls: []string{"setgroups"}, wantErr: "unable to set groups"},
+		{name: "GID failure", user: current.Username, fail: "setgid", wantCalls: []string{"setgroups", "setgid"}, wantErr: "unable to set GID " + current.Gid},
+		{name: "UID failure", user: current.Username, fail: "setuid", wantCalls: []string{"setgroups", "setgid", "setuid"}, wantErr: "unable to set UID " + current.Uid},
+	}
+	previousCalls, previousSensors, previousBoost := privilegeCalls, sensors, opts.Sensor.BoostPerformance
+	t.Cleanup(func() {
+		privilegeCalls, sensors, opts.Sensor.BoostPerformance = previousCalls, previousSensors, previousBoost
+	})
+	// without GPIO sensors the access to GPIO is not checked
+	sensors = nil
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls []string
+			call := func(name string) error {
+				calls = append(calls, name)
+				if name == tt.fail {
+					return errDenied
+				}
+				return nil
+			}
+			privilegeCalls.setrlimit = func(int, *unix.Rlimit) error { return call("setrlimit") }
+			privilegeCalls.setgroups = func([]int) error { return call("setgroups") }
+			privilegeCalls.setgid = func(int) error { return call("setgid") }
+			privilegeCalls.setuid = func(int) error { return call("setuid") }
+			opts.Sensor.BoostPerformance = tt.boost
+
+			err := dropPrivileges(tt.user)
+			if len(tt.wantErr) == 0 && err != nil {
+				t.Fatal(err)
+			}
+			if len(tt.wantErr) > 0 && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+			// the groups can't be changed once the UID is dropped
+			if strings.Join(calls, " ") != strings.Join(tt.wantCalls, " ") {
+				t.Errorf("got calls %v, want %v", calls, tt.wantCalls)
+			}
+		})
+	}
+}
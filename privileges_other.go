@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func dropPrivileges(_ string) error {
+	return errors.New("--run-as-user is only supported on Linux")
+}
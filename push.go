@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// pushMaxBodySize limits the size of a pushed request body.
+const pushMaxBodySize = 1 << 20
+
+// pushMaxClockSkew is how far in the future a pushed reading can be, a later
+// one would block the readings of the sensor until its time.
+const pushMaxClockSkew = time.Minute
+
+// pushOtherOrigin is the origin label of the rejected pushes of origins that
+// were never admitted, so clients can't add series by choosing new origins.
+const pushOtherOrigin = "other"
+
+// pushNamePattern matches the origins and sensor names accepted by the push
+// receiver, they can't contain the / separating them in the sensor name.
+var pushNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.:-]{1,64}$`)
+
+// pushedReading is a reading pushed by a remote field unit, in the format of
+// the webhook. The derived values are computed again by the receiver.
+type pushedReading struct {
+	Sensor       string    `json:"sensor"`
+	Location     string    `json:"location"`
+	Temperature  *float64  `json:"temperature"`
+	Humidity     *float64  `json:"humidity"`
+	Retries      int       `json:"retries"`
+	Time         time.Time `json:"time"`
+	BatteryLevel *float64  `json:"battery_level"`
+	RSSI         *float64  `json:"rssi"`
+}
+
+// pushReceiver records the readings pushed by remote field units to POST
+// /api/v1/push, e.g. other exporters with --webhook-url pointing to it or ESP
+// devices. The sensors of an origin are named <origin>/<sensor> within the
+// exporter, so the thresholds, stale values and outputs apply to them like to
+// the local ones, and exported with the sensor name sent by the field unit and
+// an origin label. The number of pushed sensors and origins is limited, they
+// are kept until a restart.
+type pushReceiver struct {
+	rec        *recorder
+	metrics    *metrics
+	timeout    time.Duration
+	maxSensors int
+
+	mu sync.Mutex
+	// lastSeen is the time of the last push by origin
+	lastSeen map[string]time.Time
+	silent   map[string]bool
+	// last is the time of the last recorded reading by sensor, older readings
+	// are not recorded
+	last map[string]time.Time
+
+	up       *prometheus.GaugeVec
+	seen     *prometheus.GaugeVec
+	readings *prometheus.CounterVec
+	rejected *prometheus.CounterVec
+}
+
+func (c *serveCommand) newPushReceiver(reg prometheus.Registerer, m *metrics, rec *recorder) *pushReceiver {
+	factory := promauto.With(reg)
+	return &pushReceiver{
+		rec:        rec,
+		metrics:    m,
+		timeout:    c.PushOriginTimeout,
+		maxSensors: c.PushMaxSensors,
+		lastSeen:   map[string]time.Time{},
+		silent:     map[string]bool{},
+		last:       map[string]time.Time{},
+		up: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: opts.Metrics.Namespace,
+			Name:      metricName(opts.Metrics.Names, "push_origin_up"),
+			Help:      "Whether the origin pushed readings within the origin timeout",
+		}, []string{"origin"}),
+		seen: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: opts.Metrics.Namespace,
+			Name:      metricName(opts.Metrics.Names, "push_origin_last_seen_timestamp_seconds"),
+			Help:      "Unix time of the last push of the origin",
+		}, []string{"origin"}),
+		readings: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: opts.Metrics.Namespace,
+			Name:      metricName(opts.Metrics.Names, "push_readings_total"),
+			Help:      "Number of readings pushed by the origin",
+		}, []string{"origin"}),
+		rejected: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: opts.Metrics.Namespace,
+			Name:      metricName(opts.Metrics.Names, "push_rejected_total"),
+			Help:      "Number of push requests of the origin rejected as invalid or over the pushed sensors limit, origins that were never admitted are counted as other",
+		}, []string{"origin"}),
+	}
+}
+
+// ServeHTTP accepts a single reading or a JSON array of them. The origin is
+// the origin query parameter, the client IP address when not set.
+func (p *pushReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	origin := r.URL.Query().Get("origin")
+	if len(origin) == 0 {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		origin = host
+	}
+	if !pushNamePattern.MatchString(origin) {
+		http.Error(w, "origin must be 1 to 64 letters, digits, _, ., : or -", http.StatusBadRequest)
+		return
+	}
+	readings, err := decodePushedReadings(http.MaxBytesReader(w, r.Body, pushMaxBodySize), time.Now())
+	if err != nil {
+		p.reject(origin)
+		log.Warn("Rejected pushed readings", "origin", origin, "remote", r.RemoteAddr, "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := p.admit(origin, readings); err != nil {
+		p.reject(origin)
+		log.Warn("Rejected pushed readings", "origin", origin, "remote", r.RemoteAddr, "err", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	p.seenOrigin(origin)
+	for _, pushed := range readings {
+		p.record(origin, pushed)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodePushedReadings parses and validates the readings of a push request
+// received at now.
+func decodePushedReadings(body io.Reader, now time.Time) ([]pushedReading, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	var readings []pushedReading
+	if data = bytes.TrimSpace(data); bytes.HasPrefix(data, []byte("[")) {
+		err = json.Unmarshal(data, &readings)
+	} else {
+		readings = make([]pushedReading, 1)
+		err = json.Unmarshal(data, &readings[0])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+	for i, r := range readings {
+		if r.Temperature == nil || r.Humidity == nil {
+			return nil, errors.New("temperature or humidity missing")
+		}
+		if err := validateValues(*r.Temperature, *r.Humidity); err != nil {
+			return nil, fmt.Errorf("reading %d: %v", i+1, err)
+		}
+		if len(r.Sensor) > 0 && !pushNamePattern.MatchString(r.Sensor) {
+			return nil, fmt.Errorf("reading %d: sensor must be 1 to 64 letters, digits, _, ., : or -", i+1)
+		}
+		if r.Time.After(now.Add(pushMaxClockSkew)) {
+			return nil, fmt.Errorf("reading %d: time %s is in the future", i+1, r.Time.Format(time.RFC3339))
+		}
+	}
+	return readings, nil
+}
+
+// sensorName returns the name of the pushed sensor within the exporter.
+func sensorName(origin string, pushed pushedReading) string {
+	name := pushed.Sensor
+	if len(name) == 0 {
+		name = opts.Sensor.Name
+	}
+	return sensorKey(name, origin)
+}
+
+// admit rejects the readings of new origins or sensors once the limit of the
+// pushed sensors is reached.
+func (p *pushReceiver) admit(origin string, readings []pushedReading) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.lastSeen[origin]; !ok && len(p.lastSeen) >= p.maxSensors {
+		return fmt.Errorf("too many push origins, at most %d are accepted", p.maxSensors)
+	}
+	added := map[string]bool{}
+	for _, pushed := range readings {
+		if name := sensorName(origin, pushed); !added[name] {
+			if _, ok := p.last[name]; !ok {
+				added[name] = true
+			}
+		}
+	}
+	if len(p.last)+len(added) > p.maxSensors {
+		return fmt.Errorf("too many pushed sensors, at most %d are accepted", p.maxSensors)
+	}
+	return nil
+}
+
+// reject counts a rejected push of the origin.
+func (p *pushReceiver) reject(origin string) {
+	p.mu.Lock()
+	if _, ok := p.lastSeen[origin]; !ok {
+		origin = pushOtherOrigin
+	}
+	p.mu.Unlock()
+	p.rejected.WithLabelValues(origin).Inc()
+}
+
+// seenOrigin updates the health of the origin.
+func (p *pushReceiver) seenOrigin(origin string) {
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.lastSeen[origin]; !ok {
+		log.Info("New push origin", "origin", origin)
+	} else if p.silent[origin] {
+		log.Info("Push origin is back", "origin", origin)
+	}
+	p.lastSeen[origin] = now
+	delete(p.silent, origin)
+	p.up.WithLabelValues(origin).Set(1)
+	p.seen.WithLabelValues(origin).Set(float64(now.Unix()))
+}
+
+// record records the pushed reading like the readings of the local sensors.
+// Readings not newer than the last recorded one of the sensor, e.g. replayed
+// out of order or twice, are skipped.
+func (p *pushReceiver) record(origin string, pushed pushedReading) {
+	name := sensorName(origin, pushed)
+	r := newReading(name, *pushed.Temperature, *pushed.Humidity, pushed.Retries)
+	r.Location, r.BatteryLevel, r.RSSI = pushed.Location, pushed.BatteryLevel, pushed.RSSI
+	if !pushed.Time.IsZero() {
+		r.Time = pushed.Time
+	}
+	p.readings.WithLabelValues(origin).Inc()
+
+	p.mu.Lock()
+	last, ok := p.last[name]
+	if !ok && len(p.last) >= p.maxSensors {
+		// admitted by a concurrent request
+		p.mu.Unlock()
+		log.Debug("Skipping a reading over the pushed sensors limit", "sensor", name)
+		return
+	}
+	if ok && !r.Time.After(last) {
+		p.mu.Unlock()
+		log.Debug("Skipping an out of order or repeated pushed reading", "sensor", name, "time", r.Time, "last", last)
+		return
+	}
+	p.last[name] = r.Time
+	p.mu.Unlock()
+	if !ok {
+		p.metrics.sensorInfo.WithLabelValues(sensorLabels(name)[0], "", "", "push", pushed.Location, origin).Set(1)
+	}
+	p.rec.record(name, r, nil)
+}
+
+// watchOrigins marks the origins without a push within the timeout as down
+// until the context is cancelled.
+func (p *pushReceiver) watchOrigins(ctx context.Context) {
+	ticker := time.NewTicker(p.timeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			p.mu.Lock()
+			for origin, seen := range p.lastSeen {
+				if p.silent[origin] || now.Sub(seen) < p.timeout {
+					continue
+				}
+				p.silent[origin] = true
+				p.up.WithLabelValues(origin).Set(0)
+				log.Warn("Push origin went silent", "origin", origin, "last_seen", seen)
+			}
+			p.mu.Unlock()
+		}
+	}
+}
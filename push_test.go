@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDecodePushedReadings(t *testing.T) {
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		body    string
+		want    int
+		wantErr string
+	}{
+		{
+			name: "single reading",
+			body: `{"sensor":"attic","temperature":21.5,"humidity":45}`,
+			want: 1,
+		},
+		{
+			name: "array",
+			body: ` [{"sensor":"attic","temperature":21.5,"humidity":45},{"sensor":"cellar","temperature":12,"humidity":80,"time":"2026-10-14T10:00:00Z"}]`,
+			want: 2,
+		},
+		{
+			name: "empty array",
+			body: `[]`,
+			want: 0,
+		},
+		{
+			name:    "invalid JSON",
+			body:    `{"sensor":`,
+			wantErr: "invalid JSON",
+		},
+		{
+			name:    "number out of range",
+			body:    `{"sensor":"attic","temperature":1e400,"humidity":45}`,
+			wantErr: "invalid JSON",
+		},
+		{
+			name:    "missing humidity",
+			body:    `{"sensor":"attic","temperature":21.5}`,
+			wantErr: "temperature or humidity missing",
+		},
+		{
+			name:    "humidity zero",
+			body:    `{"sensor":"attic","temperature":20,"humidity":0}`,
+			wantErr: "reading 1: invalid humidity 0",
+		},
+		{
+			name:    "humidity above 100",
+			body:    `[{"sensor":"attic","temperature":20,"humidity":50},{"sensor":"attic","temperature":20,"humidity":101}]`,
+			wantErr: "reading 2: invalid humidity 101",
+		},
+		{
+			name:    "sensor with a slash",
+			body:    `{"sensor":"a/b","temperature":20,"humidity":50}`,
+			wantErr: "reading 1: sensor must be 1 to 64 letters",
+		},
+		{
+			name:    "sensor with a space",
+			body:    `{"sensor":"living room","temperature":20,"humidity":50}`,
+			wantErr: "reading 1: sensor must be 1 to 64 letters",
+		},
+		{
+			name:    "sensor too long",
+			body:    `{"sensor":"` + strings.Repeat("a", 65) + `","temperature":20,"humidity":50}`,
+			wantErr: "reading 1: sensor must be 1 to 64 letters",
+		},
+		{
+			name: "clock skew",
+			body: `{"sensor":"attic","temperature":20,"humidity":50,"time":"2026-10-14T12:00:30Z"}`,
+			want: 1,
+		},
+		{
+			name:    "time in the future",
+			body:    `{"sensor":"attic","temperature":20,"humidity":50,"time":"2026-10-15T12:00:00Z"}`,
+			wantErr: "reading 1: time 2026-10-15T12:00:00Z is in the future",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			readings, err := decodePushedReadings(strings.NewReader(tt.body), now)
+			if len(tt.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(readings) != tt.want {
+				t.Errorf("decoded %d readings, want %d", len(readings), tt.want)
+			}
+		})
+	}
+}
+
+func TestPushReceiverRecord(t *testing.T) {
+	start := time.Date(2026, 10, 14, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		times []time.Time
+		want  int
+	}{
+		{
+			name:  "in order",
+			times: []time.Time{start, start.Add(time.Minute), start.Add(2 * time.Minute)},
+			want:  3,
+		},
+		{
+			name:  "repeated timestamp",
+			times: []time.Time{start, start, start.Add(time.Minute), start.Add(time.Minute)},
+			want:  2,
+		},
+		{
+			name:  "out of order",
+			times: []time.Time{start.Add(time.Minute), start, start.Add(2 * time.Minute)},
+			want:  2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, exported := newTestRecorder(t, recorderOptions{})
+			c := &serveCommand{PushOriginTimeout: time.Minute, PushMaxSensors: 100}
+			p := c.newPushReceiver(prometheus.NewRegistry(), rec.metrics, rec)
+			temperature, humidity := 20.0, 50.0
+			for _, at := range tt.times {
+				p.record("esp", pushedReading{Sensor: "garage", Temperature: &temperature, Humidity: &humidity, Time: at})
+			}
+			if len(*exported) != tt.want {
+				t.Fatalf("exported %d readings, want %d", len(*exported), tt.want)
+			}
+			for _, r := range *exported {
+				if r.Sensor != "esp/garage" {
+					t.Errorf("sensor = %s, want esp/garage", r.Sensor)
+				}
+			}
+			// the series have the sensor name sent by the origin
+			if got := gaugeValue(t, rec.metrics.temperature.WithLabelValues("garage", "esp")); got != temperature {
+				t.Errorf("temperature of sensor garage of origin esp = %g, want %g", got, temperature)
+			}
+		})
+	}
+}
+
+func TestPushReceiverServeHTTP(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxSensors int
+		// requests are the origins and bodies pushed one after the other
+		requests     [][2]string
+		wantStatus   int
+		want         []string
+		wantRejected float64
+		// rejectedOrigin is the origin label of the rejected requests, the
+		// last origin when empty
+		rejectedOrigin string
+	}{
+		{
+			name:       "sensors of two origins",
+			maxSensors: 10,
+			requests:   [][2]string{{"attic", `{"sensor":"a","temperature":20,"humidity":50}`}, {"cellar", `{"sensor":"a","temperature":12,"humidity":80}`}},
+			wantStatus: http.StatusNoContent,
+			want:       []string{"attic/a", "cellar/a"},
+		},
+		{
+			name:       "invalid origin",
+			maxSensors: 10,
+			requests:   [][2]string{{"a/b", `{"sensor":"a","temperature":20,"humidity":50}`}},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "too many sensors",
+			maxSensors: 2,
+			requests: [][2]string{
+				{"attic", `[{"sensor":"a","temperature":20,"humidity":50},{"sensor":"b","temperature":20,"humidity":50}]`},
+				{"attic", `{"sensor":"c","temperature":20,"humidity":50}`},
+			},
+			wantStatus:   http.StatusForbidden,
+			want:         []string{"attic/a", "attic/b"},
+			wantRejected: 1,
+		},
+		{
+			name:       "known sensors over the limit",
+			maxSensors: 1,
+			requests: [][2]string{
+				{"attic", `{"sensor":"a","temperature":20,"humidity":50}`},
+				{"attic", `{"sensor":"a","temperature":21,"humidity":50}`},
+			},
+			wantStatus: http.StatusNoContent,
+			want:       []string{"attic/a", "attic/a"},
+		},
+		{
+			name:       "too many origins",
+			maxSensors: 1,
+			requests: [][2]string{
+				{"attic", `[]`},
+				{"cellar", `[]`},
+			},
+			wantStatus:     http.StatusForbidden,
+			wantRejected:   1,
+			rejectedOrigin: pushOtherOrigin,
+		},
+		{
+			name:       "invalid push of a new origin",
+			maxSensors: 10,
+			requests: [][2]string{
+				{"attic", `{"sensor":"a","temperature":20,"humidity":50}`},
+				{"cellar", `{"sensor":"a"}`},
+			},
+			wantStatus:     http.StatusBadRequest,
+			want:           []string{"attic/a"},
+			wantRejected:   1,
+			rejectedOrigin: pushOtherOrigin,
+		},
+		{
+			name:       "invalid push of a known origin",
+			maxSensors: 10,
+			requests: [][2]string{
+				{"attic", `{"sensor":"a","temperature":20,"humidity":50}`},
+				{"attic", `{"sensor":"a"}`},
+			},
+			wantStatus:   http.StatusBadRequest,
+			want:         []string{"attic/a"},
+			wantRejected: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, exported := newTestRecorder(t, recorderOptions{})
+			c := &serveCommand{PushOriginTimeout: time.Minute, PushMaxSensors: tt.maxSensors}
+			p := c.newPushReceiver(prometheus.NewRegistry(), rec.metrics, rec)
+			var status int
+			for _, request := range tt.requests {
+				w := httptest.NewRecorder()
+				p.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/push?origin="+request[0], strings.NewReader(request[1])))
+				status = w.Code
+			}
+			if status != tt.wantStatus {
+				t.Errorf("status = %d, want %d", status, tt.wantStatus)
+			}
+			rejectedOrigin := tt.rejectedOrigin
+			if len(rejectedOrigin) == 0 {
+				rejectedOrigin = tt.requests[len(tt.requests)-1][0]
+			}
+			if got := testutil.ToFloat64(p.rejected.WithLabelValues(rejectedOrigin)); got != tt.wantRejected {
+				t.Errorf("rejected = %g, want %g", got, tt.wantRejected)
+			}
+			var got []string
+			for _, r := range *exported {
+				got = append(got, r.Sensor)
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("exported %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPushReceiverRejectedOrigins(t *testing.T) {
+	rec, _ := newTestRecorder(t, recorderOptions{})
+	c := &serveCommand{PushOriginTimeout: time.Minute, PushMaxSensors: 1}
+	p := c.newPushReceiver(prometheus.NewRegistry(), rec.metrics, rec)
+	push := func(origin, body string) {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/push?origin="+origin, strings.NewReader(body)))
+	}
+	push("attic", `{"sensor":"a","temperature":20,"humidity":50}`)
+	push("attic", `{}`)
+	// invalid pushes and pushes over the origins limit of new origins
+	const n = 100
+	for i := 0; i < n; i++ {
+		push(fmt.Sprintf("origin-%d", i), `{}`)
+		push(fmt.Sprintf("cellar-%d", i), `{"sensor":"a","temperature":20,"humidity":50}`)
+	}
+	if got := testutil.CollectAndCount(p.rejected); got != 2 {
+		t.Errorf("got %d rejected series, want attic and %s", got, pushOtherOrigin)
+	}
+	if got := testutil.ToFloat64(p.rejected.WithLabelValues(pushOtherOrigin)); got != 2*n {
+		t.Errorf("got %g rejected pushes of other origins, want %d", got, 2*n)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+type readCommand struct {
+	Output string `short:"o" long:"output" description:"output format, json prints one object per sensor and line; prometheus is the text format, which can't be combined with --metrics-native-histograms" choice:"text" choice:"json" choice:"prometheus" default:"text"`
+}
+
+func (c *readCommand) Execute(_ []string) error {
+	// the text format has no native histograms, they would be left out
+	if c.Output == "prometheus" && opts.Metrics.NativeHistograms {
+		return errors.New("--output prometheus can't be used with --metrics-native-histograms, the text format has no native histograms")
+	}
+	// the driver logs retries to stdout, keep the output parsable
+	quietDriverLogs()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	detectSensorTypes(ctx)
+
+	// the sensors are read one by one, the output keeps the configured order
+	var (
+		readings []*reading
+		readErr  error
+	)
+	for _, s := range sensors {
+		r, err := readSensor(ctx, s)
+		if err != nil {
+			readErr = fmt.Errorf("unable to read sensor %s: %v", s.Name, err)
+			log.Error("DHT sensor read failed", "sensor", s.Name, "err", err)
+			continue
+		}
+		readings = append(readings, r)
+	}
+	if len(readings) == 0 {
+		return readErr
+	}
+
+	switch c.Output {
+	case "json":
+		// one compact object per line, so the output of several sensors can
+		// be parsed line by line
+		encoder := json.NewEncoder(os.Stdout)
+		for _, r := range readings {
+			if err := encoder.Encode(r); err != nil {
+				return err
+			}
+		}
+	case "prometheus":
+		if err := writePrometheusText(readings); err != nil {
+			return err
+		}
+	default:
+		for _, r := range readings {
+			fmt.Printf("%s: %.2f°C, %.2f%%, VPD: %.2f kPa, DP: %.2f°C (retries: %d)\n",
+				r.Sensor, r.Temperature, r.Humidity, r.VaporPressureDeficit, r.DewPoint, r.Retries)
+		}
+	}
+	return readErr
+}
+
+// writePrometheusText prints the readings in the Prometheus text exposition
+// format, e.g. for the node_exporter textfile collector.
+func writePrometheusText(readings []*reading) error {
+	registry := prometheus.NewRegistry()
+	m := newMetrics(prometheus.WrapRegistererWith(opts.Metrics.Labels, registry), opts.Metrics.Namespace, opts.Metrics.Names, opts.Metrics.NativeHistograms)
+	m.setSensorInfo()
+	for _, r := range readings {
+		m.observe(r)
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		return err
+	}
+	encoder := expfmt.NewEncoder(os.Stdout, expfmt.FmtText)
+	for _, family := range families {
+		if err := encoder.Encode(family); err != nil {
+			return err
+		}
+	}
+	return nil
+}
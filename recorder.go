@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// recorder turns the measurements of all sensors into metrics and notifies
+// the observers. It is shared by the polled sensors and the sensors pushing
+// their readings, e.g. over MQTT.
+type recorder struct {
+	recorderOptions
+	metrics   *metrics
+	observers []readingObserver
+	// onStale is called with the sensors whose values expired when set
+	onStale func(sensor string)
+
+	mu sync.Mutex
+	// lastSuccess is the time of the last successful measurement per sensor
+	lastSuccess map[string]time.Time
+	// discarded counts the readings discarded during the warm-up of the polled
+	// sensors, the sensors are removed once warmed up
+	discarded map[string]int
+	// previous is the last reading and streak the number of consecutive
+	// readings identical to it per sensor
+	previous map[string]*reading
+	streak   map[string]int
+	// stale lists the sensors whose values are not exported
+	stale   map[string]bool
+	started time.Time
+}
+
+// recorderOptions configure how the readings are recorded.
+type recorderOptions struct {
+	// warmupReadings and warmupPeriod configure the warm-up of the polled
+	// sensors
+	warmupReadings int
+	warmupPeriod   time.Duration
+	// identicalLimit is the streak of identical readings after which the
+	// readings are flagged or, with suppressIdentical, not exported
+	identicalLimit    int
+	suppressIdentical bool
+	// maxAge is the age of the last successful reading after which the values
+	// of the sensor are not exported
+	maxAge time.Duration
+}
+
+func newRecorder(m *metrics, observers []readingObserver, o recorderOptions) *recorder {
+	rec := &recorder{
+		recorderOptions: o,
+		metrics:         m,
+		observers:       observers,
+		lastSuccess:     map[string]time.Time{},
+		discarded:       map[string]int{},
+		previous:        map[string]*reading{},
+		streak:          map[string]int{},
+		stale:           map[string]bool{},
+		started:         time.Now(),
+	}
+	if o.maxAge > 0 {
+		for _, s := range sensors {
+			m.measurementStale.WithLabelValues(sensorLabels(s.Name)...).Set(0)
+		}
+	}
+	if o.warmupReadings > 0 || o.warmupPeriod > 0 {
+		for _, s := range sensors {
+			rec.discarded[s.Name] = 0
+		}
+	}
+	return rec
+}
+
+// warmingUp reports whether the reading of the sensor is discarded because the
+// sensor is still warming up. Both the number of readings and the period must
+// pass.
+func (rec *recorder) warmingUp(sensor string) bool {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	discarded, ok := rec.discarded[sensor]
+	if !ok {
+		return false
+	}
+	if discarded >= rec.warmupReadings && time.Since(rec.started) >= rec.warmupPeriod {
+		delete(rec.discarded, sensor)
+		log.Info("Sensor warmed up", "sensor", sensor, "discarded", discarded)
+		return false
+	}
+	rec.discarded[sensor]++
+	return true
+}
+
+// identicalStreak updates and returns the number of consecutive readings of
+// the sensor identical to the previous one.
+func (rec *recorder) identicalStreak(r *reading) int {
+	rec.mu.Lock()
+	previous, ok := rec.previous[r.Sensor]
+	if ok && previous.Temperature == r.Temperature && previous.Humidity == r.Humidity {
+		rec.streak[r.Sensor]++
+	} else {
+		rec.streak[r.Sensor] = 0
+	}
+	rec.previous[r.Sensor] = r
+	streak := rec.streak[r.Sensor]
+	rec.mu.Unlock()
+	rec.metrics.identicalReadingsStreak.WithLabelValues(sensorLabels(r.Sensor)...).Set(float64(streak))
+	return streak
+}
+
+// ready reports whether all polled sensors are warmed up and were read
+// successfully, otherwise it returns the sensors that are not ready.
+func (rec *recorder) ready() (bool, []string) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	var waiting []string
+	for _, s := range sensors {
+		_, warmingUp := rec.discarded[s.Name]
+		if _, ok := rec.lastSuccess[s.Name]; warmingUp || !ok {
+			waiting = append(waiting, s.Name)
+		}
+	}
+	return len(waiting) == 0, waiting
+}
+
+// isStale reports whether the values of the sensor expired and are not
+// exported.
+func (rec *recorder) isStale(sensor string) bool {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.stale[sensor]
+}
+
+// expireStale periodically stops exporting the values of the sensors without
+// a successful reading within the max age until the context is cancelled. The
+// polled sensors that were never read count from the start.
+func (rec *recorder) expireStale(ctx context.Context) {
+	ticker := time.NewTicker(rec.maxAge / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			var expired []string
+			rec.mu.Lock()
+			last := map[string]time.Time{}
+			for _, s := range sensors {
+				last[s.Name] = rec.started
+			}
+			for sensor, t := range rec.lastSuccess {
+				last[sensor] = t
+			}
+			for sensor, t := range last {
+				if rec.stale[sensor] || now.Sub(t) < rec.maxAge {
+					continue
+				}
+				rec.stale[sensor] = true
+				log.Warn("Sensor values are stale, not exporting them", "sensor", sensor, "last_success", t)
+				rec.metrics.deleteValues(sensor)
+				rec.metrics.measurementStale.WithLabelValues(sensorLabels(sensor)...).Set(1)
+				expired = append(expired, sensor)
+			}
+			rec.mu.Unlock()
+			if rec.onStale != nil {
+				for _, sensor := range expired {
+					rec.onStale(sensor)
+				}
+			}
+		}
+	}
+}
+
+// readSensor reads the polled sensor, counting the errors of all attempts by
+// their type.
+func (rec *recorder) readSensor(ctx context.Context, s *sensorConfig) (*reading, error) {
+	return readSensorAttempts(ctx, s, func(err error) {
+		rec.metrics.readErrors.WithLabelValues(sensorLabels(s.Name, classifyError(err))...).Inc()
+	})
+}
+
+// record handles the result of a single measurement of the sensor.
+func (rec *recorder) record(sensor string, r *reading, err error) {
+	if err != nil {
+		log.Error("DHT sensor read failed", "sensor", sensor, "err", err)
+		rec.metrics.readFailures.WithLabelValues(sensorLabels(sensor, classifyError(err))...).Inc()
+		for _, observe := range rec.observers {
+			observe(sensor, nil, err)
+		}
+		return
+	}
+	if rec.warmingUp(sensor) {
+		log.Info("Discarding warm-up reading", "sensor", sensor, "temperature", r.Temperature, "humidity", r.Humidity)
+		return
+	}
+	if streak := rec.identicalStreak(r); rec.identicalLimit > 0 && streak >= rec.identicalLimit {
+		if streak == rec.identicalLimit {
+			log.Warn("Sensor keeps returning identical readings, it may return cached values", "sensor", sensor, "streak", streak)
+		}
+		if rec.suppressIdentical {
+			log.Info("Suppressing identical reading", "sensor", sensor, "streak", streak)
+			return
+		}
+	}
+	log.Info("DHT sensor measurement",
+		"sensor", r.Sensor,
+		"temperature", r.Temperature,
+		"humidity", r.Humidity,
+		"vpd", r.VaporPressureDeficit,
+		"dew_point", r.DewPoint,
+		"retries", r.Retries,
+		"duration", r.Duration,
+	)
+
+	// record amount of seconds since the last successful measurement
+	rec.mu.Lock()
+	last, ok := rec.lastSuccess[sensor]
+	if !ok {
+		last = rec.started
+	}
+	rec.lastSuccess[sensor] = time.Now()
+	// the values are exported in the same critical section, so they can't be
+	// deleted right after by a concurrent expiry
+	wasStale := rec.stale[sensor]
+	delete(rec.stale, sensor)
+	rec.metrics.lastSuccessfulMeasurementSeconds.WithLabelValues(sensorLabels(r.Sensor)...).Set(float64(time.Now().Unix() - last.Unix()))
+	rec.metrics.observe(r)
+	if rec.maxAge > 0 {
+		rec.metrics.measurementStale.WithLabelValues(sensorLabels(r.Sensor)...).Set(0)
+	}
+	rec.mu.Unlock()
+	if wasStale {
+		log.Info("Sensor values are fresh again", "sensor", sensor)
+	}
+	for _, observe := range rec.observers {
+		observe(r.Sensor, r, nil)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var errTestRead = errors.New("Can't decode pulse array received from DHTxx sensor, since incorrect length: 3")
+
+func gaugeValue(t *testing.T, g prometheus.Gauge) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := g.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetGauge().GetValue()
+}
+
+// newTestRecorder returns a recorder of the polled sensor attic and the list
+// of the readings it exported.
+func newTestRecorder(t *testing.T, o recorderOptions) (*recorder, *[]*reading) {
+	t.Helper()
+	previous := sensors
+	sensors = []*sensorConfig{{Name: "attic"}}
+	t.Cleanup(func() { sensors = previous })
+	var exported []*reading
+	observe := func(_ string, r *reading, err error) {
+		if err == nil {
+			exported = append(exported, r)
+		}
+	}
+	return newRecorder(newMetrics(prometheus.NewRegistry(), "dht", nil, false), []readingObserver{observe}, o), &exported
+}
+
+func TestRecorderWarmup(t *testing.T) {
+	tests := []struct {
+		name    string
+		options recorderOptions
+		sensor  string
+		// failures are recorded before the readings
+		failures int
+		readings int
+		want     int
+	}{
+		{name: "no warm-up", readings: 3, want: 3},
+		{name: "warm-up readings", options: recorderOptions{warmupReadings: 2}, readings: 5, want: 3},
+		{name: "failed reads don't count", options: recorderOptions{warmupReadings: 2}, failures: 3, readings: 3, want: 1},
+		{name: "warm-up period not over", options: recorderOptions{warmupPeriod: time.Hour}, readings: 3, want: 0},
+		{name: "warm-up readings and period", options: recorderOptions{warmupReadings: 1, warmupPeriod: time.Hour}, readings: 3, want: 0},
+		{name: "pushed sensors don't warm up", options: recorderOptions{warmupReadings: 2}, sensor: "esp/garage", readings: 3, want: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, exported := newTestRecorder(t, tt.options)
+			sensor := tt.sensor
+			if len(sensor) == 0 {
+				sensor = "attic"
+			}
+			for i := 0; i < tt.failures; i++ {
+				rec.record(sensor, nil, errTestRead)
+			}
+			for i := 0; i < tt.readings; i++ {
+				rec.record(sensor, newReading(sensor, 20+float64(i), 50, 0), nil)
+			}
+			if len(*exported) != tt.want {
+				t.Errorf("exported %d readings, want %d", len(*exported), tt.want)
+			}
+			ready, _ := rec.ready()
+			if wantReady := tt.sensor == "" && tt.want > 0; ready != wantReady {
+				t.Errorf("ready = %v, want %v", ready, wantReady)
+			}
+		})
+	}
+}
+
+func TestRecorderIdenticalReadings(t *testing.T) {
+	type values struct{ temperature, humidity float64 }
+	tests := []struct {
+		name       string
+		options    recorderOptions
+		readings   []values
+		want       int
+		wantStreak float64
+	}{
+		{
+			name:       "changing readings",
+			readings:   []values{{20, 50}, {20.1, 50}, {20.1, 50.2}},
+			want:       3,
+			wantStreak: 0,
+		},
+		{
+			name:       "streak without a limit",
+			readings:   []values{{20, 50}, {20, 50}, {20, 50}},
+			want:       3,
+			wantStreak: 2,
+		},
+		{
+			name:       "flagged streak",
+			options:    recorderOptions{identicalLimit: 2},
+			readings:   []values{{20, 50}, {20, 50}, {20, 50}, {20, 50}},
+			want:       4,
+			wantStreak: 3,
+		},
+		{
+			name:       "suppressed streak",
+			options:    recorderOptions{identicalLimit: 2, suppressIdentical: true},
+			readings:   []values{{20, 50}, {20, 50}, {20, 50}, {20, 50}},
+			want:       2,
+			wantStreak: 3,
+		},
+		{
+			name:       "streak broken by a new value",
+			options:    recorderOptions{identicalLimit: 2, suppressIdentical: true},
+			readings:   []values{{20, 50}, {20, 50}, {20, 50}, {21, 50}, {21, 50}},
+			want:       4,
+			wantStreak: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, exported := newTestRecorder(t, tt.options)
+			for _, v := range tt.readings {
+				rec.record("attic", newReading("attic", v.temperature, v.humidity, 0), nil)
+			}
+			if len(*exported) != tt.want {
+				t.Errorf("exported %d readings, want %d", len(*exported), tt.want)
+			}
+			if got := gaugeValue(t, rec.metrics.identicalReadingsStreak.WithLabelValues("attic", "")); got != tt.wantStreak {
+				t.Errorf("identical_readings_streak = %g, want %g", got, tt.wantStreak)
+			}
+		})
+	}
+}
+
+func TestRecorderExpireStale(t *testing.T) {
+	rec, _ := newTestRecorder(t, recorderOptions{maxAge: 40 * time.Millisecond})
+	expired := make(chan string, 2)
+	rec.onStale = func(sensor string) { expired <- sensor }
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		rec.expireStale(ctx)
+	}()
+	// the sensors are restored once the expiry stopped
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	rec.record("attic", newReading("attic", 21.5, 45, 0), nil)
+	select {
+	case sensor := <-expired:
+		if sensor != "attic" {
+			t.Errorf("got stale sensor %s, want attic", sensor)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the sensor didn't expire")
+	}
+	if !rec.isStale("attic") {
+		t.Error("the expired sensor is not stale")
+	}
+	if got := gaugeValue(t, rec.metrics.measurementStale.WithLabelValues("attic", "")); got != 1 {
+		t.Errorf("measurement_stale = %g, want 1", got)
+	}
+	// a sensor is only expired once
+	select {
+	case sensor := <-expired:
+		t.Errorf("sensor %s expired again", sensor)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
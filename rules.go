@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+type rulesCommand struct {
+	Job       string        `long:"job" description:"Prometheus job name scraping the exporter" default:"dht"`
+	StaleFor  time.Duration `long:"stale-for" description:"alert when the sensor values did not change for this long" default:"30m"`
+	Retries   uint          `long:"retries" description:"alert when a measurement needed at least this many retries" default:"3"`
+	AlertsFor time.Duration `long:"for" description:"how long a condition must hold before the alert fires" default:"5m"`
+}
+
+var rulesTemplate = template.Must(template.New("rules").Parse(`groups:
+  - name: dht
+    rules:
+      - alert: DHTExporterDown
+        expr: up{job="{{ .Job }}"} == 0
+        for: {{ .For }}
+        labels:
+          severity: critical
+        annotations:
+          summary: DHT exporter {{ "{{ $labels.instance }}" }} is down
+      - alert: DHTSensorMissing
+        expr: absent({{ .SensorInfo }}{job="{{ .Job }}"})
+        for: {{ .For }}
+        labels:
+          severity: critical
+        annotations:
+          summary: No DHT sensor is reported by job {{ .Job }}
+      - alert: DHTSensorStuck
+        expr: changes({{ .Temperature }}{job="{{ .Job }}"}[{{ .StaleFor }}]) == 0 and changes({{ .Humidity }}{job="{{ .Job }}"}[{{ .StaleFor }}]) == 0
+        for: {{ .For }}
+        labels:
+          severity: warning
+        annotations:
+          summary: DHT sensor {{ "{{ $labels.sensor }}" }} on {{ "{{ $labels.instance }}" }} reported the same values for {{ .StaleFor }}
+      - alert: DHTSensorRetries
+        expr: {{ .Retries }}{job="{{ .Job }}"} >= {{ .MinRetries }}
+        for: {{ .For }}
+        labels:
+          severity: warning
+        annotations:
+          summary: DHT sensor {{ "{{ $labels.sensor }}" }} on {{ "{{ $labels.instance }}" }} needs {{ "{{ $value }}" }} retries per measurement
+`))
+
+// rulesJobPattern matches the job names that can be used as is in the YAML
+// and in the PromQL string literals of the rules.
+var rulesJobPattern = regexp.MustCompile(`^[a-zA-Z0-9_.:/-]+$`)
+
+func (c *rulesCommand) Execute(_ []string) error {
+	if !rulesJobPattern.MatchString(c.Job) {
+		return fmt.Errorf("invalid --job %q, only letters, digits and _.:/- are supported", c.Job)
+	}
+	return rulesTemplate.Execute(os.Stdout, map[string]interface{}{
+		"Job":         c.Job,
+		"For":         model.Duration(c.AlertsFor).String(),
+		"StaleFor":    model.Duration(c.StaleFor).String(),
+		"MinRetries":  c.Retries,
+		"SensorInfo":  fullMetricName("sensor_info"),
+		"Temperature": fullMetricName("last_temperature"),
+		"Humidity":    fullMetricName("last_humidity"),
+		"Retries":     fullMetricName("last_measurement_retries"),
+	})
+}
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/d2r2/go-dht"
+)
+
+// reading is a single successful sensor measurement including the derived
+// values.
+type reading struct {
+	Sensor               string    `json:"sensor"`
+	Temperature          float64   `json:"temperature"`
+	Humidity             float64   `json:"humidity"`
+	VaporPressureDeficit float64   `json:"vapor_pressure_deficit"`
+	DewPoint             float64   `json:"dew_point"`
+	Retries              int       `json:"retries"`
+	Time                 time.Time `json:"time"`
+	// Location is the location of the sensor, if configured.
+	Location string `json:"location,omitempty"`
+	// BatteryLevel and RSSI are only reported by wireless sensors.
+	BatteryLevel *float64 `json:"battery_level,omitempty"`
+	RSSI         *float64 `json:"rssi,omitempty"`
+	// Duration is how long the measurement took, including retries.
+	Duration time.Duration `json:"-"`
+}
+
+func newReading(sensor string, temperature, humidity float64, retries int) *reading {
+	return &reading{
+		Sensor:               sensor,
+		Temperature:          temperature,
+		Humidity:             humidity,
+		VaporPressureDeficit: vaporPressureDeficit(temperature, humidity),
+		DewPoint:             dewPoint(temperature, humidity),
+		Retries:              retries,
+		Time:                 time.Now(),
+	}
+}
+
+// validateValues rejects values that can't be a measurement. A humidity of 0
+// is what a failed DHT read looks like and has no dew point.
+func validateValues(temperature, humidity float64) error {
+	if math.IsNaN(temperature) || math.IsInf(temperature, 0) {
+		return fmt.Errorf("invalid temperature %g", temperature)
+	}
+	if math.IsNaN(humidity) || math.IsInf(humidity, 0) || humidity <= 0 || humidity > 100 {
+		return fmt.Errorf("invalid humidity %g", humidity)
+	}
+	return nil
+}
+
+// defaultSensorBus is the bus of sensors that don't configure one. All DHT
+// sensors are bit-banged by the CPU, reading two of them at once breaks the
+// timing of both.
+const defaultSensorBus = "gpio"
+
+// sensorConfig is a single configured sensor.
+type sensorConfig struct {
+	Name string
+	// Type, PIN and Detect are only used by the DHT driver.
+	Type       dht.SensorType
+	PIN        int
+	Detect     bool
+	MaxRetries int
+	Location   string
+	// Interval overrides the serve --interval for this sensor when set.
+	Interval time.Duration
+	// Bus names the resource shared with other sensors. Sensors on the same
+	// bus are never read at the same time.
+	Bus    string
+	Driver sensorDriver
+	// TemperatureCalibration and HumidityCalibration correct the measured
+	// values when set.
+	TemperatureCalibration *calibration
+	HumidityCalibration    *calibration
+	// PowerPIN is the GPIO pin powering the sensor, serve power cycles the
+	// sensor through it after consecutive failed measurements when set.
+	PowerPIN string
+
+	// lastRead is when the last read attempt finished, guarded by the bus
+	// lock.
+	lastRead time.Time
+}
+
+// sensorDriver reads the values of a polled sensor.
+type sensorDriver interface {
+	// read performs a single read attempt.
+	read() (temperature, humidity float64, err error)
+	// retryDelay is how long to wait before the next attempt.
+	retryDelay() time.Duration
+	// info returns the model, pin and driver labels of the sensor info metric.
+	info() (model, pin, driver string)
+}
+
+// dhtDriver reads a DHT sensor bit-banged over a GPIO pin.
+type dhtDriver struct {
+	sensorType dht.SensorType
+	pin        int
+}
+
+func (d *dhtDriver) read() (temperature, humidity float64, err error) {
+	err = withLockedMemory(opts.Sensor.LockMemory, func() error {
+		t, h, err := dht.ReadDHTxx(d.sensorType, d.pin, opts.Sensor.BoostPerformance)
+		temperature, humidity = float64(t), float64(h)
+		return err
+	})
+	return temperature, humidity, err
+}
+
+func (d *dhtDriver) retryDelay() time.Duration {
+	return d.sensorType.GetRetryTimeout()
+}
+
+func (d *dhtDriver) info() (model, pin, driver string) {
+	return sensorModel(d.sensorType), strconv.Itoa(d.pin), "go-dht"
+}
+
+// sensors lists the configured sensors, set by validateOptions.
+var sensors []*sensorConfig
+
+// sensorSpec is the value of a --sensor option, a comma separated list of
+// key=value pairs, e.g. name=attic,pin=17.
+type sensorSpec struct {
+	raw    string
+	values map[string]string
+}
+
+// sensorSpecKeys lists the keys supported in a --sensor value.
+var sensorSpecKeys = append(append([]string{"name", "driver", "type", "pin", "max-retries", "location", "interval", "bus", "power-pin"}, modbusSpecKeys...), simulateSpecKeys...)
+
+// driverSpecKeys lists the --sensor keys that are only supported by a driver.
+var driverSpecKeys = map[string][]string{
+	"modbus":   modbusSpecKeys,
+	"simulate": simulateSpecKeys,
+}
+
+func (s *sensorSpec) UnmarshalFlag(value string) error {
+	values, err := parseSpec(value, sensorSpecKeys)
+	if err != nil {
+		return err
+	}
+	s.raw, s.values = value, values
+	return nil
+}
+
+func (s sensorSpec) MarshalFlag() (string, error) {
+	return s.raw, nil
+}
+
+// parseSpec parses a comma separated list of key=value pairs, all keys must be
+// listed in keys.
+func parseSpec(value string, keys []string) (map[string]string, error) {
+	values := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		key, val, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected key=value, got %q", pair)
+		}
+		key = strings.TrimSpace(key)
+		known := false
+		for _, k := range keys {
+			known = known || k == key
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown key %q, supported: %s", key, strings.Join(keys, ", "))
+		}
+		values[key] = strings.TrimSpace(val)
+	}
+	return values, nil
+}
+
+// configureSensors builds the sensor list from the --sensor options. Keys that
+// are not set in a --sensor value default to the --sensor-* options. Without
+// any --sensor option the --sensor-* options configure a single sensor.
+func configureSensors(o sensorOptions) ([]*sensorConfig, error) {
+	specs := o.Sensors
+	if len(specs) == 0 {
+		specs = []sensorSpec{{values: map[string]string{}}}
+	}
+	var result []*sensorConfig
+	names := map[string]bool{}
+	for _, spec := range specs {
+		s := &sensorConfig{
+			Name:       o.Name,
+			PIN:        int(o.PIN),
+			MaxRetries: int(o.MaxRetries),
+			Location:   o.Location,
+			Detect:     o.Detect,
+			Bus:        defaultSensorBus,
+			PowerPIN:   o.PowerPIN,
+		}
+		sensorType := o.Type
+		if value, ok := spec.values["type"]; ok {
+			sensorType = value
+		}
+		for key, value := range spec.values {
+			var err error
+			switch key {
+			case "name":
+				s.Name = value
+			case "pin":
+				s.PIN, err = strconv.Atoi(value)
+			case "max-retries":
+				s.MaxRetries, err = strconv.Atoi(value)
+			case "location":
+				s.Location = value
+			case "interval":
+				s.Interval, err = time.ParseDuration(value)
+			case "bus":
+				s.Bus = value
+			case "power-pin":
+				s.PowerPIN = value
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s in --sensor %q: %v", key, spec.raw, err)
+			}
+		}
+		for driver, keys := range driverSpecKeys {
+			if driver == spec.values["driver"] {
+				continue
+			}
+			for _, key := range keys {
+				if _, ok := spec.values[key]; ok {
+					return nil, fmt.Errorf("%s in --sensor %q is only supported by the %s driver", key, spec.raw, driver)
+				}
+			}
+		}
+		switch spec.values["driver"] {
+		case "", "dht":
+			t, detect, err := parseSensorType(sensorType)
+			if err != nil {
+				return nil, fmt.Errorf("invalid type of sensor %s: %v", s.Name, err)
+			}
+			s.Type, s.Detect = t, s.Detect || detect
+			s.Driver = &dhtDriver{sensorType: s.Type, pin: s.PIN}
+		case "modbus":
+			driver, err := newModbusDriver(spec.values)
+			if err != nil {
+				return nil, fmt.Errorf("invalid --sensor %q: %v", spec.raw, err)
+			}
+			if _, ok := spec.values["bus"]; !ok {
+				// a serial line or a TCP gateway handles one request at a time
+				s.Bus = "modbus:" + driver.address
+			}
+			s.Driver = driver
+		case "simulate":
+			driver, err := newSimulateDriver(spec.values)
+			if err != nil {
+				return nil, fmt.Errorf("invalid --sensor %q: %v", spec.raw, err)
+			}
+			if _, ok := spec.values["bus"]; !ok {
+				s.Bus = "simulate:" + s.Name
+			}
+			s.Driver = driver
+		default:
+			return nil, fmt.Errorf("unsupported driver %q in --sensor %q, supported: dht, modbus, simulate", spec.values["driver"], spec.raw)
+		}
+		if len(s.Name) == 0 {
+			return nil, errors.New("sensor name must not be empty")
+		}
+		if strings.Contains(s.Name, "/") {
+			return nil, fmt.Errorf("sensor name %s must not contain /, it separates the origin of pushed sensors", s.Name)
+		}
+		if names[s.Name] {
+			return nil, fmt.Errorf("duplicate sensor name %s, every --sensor needs a unique name", s.Name)
+		}
+		names[s.Name] = true
+		if s.PIN < 0 || s.MaxRetries < 0 || s.Interval < 0 {
+			return nil, fmt.Errorf("pin, max-retries and interval of sensor %s must not be negative", s.Name)
+		}
+		result = append(result, s)
+	}
+	return result, nil
+}
+
+// sensorNames returns the names of the configured sensors.
+func sensorNames() []string {
+	var names []string
+	for _, s := range sensors {
+		names = append(names, s.Name)
+	}
+	return names
+}
+
+// sensorByName returns the configured sensor with the name, nil when there isn't
+// one.
+func sensorByName(name string) *sensorConfig {
+	for _, s := range sensors {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// sensorLocations returns the distinct locations of the configured sensors.
+func sensorLocations() []string {
+	var locations []string
+	seen := map[string]bool{}
+	for _, s := range sensors {
+		if len(s.Location) > 0 && !seen[s.Location] {
+			seen[s.Location] = true
+			locations = append(locations, s.Location)
+		}
+	}
+	return locations
+}
+
+var (
+	busLocksMu sync.Mutex
+	busLocks   = map[string]*sync.Mutex{}
+)
+
+// busLock returns the lock serializing the access to the bus.
+func busLock(bus string) *sync.Mutex {
+	busLocksMu.Lock()
+	defer busLocksMu.Unlock()
+	l, ok := busLocks[bus]
+	if !ok {
+		l = &sync.Mutex{}
+		busLocks[bus] = l
+	}
+	return l
+}
+
+// readSensor performs a single measurement of the sensor, retrying up to its
+// max retries times. The bus is only locked for the duration of a single
+// attempt, so sensors sharing it are not delayed by the wait between retries.
+// Cancelling the context stops the retries, an attempt that is already in
+// progress is always finished.
+func readSensor(ctx context.Context, s *sensorConfig) (*reading, error) {
+	return readSensorAttempts(ctx, s, nil)
+}
+
+// readSensorAttempts reads the sensor like readSensor, calling attemptFailed
+// with the error of every failed attempt when set.
+func readSensorAttempts(ctx context.Context, s *sensorConfig, attemptFailed func(err error)) (*reading, error) {
+	log.Debug("Reading sensor", "sensor", s.Name)
+	start := time.Now()
+	for retried := 0; ; retried++ {
+		temperature, humidity, err := readSensorOnce(s)
+		if err == nil {
+			// an offset can push the humidity above 100 %, which is capped, or
+			// to 0 or below, which fails like a read without a value
+			temperature = s.TemperatureCalibration.apply(temperature)
+			humidity = math.Min(100, s.HumidityCalibration.apply(humidity))
+			if verr := validateValues(temperature, humidity); verr != nil {
+				err = fmt.Errorf("calibrated reading: %v", verr)
+			}
+		}
+		if err != nil && attemptFailed != nil {
+			attemptFailed(err)
+		}
+		if err == nil {
+			r := newReading(s.Name, temperature, humidity, retried)
+			r.Location = s.Location
+			r.Duration = time.Since(start)
+			return r, nil
+		}
+		if retried >= s.MaxRetries || !isRetried(err) {
+			return nil, err
+		}
+		log.Debug("Sensor read attempt failed", "sensor", s.Name, "attempt", retried+1, "err", err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(retryDelay(s)):
+		}
+	}
+}
+
+// isRetried reports whether the type of the read error is listed in
+// --sensor-retry-on.
+func isRetried(err error) bool {
+	errorType := classifyError(err)
+	for _, t := range opts.Sensor.RetryOn {
+		if t == errorType {
+			return true
+		}
+	}
+	return false
+}
+
+// retryDelay returns the delay before the next attempt to read the sensor,
+// including the random jitter.
+func retryDelay(s *sensorConfig) time.Duration {
+	delay := minReadInterval(s)
+	if opts.Sensor.RetryJitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(opts.Sensor.RetryJitter)))
+	}
+	return delay
+}
+
+// minReadInterval returns the time the sensor needs between two reads.
+func minReadInterval(s *sensorConfig) time.Duration {
+	if opts.Sensor.RetryDelay > 0 {
+		return opts.Sensor.RetryDelay
+	}
+	return s.Driver.retryDelay()
+}
+
+// readSensorOnce performs a single read attempt with the bus locked. Reads
+// coming too soon after the previous one, e.g. an on demand read right after
+// the scheduled one, wait with the bus unlocked until the sensor is ready.
+func readSensorOnce(s *sensorConfig) (temperature, humidity float64, err error) {
+	lock := busLock(s.Bus)
+	for {
+		lock.Lock()
+		wait := minReadInterval(s) - time.Since(s.lastRead)
+		if wait <= 0 {
+			break
+		}
+		lock.Unlock()
+		time.Sleep(wait)
+	}
+	defer lock.Unlock()
+	defer func() { s.lastRead = time.Now() }()
+	return s.Driver.read()
+}
+
+// memoryLocked is set when the process memory was locked for the whole process
+// lifetime, e.g. before dropping privileges.
+var memoryLocked bool
+
+var (
+	memoryLockMu    sync.Mutex
+	memoryLockCount int
+)
+
+// withLockedMemory runs fn with the process memory locked when lock is true.
+// Failing to lock the memory is logged, but doesn't prevent the read. The lock
+// is shared by concurrent reads and released when the last of them finishes.
+func withLockedMemory(lock bool, fn func() error) error {
+	if !lock || memoryLocked {
+		return fn()
+	}
+	memoryLockMu.Lock()
+	if memoryLockCount == 0 {
+		if err := lockMemory(); err != nil {
+			memoryLockMu.Unlock()
+			log.Warn("Unable to lock memory", "err", err)
+			return fn()
+		}
+	}
+	memoryLockCount++
+	memoryLockMu.Unlock()
+	defer func() {
+		memoryLockMu.Lock()
+		defer memoryLockMu.Unlock()
+		memoryLockCount--
+		if memoryLockCount > 0 {
+			return
+		}
+		if err := unlockMemory(); err != nil {
+			log.Warn("Unable to unlock memory", "err", err)
+		}
+	}()
+	return fn()
+}
+
+// sensorTypeNames maps the accepted --sensor-type names to the DHT sensor
+// types. The AM2302 is the wired DHT22.
+var sensorTypeNames = map[string]dht.SensorType{
+	"dht11":  dht.DHT11,
+	"dht12":  dht.DHT12,
+	"dht22":  dht.DHT22,
+	"am2302": dht.AM2302,
+}
+
+// parseSensorType parses a sensor type name or the numeric type of the
+// previous versions. The auto type reports detection with DHT22 as the type
+// used when the detection fails.
+func parseSensorType(value string) (sensorType dht.SensorType, detect bool, err error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "auto" {
+		return dht.DHT22, true, nil
+	}
+	if t, ok := sensorTypeNames[value]; ok {
+		return t, false, nil
+	}
+	if n, err := strconv.Atoi(value); err == nil {
+		switch t := dht.SensorType(n); t {
+		case dht.DHT11, dht.DHT12, dht.DHT22:
+			return t, false, nil
+		}
+	}
+	return 0, false, fmt.Errorf("unsupported sensor type %q, supported: dht11, dht12, dht22, am2302, auto", value)
+}
+
+// sensorModel returns the model name of the configured DHT sensor type.
+func sensorModel(sensorType dht.SensorType) string {
+	switch sensorType {
+	case dht.DHT11:
+		return "DHT11"
+	case dht.DHT12:
+		return "DHT12"
+	case dht.DHT22:
+		return "DHT22"
+	default:
+		return "unknown"
+	}
+}
+
+func vaporPressureDeficit(temperature, humidity float64) float64 {
+	es := 0.6108 * math.Exp(17.27*temperature/(temperature+237.3))
+	ea := humidity / 100 * es
+	// this equation returns a negative value (in kPa), which while technically correct,
+	// is invalid in this case because we are talking about a deficit.
+	return (ea - es) * -1
+}
+
+func dewPoint(temperature, humidity float64) float64 {
+	// Constants for the dew point calculation
+	a := 17.27
+	b := 237.7
+
+	// Calculate intermediate values
+	alpha := ((a * temperature) / (b + temperature)) + math.Log(humidity/100.0)
+	dewPoint := (b * alpha) / (a - alpha)
+
+	return dewPoint
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/d2r2/go-dht"
+)
+
+func TestParseSpec(t *testing.T) {
+	keys := []string{"name", "pin", "location"}
+	tests := []struct {
+		name    string
+		value   string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name:  "single key",
+			value: "name=attic",
+			want:  map[string]string{"name": "attic"},
+		},
+		{
+			name:  "spaces around keys and values",
+			value: "name = attic , pin= 17",
+			want:  map[string]string{"name": "attic", "pin": "17"},
+		},
+		{
+			name:  "empty value",
+			value: "name=attic,location=",
+			want:  map[string]string{"name": "attic", "location": ""},
+		},
+		{
+			name:  "value with an equals sign",
+			value: "location=a=b",
+			want:  map[string]string{"location": "a=b"},
+		},
+		{
+			name:  "last value wins",
+			value: "pin=4,pin=17",
+			want:  map[string]string{"pin": "17"},
+		},
+		{
+			name:    "missing value",
+			value:   "name=attic,pin",
+			wantErr: `expected key=value, got "pin"`,
+		},
+		{
+			name:    "unknown key",
+			value:   "name=attic,type=dht22",
+			wantErr: `unknown key "type"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSpec(tt.value, keys)
+			if len(tt.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("parseSpec = %v, want %v", got, tt.want)
+			}
+			for key, value := range tt.want {
+				if got[key] != value {
+					t.Errorf("%s = %q, want %q", key, got[key], value)
+				}
+			}
+		})
+	}
+}
+
+func TestParseSensorType(t *testing.T) {
+	tests := []struct {
+		value      string
+		want       dht.SensorType
+		wantDetect bool
+		wantErr    bool
+	}{
+		{value: "dht11", want: dht.DHT11},
+		{value: "dht12", want: dht.DHT12},
+		{value: "dht22", want: dht.DHT22},
+		{value: "am2302", want: dht.DHT22},
+		{value: " DHT22 ", want: dht.DHT22},
+		{value: "auto", want: dht.DHT22, wantDetect: true},
+		{value: "1", want: dht.DHT11},
+		{value: "3", want: dht.DHT22},
+		{value: "0", wantErr: true},
+		{value: "4", wantErr: true},
+		{value: "dht21", wantErr: true},
+		{value: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, detect, err := parseSensorType(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseSensorType = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want || detect != tt.wantDetect {
+				t.Errorf("parseSensorType = %v, %v, want %v, %v", got, detect, tt.want, tt.wantDetect)
+			}
+		})
+	}
+}
+
+func TestValidateValues(t *testing.T) {
+	tests := []struct {
+		name        string
+		temperature float64
+		humidity    float64
+		wantErr     bool
+	}{
+		{name: "valid", temperature: 21.5, humidity: 45},
+		{name: "below zero", temperature: -20, humidity: 100},
+		{name: "humidity zero", temperature: 20, humidity: 0, wantErr: true},
+		{name: "negative humidity", temperature: 20, humidity: -1, wantErr: true},
+		{name: "humidity above 100", temperature: 20, humidity: 100.1, wantErr: true},
+		{name: "NaN temperature", temperature: math.NaN(), humidity: 50, wantErr: true},
+		{name: "infinite temperature", temperature: math.Inf(-1), humidity: 50, wantErr: true},
+		{name: "NaN humidity", temperature: 20, humidity: math.NaN(), wantErr: true},
+		{name: "infinite humidity", temperature: 20, humidity: math.Inf(1), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateValues(tt.temperature, tt.humidity); (err != nil) != tt.wantErr {
+				t.Errorf("validateValues(%g, %g) = %v, want error %v", tt.temperature, tt.humidity, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadSensorCalibration(t *testing.T) {
+	tests := []struct {
+		name         string
+		humidity     float64
+		calibration  *calibration
+		wantHumidity float64
+		wantErr      bool
+	}{
+		{name: "no calibration", humidity: 45, wantHumidity: 45},
+		{name: "offset", humidity: 45, calibration: &calibration{scale: 1, offset: -1.5}, wantHumidity: 43.5},
+		{name: "capped at 100", humidity: 99, calibration: &calibration{scale: 1, offset: 2}, wantHumidity: 100},
+		{name: "offset to zero", humidity: 1.5, calibration: &calibration{scale: 1, offset: -1.5}, wantErr: true},
+		{name: "offset below zero", humidity: 1, calibration: &calibration{scale: 1, offset: -1.5}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &sensorConfig{
+				Name:                "attic",
+				Bus:                 "test",
+				Driver:              &simulateDriver{rows: []simulatedRow{{temperature: 20, humidity: tt.humidity}}},
+				HumidityCalibration: tt.calibration,
+			}
+			r, err := readSensor(context.Background(), s)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("read humidity %g, want an error", r.Humidity)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Humidity != tt.wantHumidity || math.IsInf(r.DewPoint, 0) || math.IsNaN(r.DewPoint) {
+				t.Errorf("read humidity %g, dew point %g, want humidity %g", r.Humidity, r.DewPoint, tt.wantHumidity)
+			}
+		})
+	}
+}
+
+func TestReadSensorWaitsForSensor(t *testing.T) {
+	s := &sensorConfig{
+		Name:   "attic",
+		Bus:    "test",
+		Driver: &simulateDriver{rows: []simulatedRow{{temperature: 20, humidity: 50}}},
+	}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, err := readSensor(context.Background(), s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the first read doesn't wait, the others wait for the sensor
+	if elapsed, want := time.Since(start), 2*s.Driver.retryDelay(); elapsed < want {
+		t.Errorf("three reads took %v, want at least %v", elapsed, want)
+	}
+}
@@ -0,0 +1,605 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type serveCommand struct {
+	ListenAddr     string        `short:"l" long:"listen-addr" description:"listen address:port" required:"true" default:":2112" env:"DHT_LISTEN_ADDR"`
+	ReadSeconds    time.Duration `long:"interval" description:"interval between measurements" default:"15s" env:"DHT_INTERVAL"`
+	IntervalAlign  bool          `long:"interval-align" description:"align the measurements to multiples of the interval on the wall clock, e.g. :00, :15, :30 and :45 for 15s" env:"DHT_INTERVAL_ALIGN"`
+	IntervalJitter time.Duration `long:"interval-jitter" description:"random delay of up to this duration added to every measurement, so exporters don't read in lockstep" env:"DHT_INTERVAL_JITTER"`
+	MaxAge         time.Duration `long:"max-age" description:"stop exporting the values of a sensor without a successful reading for this long and flag it in measurement_stale, so dashboards show gaps instead of old values; should be a few intervals" env:"DHT_MAX_AGE"`
+	WarmupReadings uint          `long:"warmup-readings" description:"discard this many successful readings of every sensor after the start, the first DHT22 readings after power-up are often bogus" env:"DHT_WARMUP_READINGS"`
+	WarmupPeriod   time.Duration `long:"warmup-period" description:"discard the readings taken within this period after the start" env:"DHT_WARMUP_PERIOD"`
+
+	IdenticalReadingsLimit  uint   `long:"identical-readings-limit" description:"flag a sensor after this many consecutive readings identical to the previous one, DHT22 sensors return the cached values when polled too quickly" env:"DHT_IDENTICAL_READINGS_LIMIT"`
+	IdenticalReadingsAction string `long:"identical-readings-action" description:"what to do with the readings over the limit; flag logs a warning, suppress also stops exporting them" choice:"flag" choice:"suppress" default:"flag" env:"DHT_IDENTICAL_READINGS_ACTION"`
+
+	DisableDefaultMetrics bool `long:"disable-default-metrics" description:"do not expose process_* and go_* collector metrics" env:"DHT_DISABLE_DEFAULT_METRICS"`
+	EnableGoMetrics       bool `long:"enable-go-metrics" description:"expose Go runtime (go_*) metrics" env:"DHT_ENABLE_GO_METRICS"`
+	EnablePiMetrics       bool `long:"enable-pi-metrics" description:"expose the Raspberry Pi undervoltage and throttling flags and the CPU temperature; undervoltage is a common cause of failed reads" env:"DHT_ENABLE_PI_METRICS"`
+
+	EnableComfortMetrics  bool    `long:"enable-comfort-metrics" description:"expose comfort_state classifying every reading as too_cold, too_hot, dry, humid or comfortable by the --comfort-* bands, the temperature takes precedence" env:"DHT_ENABLE_COMFORT_METRICS"`
+	ComfortTemperatureMin float64 `long:"comfort-temperature-min" description:"lowest comfortable temperature in °C" default:"20" env:"DHT_COMFORT_TEMPERATURE_MIN"`
+	ComfortTemperatureMax float64 `long:"comfort-temperature-max" description:"highest comfortable temperature in °C" default:"26" env:"DHT_COMFORT_TEMPERATURE_MAX"`
+	ComfortHumidityMin    float64 `long:"comfort-humidity-min" description:"lowest comfortable relative humidity in %" default:"30" env:"DHT_COMFORT_HUMIDITY_MIN"`
+	ComfortHumidityMax    float64 `long:"comfort-humidity-max" description:"highest comfortable relative humidity in %" default:"60" env:"DHT_COMFORT_HUMIDITY_MAX"`
+
+	ReadTimeout       time.Duration `long:"http-read-timeout" description:"maximum duration for reading the entire request" default:"10s" env:"DHT_HTTP_READ_TIMEOUT"`
+	ReadHeaderTimeout time.Duration `long:"http-read-header-timeout" description:"maximum duration for reading the request headers" default:"5s" env:"DHT_HTTP_READ_HEADER_TIMEOUT"`
+	WriteTimeout      time.Duration `long:"http-write-timeout" description:"maximum duration before timing out writes of the response" default:"30s" env:"DHT_HTTP_WRITE_TIMEOUT"`
+	IdleTimeout       time.Duration `long:"http-idle-timeout" description:"maximum time to wait for the next request on keep-alive connections" default:"60s" env:"DHT_HTTP_IDLE_TIMEOUT"`
+
+	MetricsDisableCompression  bool          `long:"metrics-disable-compression" description:"do not gzip the /metrics response even if the client supports it" env:"DHT_METRICS_DISABLE_COMPRESSION"`
+	MetricsMaxRequestsInFlight int           `long:"metrics-max-requests-in-flight" description:"maximum number of concurrent /metrics requests, 0 means unlimited" default:"0" env:"DHT_METRICS_MAX_REQUESTS_IN_FLIGHT"`
+	MetricsTimeout             time.Duration `long:"metrics-timeout" description:"timeout of a /metrics request, 0 means no timeout" default:"0" env:"DHT_METRICS_TIMEOUT"`
+
+	AccessLog     bool    `long:"http-access-log" description:"log every HTTP request with the remote address, path, status and duration" env:"DHT_HTTP_ACCESS_LOG"`
+	RateLimit     float64 `long:"http-rate-limit" description:"maximum requests per second per client IP address, 0 disables rate limiting" default:"0" env:"DHT_HTTP_RATE_LIMIT"`
+	RateBurst     int     `long:"http-rate-burst" description:"number of requests a client can make at once before the rate limit applies" default:"5" env:"DHT_HTTP_RATE_BURST"`
+	MaxConcurrent int     `long:"http-max-concurrent" description:"maximum number of requests served concurrently, 0 means unlimited" default:"0" env:"DHT_HTTP_MAX_CONCURRENT"`
+	APIToken      string  `long:"api-token" description:"bearer token of the /api/v1 endpoints, e.g. POST /api/v1/read reading the sensors right away; the endpoints are disabled when not set" env:"DHT_API_TOKEN" default-mask:"-"`
+
+	PushReceiver      bool          `long:"push-receiver" description:"accept readings of remote field units on POST /api/v1/push as described above; requires --api-token" env:"DHT_PUSH_RECEIVER"`
+	NoLocalSensors    bool          `long:"no-local-sensors" description:"don't read any local sensor, e.g. on a collector only receiving pushed, MQTT or BLE readings" env:"DHT_NO_LOCAL_SENSORS"`
+	PushOriginTimeout time.Duration `long:"push-origin-timeout" description:"an origin is reported down in push_origin_up when it doesn't push readings for this long" default:"5m" env:"DHT_PUSH_ORIGIN_TIMEOUT"`
+	PushMaxSensors    int           `long:"push-max-sensors" description:"maximum number of pushed sensors and of push origins, pushes of new ones are rejected above it until a restart" default:"100" env:"DHT_PUSH_MAX_SENSORS"`
+
+	MDNS         bool   `long:"mdns" description:"advertise the exporter on the local network via mDNS" env:"DHT_MDNS"`
+	MDNSService  string `long:"mdns-service" description:"mDNS service type to advertise" default:"_prometheus-http._tcp" env:"DHT_MDNS_SERVICE"`
+	MDNSInstance string `long:"mdns-instance" description:"mDNS instance name, defaults to the hostname" env:"DHT_MDNS_INSTANCE"`
+
+	ConsulAddr            string        `long:"consul-addr" description:"register with the Consul agent at this address, e.g. http://127.0.0.1:8500" env:"DHT_CONSUL_ADDR"`
+	ConsulToken           string        `long:"consul-token" description:"Consul ACL token" env:"DHT_CONSUL_TOKEN" default-mask:"-"`
+	ConsulServiceName     string        `long:"consul-service-name" description:"Consul service name" default:"dht-exporter" env:"DHT_CONSUL_SERVICE_NAME"`
+	ConsulServiceID       string        `long:"consul-service-id" description:"Consul service ID, defaults to the service name and hostname" env:"DHT_CONSUL_SERVICE_ID"`
+	ConsulServiceAddress  string        `long:"consul-service-address" description:"address registered for the service, defaults to the address of the Consul agent node" env:"DHT_CONSUL_SERVICE_ADDRESS"`
+	ConsulTags            []string      `long:"consul-tag" description:"Consul service tag (can be repeated)" env:"DHT_CONSUL_TAGS" env-delim:","`
+	ConsulTTL             time.Duration `long:"consul-ttl" description:"TTL of the health check updated with the sensor read results" default:"60s" env:"DHT_CONSUL_TTL"`
+	ConsulDeregisterAfter time.Duration `long:"consul-deregister-after" description:"Consul removes the service after the health check was critical for this long" default:"10m" env:"DHT_CONSUL_DEREGISTER_AFTER"`
+
+	MQTTBroker   string           `long:"mqtt-broker" description:"MQTT broker to receive readings of other devices from, e.g. tcp://broker:1883" env:"DHT_MQTT_BROKER"`
+	MQTTClientID string           `long:"mqtt-client-id" description:"MQTT client ID, defaults to dht-exporter-<hostname>" env:"DHT_MQTT_CLIENT_ID"`
+	MQTTUsername string           `long:"mqtt-username" description:"MQTT username" env:"DHT_MQTT_USERNAME"`
+	MQTTPassword string           `long:"mqtt-password" description:"MQTT password" env:"DHT_MQTT_PASSWORD" default-mask:"-"`
+	MQTTSensors  []mqttSensorSpec `long:"mqtt-sensor" description:"sensor publishing its readings over MQTT, e.g. name=shed,format=tasmota,topic=tele/shed/SENSOR or name=hall,format=esphome,temperature-topic=hall/sensor/temperature/state,humidity-topic=hall/sensor/humidity/state; supported formats are tasmota, esphome and json; tasmota-sensor=AM2301 picks the sensor of a Tasmota device with several, the first one with both values by default; an esphome value is paired with the last value of the other topic up to max-age, 5m by default; the topics can't contain the wildcards + and # (can be repeated)" env:"DHT_MQTT_SENSORS" env-delim:";"`
+
+	BLE         bool            `long:"ble" description:"listen for advertisements of BLE thermometers: Xiaomi LYWSD03MMC with the ATC1441 or pvvx firmware and Govee H5072/H5075; requires BlueZ" env:"DHT_BLE"`
+	BLESensors  []bleSensorSpec `long:"ble-sensor" description:"BLE thermometer to export, e.g. mac=A4:C1:38:12:34:56,name=bedroom,location=upstairs (can be repeated)" env:"DHT_BLE_SENSORS" env-delim:";"`
+	BLEDiscover int             `long:"ble-discover" description:"export up to this many recognized thermometers labeled by MAC address instead of the --ble-sensor ones, the first ones heard are kept until a restart; this exports any thermometer in range, e.g. the neighbour's" env:"DHT_BLE_DISCOVER"`
+
+	WebhookURL        string            `long:"webhook-url" description:"POST every successful reading as JSON to this URL" env:"DHT_WEBHOOK_URL"`
+	WebhookHeaders    map[string]string `long:"webhook-header" description:"HTTP header sent with the webhook requests, e.g. Authorization:Bearer secret (can be repeated)" env:"DHT_WEBHOOK_HEADERS" env-delim:"," default-mask:"-"`
+	WebhookTimeout    time.Duration     `long:"webhook-timeout" description:"timeout of a single webhook request" default:"5s" env:"DHT_WEBHOOK_TIMEOUT"`
+	WebhookRetries    uint              `long:"webhook-retries" description:"number of retries of a failed webhook delivery" default:"3" env:"DHT_WEBHOOK_RETRIES"`
+	WebhookRetryDelay time.Duration     `long:"webhook-retry-delay" description:"delay before the first retry, doubled for every next one" default:"1s" env:"DHT_WEBHOOK_RETRY_DELAY"`
+	WebhookBufferFile string            `long:"webhook-buffer-file" description:"buffer the readings in this file while the webhook is unavailable and deliver them in order once it's back, also across restarts; the delivery is at least once, readings delivered right before a crash can be delivered again after the restart" env:"DHT_WEBHOOK_BUFFER_FILE"`
+	WebhookBufferSize uint              `long:"webhook-buffer-size" description:"maximum number of buffered readings" default:"10000" env:"DHT_WEBHOOK_BUFFER_SIZE"`
+	WebhookBufferDrop string            `long:"webhook-buffer-drop" description:"readings dropped when the buffer is full" choice:"oldest" choice:"newest" default:"oldest" env:"DHT_WEBHOOK_BUFFER_DROP"`
+
+	Thresholds []thresholdSpec `long:"threshold" description:"range a value of the readings is expected to stay in, e.g. name=frost,value=temperature,min=2 or name=mould,sensor=cellar,value=humidity,max=70,severity=critical; supported values are temperature, humidity, vpd and dew-point, breaches are logged and exported in threshold_breached (can be repeated)" env:"DHT_THRESHOLDS" env-delim:";"`
+
+	AlertmanagerURLs    []string          `long:"alertmanager-url" description:"Alertmanager to send the --threshold breaches to as DHTThresholdBreached alerts, e.g. http://alertmanager:9093 (can be repeated)" env:"DHT_ALERTMANAGER_URLS" env-delim:","`
+	AlertmanagerHeaders map[string]string `long:"alertmanager-header" description:"HTTP header sent with the Alertmanager requests, e.g. Authorization:Basic dXNlcjpwYXNz (can be repeated)" env:"DHT_ALERTMANAGER_HEADERS" env-delim:"," default-mask:"-"`
+	AlertmanagerTimeout time.Duration     `long:"alertmanager-timeout" description:"timeout of a single Alertmanager request" default:"10s" env:"DHT_ALERTMANAGER_TIMEOUT"`
+	AlertmanagerResend  time.Duration     `long:"alertmanager-resend" description:"interval of resending the firing alerts; Alertmanager resolves the alerts not resent for four intervals" default:"1m" env:"DHT_ALERTMANAGER_RESEND"`
+
+	StatusPIN        string `long:"status-pin" description:"GPIO pin of a status LED or buzzer, e.g. 17 or GPIO17" env:"DHT_STATUS_PIN"`
+	StatusMode       string `long:"status-mode" description:"led blinks on every successful reading and is held on while a sensor is alarming, buzzer pulses while a sensor is alarming" choice:"led" choice:"buzzer" default:"led" env:"DHT_STATUS_MODE"`
+	StatusAlarmAfter uint   `long:"status-alarm-after" description:"number of consecutive failed reads or readings breaching a --threshold after which a sensor is alarming" default:"3" env:"DHT_STATUS_ALARM_AFTER"`
+
+	Display       string `long:"display" description:"show the last reading on a display attached to the Pi: ssd1306 for a 128x64 I2C OLED at address 0x3C or epd2in13v2 for the Waveshare 2.13\" e-paper HAT V2 on SPI" choice:"ssd1306" choice:"epd2in13v2" env:"DHT_DISPLAY"`
+	DisplayBus    string `long:"display-bus" description:"I2C bus or SPI port of the display, e.g. 1 or SPI0.0, defaults to the first one found" env:"DHT_DISPLAY_BUS"`
+	DisplayRotate bool   `long:"display-rotate" description:"rotate the display content by 180 degrees" env:"DHT_DISPLAY_ROTATE"`
+
+	GRPCListenAddr string `long:"grpc-listen-addr" description:"serve the readings over gRPC on this address, see api/v1/readings.proto" env:"DHT_GRPC_LISTEN_ADDR"`
+
+	ShutdownTimeout time.Duration `long:"shutdown-timeout" description:"grace period for draining in-flight scrapes, stopping the measurement loop and flushing outputs on shutdown" default:"10s" env:"DHT_SHUTDOWN_TIMEOUT"`
+
+	DryRun bool `long:"dry-run" description:"validate the configuration, check that the endpoints are reachable, print the resolved configuration and exit without reading the sensors" no-ini:"true"`
+
+	RunAsUser string `long:"run-as-user" description:"drop root privileges to this user (name or UID) after opening the listener and preparing GPIO access; the user needs write access to /sys/class/gpio, e.g. via the gpio group" env:"DHT_RUN_AS_USER"`
+}
+
+// serveOpts is shared with the config commands, so they can validate the
+// serve options as well.
+var serveOpts serveCommand
+
+func (c *serveCommand) validate() error {
+	if c.NoLocalSensors {
+		// the sensors are configured by the shared options, drop them before
+		// anything uses them
+		sensors = nil
+	}
+	if c.ReadSeconds <= 0 {
+		return errors.New("--interval must be greater than zero")
+	}
+	if c.IntervalJitter < 0 {
+		return errors.New("--interval-jitter must not be negative")
+	}
+	if c.IntervalAlign {
+		// the jitter must not push a measurement past the next aligned one of
+		// the sensor with the shortest interval
+		interval, name := c.ReadSeconds, ""
+		for _, s := range sensors {
+			if s.Interval > 0 && s.Interval < interval {
+				interval, name = s.Interval, s.Name
+			}
+		}
+		if c.IntervalJitter >= interval {
+			if len(name) > 0 {
+				return fmt.Errorf("--interval-jitter must be lower than the interval %s of sensor %s when aligning the measurements", interval, name)
+			}
+			return errors.New("--interval-jitter must be lower than --interval when aligning the measurements")
+		}
+	}
+	if c.MaxAge < 0 {
+		return errors.New("--max-age must not be negative")
+	}
+	if c.RateLimit < 0 {
+		return errors.New("--http-rate-limit must not be negative")
+	}
+	if c.RateLimit > 0 && c.RateBurst < 1 {
+		return errors.New("--http-rate-burst must be at least 1")
+	}
+	if c.MaxConcurrent < 0 {
+		return errors.New("--http-max-concurrent must not be negative")
+	}
+	if c.MetricsMaxRequestsInFlight < 0 {
+		return errors.New("--metrics-max-requests-in-flight must not be negative")
+	}
+	if c.WriteTimeout > 0 && c.MetricsTimeout >= c.WriteTimeout {
+		return errors.New("--metrics-timeout must be lower than --http-write-timeout")
+	}
+	if _, err := configureMQTTSensors(c.MQTTSensors); err != nil {
+		return err
+	}
+	if len(c.MQTTSensors) > 0 && len(c.MQTTBroker) == 0 {
+		return errors.New("--mqtt-sensor requires --mqtt-broker")
+	}
+	if _, err := configureBLESensors(c.BLESensors); err != nil {
+		return err
+	}
+	if len(c.BLESensors) > 0 && !c.BLE {
+		return errors.New("--ble-sensor requires --ble")
+	}
+	if c.BLEDiscover < 0 {
+		return errors.New("--ble-discover must not be negative")
+	}
+	if c.BLEDiscover > 0 && !c.BLE {
+		return errors.New("--ble-discover requires --ble")
+	}
+	if c.BLEDiscover > 0 && len(c.BLESensors) > 0 {
+		return errors.New("--ble-discover can't be combined with --ble-sensor")
+	}
+	if c.BLE && c.BLEDiscover == 0 && len(c.BLESensors) == 0 {
+		return errors.New("--ble requires --ble-sensor or --ble-discover")
+	}
+	thresholds, err := configureThresholds(c.Thresholds)
+	if err != nil {
+		return err
+	}
+	if err := c.checkThresholdSensors(thresholds); err != nil {
+		return err
+	}
+	if c.PushReceiver {
+		if len(c.APIToken) == 0 {
+			return errors.New("--push-receiver requires --api-token")
+		}
+		if c.PushOriginTimeout <= 0 {
+			return errors.New("--push-origin-timeout must be positive")
+		}
+		if c.PushMaxSensors <= 0 {
+			return errors.New("--push-max-sensors must be positive")
+		}
+	}
+	if _, err := c.comfortBands(); err != nil {
+		return err
+	}
+	if len(c.AlertmanagerURLs) > 0 {
+		if len(c.Thresholds) == 0 {
+			return errors.New("--alertmanager-url requires --threshold")
+		}
+		for _, raw := range c.AlertmanagerURLs {
+			if u, err := url.Parse(raw); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return fmt.Errorf("invalid --alertmanager-url %q, expected an http or https URL", raw)
+			}
+		}
+		if c.AlertmanagerResend <= 0 {
+			return errors.New("--alertmanager-resend must be positive")
+		}
+	}
+	if len(c.StatusPIN) > 0 && c.StatusAlarmAfter == 0 {
+		return errors.New("--status-alarm-after must be at least 1")
+	}
+	if len(c.WebhookURL) > 0 {
+		if u, err := url.Parse(c.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("invalid --webhook-url %q, expected an http or https URL", c.WebhookURL)
+		}
+	}
+	if len(c.WebhookBufferFile) > 0 {
+		if len(c.WebhookURL) == 0 {
+			return errors.New("--webhook-buffer-file requires --webhook-url")
+		}
+		if c.WebhookBufferSize == 0 {
+			return errors.New("--webhook-buffer-size must be at least 1")
+		}
+	}
+	if c.ShutdownTimeout <= 0 {
+		return errors.New("--shutdown-timeout must be positive")
+	}
+	if len(c.ConsulAddr) > 0 && c.ConsulTTL < 2*time.Second {
+		return errors.New("--consul-ttl must be at least 2s")
+	}
+	return c.checkPinConflicts()
+}
+
+func (c *serveCommand) Execute(_ []string) error {
+	if c.DryRun {
+		return checkConfig(os.Stdout, true, 3*time.Second)
+	}
+	if err := c.validate(); err != nil {
+		return err
+	}
+
+	registry := prometheus.NewRegistry()
+	registerer := prometheus.WrapRegistererWith(opts.Metrics.Labels, registry)
+	m := newMetrics(registerer, opts.Metrics.Namespace, opts.Metrics.Names, opts.Metrics.NativeHistograms)
+	m.comfort, _ = c.comfortBands()
+
+	mux := http.NewServeMux()
+	var handler http.Handler = mux
+	if c.MaxConcurrent > 0 {
+		handler = concurrencyLimitHandler(c.MaxConcurrent, handler)
+	}
+	if c.RateLimit > 0 {
+		handler = newRateLimiter(c.RateLimit, c.RateBurst).handler(handler)
+	}
+	if c.AccessLog {
+		handler = accessLogHandler(handler)
+	}
+	server := &http.Server{
+		Addr:              c.ListenAddr,
+		Handler:           handler,
+		ReadTimeout:       c.ReadTimeout,
+		ReadHeaderTimeout: c.ReadHeaderTimeout,
+		WriteTimeout:      c.WriteTimeout,
+		IdleTimeout:       c.IdleTimeout,
+		ErrorLog:          slog.NewLogLogger(log.Handler(), slog.LevelWarn),
+	}
+
+	if !c.DisableDefaultMetrics {
+		registerer.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+		if c.EnableGoMetrics {
+			registerer.MustRegister(collectors.NewGoCollector())
+		}
+	}
+	if c.EnablePiMetrics {
+		registerer.MustRegister(newPiCollector())
+	}
+
+	detectSensorTypes(context.Background())
+	m.setSensorInfo()
+
+	// bind the listener before dropping privileges, so privileged ports work
+	listener, err := net.Listen("tcp", c.ListenAddr)
+	if err != nil {
+		return err
+	}
+	// the server closes the listener on shutdown
+	defer listener.Close()
+
+	// outputs are closed in order by the shutdown, the deferred close only
+	// releases the ones opened before a failed start
+	var outputs []outputCloser
+	defer func() {
+		if len(outputs) > 0 {
+			closeCtx, closeRelease := context.WithTimeout(context.Background(), c.ShutdownTimeout)
+			defer closeRelease()
+			closeOutputs(closeCtx, outputs)
+		}
+	}()
+
+	// the display buses and the status and power pins usually need the i2c,
+	// spi or gpio group, open them before dropping privileges as well
+	var oled *localDisplay
+	if len(c.Display) > 0 {
+		if oled, err = c.openDisplay(); err != nil {
+			return fmt.Errorf("unable to open the display: %v", err)
+		}
+		outputs = append(outputs, oled.closer())
+	}
+	thresholds, _ := configureThresholds(c.Thresholds)
+	var status *statusIndicator
+	if len(c.StatusPIN) > 0 {
+		if status, err = c.openStatusIndicator(thresholds); err != nil {
+			return fmt.Errorf("unable to open the status pin: %v", err)
+		}
+		outputs = append(outputs, status.closer())
+	}
+	powerSwitches, err := openPowerSwitches(m)
+	if err != nil {
+		return fmt.Errorf("unable to open the sensor power pin: %v", err)
+	}
+	defer closePowerSwitches(powerSwitches)
+	var grpcListener net.Listener
+	if len(c.GRPCListenAddr) > 0 {
+		if grpcListener, err = net.Listen("tcp", c.GRPCListenAddr); err != nil {
+			return err
+		}
+		// the gRPC server closes the listener on shutdown
+		defer grpcListener.Close()
+	}
+	if len(c.RunAsUser) > 0 {
+		if err := dropPrivileges(c.RunAsUser); err != nil {
+			return err
+		}
+	}
+	if c.MDNS {
+		mdnsServer, err := c.advertiseMDNS(listener.Addr())
+		if err != nil {
+			return fmt.Errorf("unable to advertise via mDNS: %v", err)
+		}
+		defer mdnsServer.Shutdown()
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	var (
+		observers []readingObserver
+		consul    *consulRegistration
+		monitor   *thresholdMonitor
+	)
+	if len(c.ConsulAddr) > 0 {
+		consul, err = c.registerConsul(listener.Addr())
+		if err != nil {
+			return fmt.Errorf("unable to register with Consul: %v", err)
+		}
+		// the shutdown deregisters first, so no new scrapes arrive
+		defer consul.deregister()
+		go consul.heartbeat(ctx)
+		observers = append(observers, consul.observeReading)
+	}
+	if len(c.WebhookURL) > 0 {
+		w, err := c.newWebhook(registerer)
+		if err != nil {
+			return err
+		}
+		observers = append(observers, w.observeReading)
+		outputs = append(outputs, w.closer())
+	}
+	if len(thresholds) > 0 {
+		var notifier *alertmanagerNotifier
+		if len(c.AlertmanagerURLs) > 0 {
+			if notifier, err = c.newAlertmanagerNotifier(registerer); err != nil {
+				return err
+			}
+			outputs = append(outputs, notifier.closer())
+		}
+		monitor = newThresholdMonitor(thresholds, m, notifier)
+		observers = append(observers, monitor.observeReading)
+	}
+	if status != nil {
+		observers = append(observers, status.observeReading)
+	}
+	if oled != nil {
+		observers = append(observers, oled.observeReading)
+	}
+	// the gRPC service leaves out the sensors the recorder expired, it's
+	// served once the recorder is created
+	var (
+		rec     *recorder
+		service *readingService
+	)
+	if grpcListener != nil {
+		service = newReadingService(func(sensor string) bool { return rec.isStale(sensor) })
+		observers = append(observers, service.observeReading)
+	}
+
+	// every sensor is read on its own schedule, so a slow sensor doesn't delay
+	// the others
+	rec = newRecorder(m, observers, recorderOptions{
+		warmupReadings:    int(c.WarmupReadings),
+		warmupPeriod:      c.WarmupPeriod,
+		identicalLimit:    int(c.IdenticalReadingsLimit),
+		suppressIdentical: c.IdenticalReadingsAction == "suppress",
+		maxAge:            c.MaxAge,
+	})
+	if monitor != nil {
+		rec.onStale = monitor.resolveAlerts
+	}
+	if c.MaxAge > 0 {
+		go rec.expireStale(ctx)
+	}
+	if service != nil {
+		outputs = append(outputs, serveGRPC(grpcListener, service))
+	}
+	if len(c.MQTTSensors) > 0 {
+		mqttSensors, _ := configureMQTTSensors(c.MQTTSensors)
+		for _, s := range mqttSensors {
+			m.sensorInfo.WithLabelValues(s.name, s.format, "", "mqtt", s.location, "").Set(1)
+		}
+		client, err := c.subscribeMQTT(mqttSensors, rec)
+		if err != nil {
+			return fmt.Errorf("unable to connect to the MQTT broker: %v", err)
+		}
+		defer client.Disconnect(250)
+	}
+	if c.BLE {
+		bleSensors, _ := configureBLESensors(c.BLESensors)
+		// thermometers advertise every few seconds, record them like the
+		// polled sensors
+		ble := &bleListener{sensors: bleSensors, discover: c.BLEDiscover, rec: rec, interval: c.ReadSeconds, last: map[string]time.Time{}}
+		if err := scanBLE(ctx, ble); err != nil {
+			return err
+		}
+	}
+	var measurements sync.WaitGroup
+	for _, s := range sensors {
+		measurements.Add(1)
+		go func(s *sensorConfig) {
+			defer measurements.Done()
+			c.recordMetrics(ctx, rec, s, powerSwitches[s.Name])
+		}(s)
+	}
+	measurementDone := make(chan struct{})
+	go func() {
+		measurements.Wait()
+		close(measurementDone)
+	}()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{
+		ErrorLog:            slog.NewLogLogger(log.Handler(), slog.LevelError),
+		DisableCompression:  c.MetricsDisableCompression,
+		MaxRequestsInFlight: c.MetricsMaxRequestsInFlight,
+		Timeout:             c.MetricsTimeout,
+	}))
+	mux.HandleFunc("/-/healthy", func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprintln(w, "OK")
+	})
+	mux.Handle("/-/ready", readinessHandler(rec))
+	if len(c.APIToken) > 0 {
+		// leave a part of the write timeout to respond with the reads that
+		// finished in time
+		mux.Handle("/api/v1/read", tokenAuthHandler(c.APIToken, readHandler(rec, powerSwitches, c.WriteTimeout*4/5)))
+	}
+	if c.PushReceiver {
+		receiver := c.newPushReceiver(registerer, m, rec)
+		go receiver.watchOrigins(ctx)
+		mux.Handle("/api/v1/push", tokenAuthHandler(c.APIToken, receiver))
+	}
+
+	go func() {
+		log.Info("Starting HTTP server", "addr", c.ListenAddr)
+		if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			log.Error("HTTP server error", "err", err)
+			os.Exit(1)
+		}
+		log.Info("Stopped serving new connections")
+	}()
+
+	<-ctx.Done()
+	err = c.shutdown(server, consul, measurementDone, outputs)
+	outputs = nil
+	return err
+}
+
+// outputCloser flushes pending writes of an output and closes it.
+type outputCloser struct {
+	name  string
+	close func(ctx context.Context) error
+}
+
+// shutdown stops the exporter within the shutdown timeout. Service discovery
+// goes first so no new scrapes arrive, then in-flight scrapes are drained, the
+// measurement loop is stopped and finally the outputs are flushed.
+func (c *serveCommand) shutdown(server *http.Server, consul *consulRegistration, measurementDone <-chan struct{}, outputs []outputCloser) error {
+	shutdownCtx, shutdownRelease := context.WithTimeout(context.Background(), c.ShutdownTimeout)
+	defer shutdownRelease()
+
+	if consul != nil {
+		consul.deregister()
+	}
+
+	var shutdownErr error
+	log.Info("Draining HTTP connections", "timeout", c.ShutdownTimeout)
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Warn("Unable to drain HTTP connections, closing them", "err", err)
+		server.Close()
+		shutdownErr = fmt.Errorf("HTTP shutdown error: %v", err)
+	}
+
+	// the sensor must not be left in the middle of a read
+	log.Info("Waiting for the measurement loop to stop")
+	select {
+	case <-measurementDone:
+		log.Info("Measurement loop stopped")
+	case <-shutdownCtx.Done():
+		log.Warn("Measurement loop did not stop within the shutdown timeout")
+		if shutdownErr == nil {
+			shutdownErr = errors.New("measurement loop did not stop within the shutdown timeout")
+		}
+	}
+
+	closeOutputs(shutdownCtx, outputs)
+	return shutdownErr
+}
+
+// closeOutputs flushes and closes the outputs in order.
+func closeOutputs(ctx context.Context, outputs []outputCloser) {
+	for _, output := range outputs {
+		if err := output.close(ctx); err != nil {
+			log.Warn("Unable to flush output", "output", output.name, "err", err)
+			continue
+		}
+		log.Info("Output flushed", "output", output.name)
+	}
+}
+
+// readingObserver is notified about the result of every measurement.
+type readingObserver func(sensor string, r *reading, err error)
+
+// recordMetrics reads the sensor every interval until the context is cancelled.
+// The sensor is power cycled through the power switch when set.
+func (c *serveCommand) recordMetrics(ctx context.Context, rec *recorder, s *sensorConfig, power *powerSwitch) {
+	interval := c.ReadSeconds
+	if s.Interval > 0 {
+		interval = s.Interval
+	}
+	// the first measurement is only delayed by the jitter, so the metrics are
+	// available right after the start
+	delay := c.jitter()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		r, err := rec.readSensor(ctx, s)
+		if err != nil && ctx.Err() != nil {
+			return
+		}
+		rec.record(s.Name, r, err)
+		if power != nil {
+			power.observe(ctx, err)
+		}
+		delay = c.nextMeasurement(time.Now(), interval)
+	}
+}
+
+// nextMeasurement returns how long to wait for the next measurement. Aligned
+// measurements start at the next multiple of the interval since the Unix
+// epoch, others an interval after the previous measurement finished.
+func (c *serveCommand) nextMeasurement(now time.Time, interval time.Duration) time.Duration {
+	delay := interval
+	if c.IntervalAlign {
+		// Truncate works relative to the zero time, not to the epoch
+		delay = interval - time.Duration(now.UnixNano()%int64(interval))
+	}
+	return delay + c.jitter()
+}
+
+func (c *serveCommand) jitter() time.Duration {
+	if c.IntervalJitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(c.IntervalJitter)))
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// simulateSpecKeys lists the --sensor keys of the simulate driver.
+var simulateSpecKeys = []string{
+	"file",
+	"temperature", "temperature-amplitude", "temperature-noise",
+	"humidity", "humidity-amplitude", "humidity-noise",
+	"period", "failure-rate", "failure-every", "failure-for", "failure-type",
+}
+
+// simulatedErrors are errors with the messages of the DHT driver, so the
+// simulated failures are classified like the real ones.
+var simulatedErrors = map[string]error{
+	errorTypeChecksum: errors.New("CRCs doesn't match (simulated)"),
+	errorTypeTimeout:  errors.New("Can't decode pulse array received from DHTxx sensor (simulated)"),
+	errorTypeGPIO:     errors.New("failed to open GPIO (simulated)"),
+	errorTypeOther:    errors.New("simulated failure"),
+}
+
+// simulateDriver generates readings without any hardware, either by replaying
+// a CSV file or from a daily cycle waveform with noise. Failures can be
+// injected randomly and in windows of wall clock time.
+type simulateDriver struct {
+	// file is the replayed CSV file, rows are returned one per read and start
+	// over at the end
+	file string
+	rows []simulatedRow
+
+	// the waveform, temperature and humidity are the means the values
+	// oscillate around with their amplitude within the period, the humidity
+	// is lowest when the temperature is highest
+	temperature, temperatureAmplitude, temperatureNoise float64
+	humidity, humidityAmplitude, humidityNoise          float64
+	period                                              time.Duration
+
+	failureRate  float64
+	failureEvery time.Duration
+	failureFor   time.Duration
+	failure      error
+
+	mu   sync.Mutex
+	next int
+}
+
+// simulatedRow is a row of a replayed CSV file, failed is set for rows without
+// values.
+type simulatedRow struct {
+	temperature, humidity float64
+	failed                bool
+}
+
+// newSimulateDriver configures the driver from the --sensor keys, e.g.
+// driver=simulate,temperature=22,temperature-amplitude=4,failure-rate=0.1 or
+// driver=simulate,file=history.csv
+func newSimulateDriver(values map[string]string) (*simulateDriver, error) {
+	d := &simulateDriver{
+		file:                 values["file"],
+		temperature:          21,
+		temperatureAmplitude: 3,
+		temperatureNoise:     0.1,
+		humidity:             50,
+		humidityAmplitude:    10,
+		humidityNoise:        0.5,
+		period:               24 * time.Hour,
+		failure:              simulatedErrors[errorTypeChecksum],
+	}
+	parseFloat := func(key string, value *float64) error {
+		if raw, ok := values[key]; ok {
+			v, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %v", key, err)
+			}
+			*value = v
+		}
+		return nil
+	}
+	parseDuration := func(key string, value *time.Duration) error {
+		if raw, ok := values[key]; ok {
+			v, err := time.ParseDuration(raw)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %v", key, err)
+			}
+			*value = v
+		}
+		return nil
+	}
+	for _, err := range []error{
+		parseFloat("temperature", &d.temperature),
+		parseFloat("temperature-amplitude", &d.temperatureAmplitude),
+		parseFloat("temperature-noise", &d.temperatureNoise),
+		parseFloat("humidity", &d.humidity),
+		parseFloat("humidity-amplitude", &d.humidityAmplitude),
+		parseFloat("humidity-noise", &d.humidityNoise),
+		parseDuration("period", &d.period),
+		parseFloat("failure-rate", &d.failureRate),
+		parseDuration("failure-every", &d.failureEvery),
+		parseDuration("failure-for", &d.failureFor),
+	} {
+		if err != nil {
+			return nil, err
+		}
+	}
+	if d.period <= 0 {
+		return nil, errors.New("period must be positive")
+	}
+	if d.failureRate < 0 || d.failureRate > 1 {
+		return nil, errors.New("failure-rate must be between 0 and 1")
+	}
+	if (d.failureEvery > 0) != (d.failureFor > 0) || d.failureFor >= d.failureEvery && d.failureEvery > 0 {
+		return nil, errors.New("failure-every and failure-for must be set together and failure-for must be shorter")
+	}
+	if t, ok := values["failure-type"]; ok {
+		if d.failure, ok = simulatedErrors[t]; !ok {
+			return nil, fmt.Errorf("unsupported failure-type %q, supported: checksum, timeout, gpio, other", t)
+		}
+	}
+	if len(d.file) > 0 {
+		rows, err := readSimulatedRows(d.file)
+		if err != nil {
+			return nil, err
+		}
+		d.rows = rows
+	}
+	return d, nil
+}
+
+// readSimulatedRows reads a CSV file with a header row. The temperature and
+// humidity columns are required, other columns like a timestamp are ignored.
+// Rows with an empty value replay a failed read.
+func readSimulatedRows(path string) ([]simulatedRow, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the header of %s: %v", path, err)
+	}
+	temperatureColumn, humidityColumn := -1, -1
+	for i, name := range header {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "temperature":
+			temperatureColumn = i
+		case "humidity":
+			humidityColumn = i
+		}
+	}
+	if temperatureColumn < 0 || humidityColumn < 0 {
+		return nil, fmt.Errorf("%s needs temperature and humidity columns", path)
+	}
+	var rows []simulatedRow
+	for line := 2; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if len(record) <= temperatureColumn || len(record) <= humidityColumn ||
+			len(strings.TrimSpace(record[temperatureColumn])) == 0 || len(strings.TrimSpace(record[humidityColumn])) == 0 {
+			rows = append(rows, simulatedRow{failed: true})
+			continue
+		}
+		temperature, err := strconv.ParseFloat(strings.TrimSpace(record[temperatureColumn]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid temperature: %v", path, line, err)
+		}
+		humidity, err := strconv.ParseFloat(strings.TrimSpace(record[humidityColumn]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid humidity: %v", path, line, err)
+		}
+		rows = append(rows, simulatedRow{temperature: temperature, humidity: humidity})
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("%s has no readings", path)
+	}
+	return rows, nil
+}
+
+func (d *simulateDriver) read() (temperature, humidity float64, err error) {
+	now := time.Now()
+	if d.failureEvery > 0 && now.Sub(now.Truncate(d.failureEvery)) < d.failureFor {
+		return 0, 0, d.failure
+	}
+	if d.failureRate > 0 && rand.Float64() < d.failureRate {
+		return 0, 0, d.failure
+	}
+	if len(d.rows) > 0 {
+		d.mu.Lock()
+		row := d.rows[d.next]
+		d.next = (d.next + 1) % len(d.rows)
+		d.mu.Unlock()
+		if row.failed {
+			return 0, 0, d.failure
+		}
+		return row.temperature, row.humidity, nil
+	}
+	// the temperature peaks at 15:00 UTC for the daily period, like the
+	// outside temperature
+	phase := 2 * math.Pi * (float64(now.Sub(now.Truncate(d.period))) / float64(d.period))
+	wave := -math.Cos(phase - math.Pi/4)
+	temperature = d.temperature + d.temperatureAmplitude*wave + rand.NormFloat64()*d.temperatureNoise
+	humidity = d.humidity - d.humidityAmplitude*wave + rand.NormFloat64()*d.humidityNoise
+	// the humidity stays above 0, which is only reported by failed reads
+	return math.Round(temperature*10) / 10, math.Round(math.Max(0.1, math.Min(100, humidity))*10) / 10, nil
+}
+
+func (d *simulateDriver) retryDelay() time.Duration {
+	return 100 * time.Millisecond
+}
+
+func (d *simulateDriver) info() (model, pin, driver string) {
+	if len(d.file) > 0 {
+		return "replay", d.file, "simulate"
+	}
+	return "waveform", "", "simulate"
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSimulateDriverWaveform(t *testing.T) {
+	tests := []struct {
+		name   string
+		values map[string]string
+		// mean and amplitude of the values
+		temperature, temperatureAmplitude float64
+		humidity, humidityAmplitude       float64
+	}{
+		{
+			name:        "defaults without noise",
+			values:      map[string]string{"temperature-noise": "0", "humidity-noise": "0"},
+			temperature: 21, temperatureAmplitude: 3,
+			humidity: 50, humidityAmplitude: 10,
+		},
+		{
+			name: "short period",
+			values: map[string]string{
+				"temperature": "5", "temperature-amplitude": "2", "temperature-noise": "0",
+				"humidity": "80", "humidity-amplitude": "5", "humidity-noise": "0",
+				"period": "1s",
+			},
+			temperature: 5, temperatureAmplitude: 2,
+			humidity: 80, humidityAmplitude: 5,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := newSimulateDriver(tt.values)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 100; i++ {
+				temperature, humidity, err := d.read()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if math.Abs(temperature-tt.temperature) > tt.temperatureAmplitude+0.05 {
+					t.Fatalf("temperature %g is out of %g±%g", temperature, tt.temperature, tt.temperatureAmplitude)
+				}
+				if math.Abs(humidity-tt.humidity) > tt.humidityAmplitude+0.05 {
+					t.Fatalf("humidity %g is out of %g±%g", humidity, tt.humidity, tt.humidityAmplitude)
+				}
+				// the humidity is lowest when the temperature is highest, both
+				// are rounded to a tenth
+				wave := (temperature - tt.temperature) / tt.temperatureAmplitude
+				if want := tt.humidity - tt.humidityAmplitude*wave; math.Abs(humidity-want) > 0.1+tt.humidityAmplitude*0.05/tt.temperatureAmplitude {
+					t.Fatalf("humidity %g doesn't follow the temperature %g, want %g", humidity, temperature, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSimulateDriverFailures(t *testing.T) {
+	tests := []struct {
+		name     string
+		values   map[string]string
+		wantType string
+	}{
+		{name: "default failure type", values: map[string]string{"failure-rate": "1"}, wantType: errorTypeChecksum},
+		{name: "timeout", values: map[string]string{"failure-rate": "1", "failure-type": "timeout"}, wantType: errorTypeTimeout},
+		{name: "gpio", values: map[string]string{"failure-rate": "1", "failure-type": "gpio"}, wantType: errorTypeGPIO},
+		{name: "no failures", values: map[string]string{"failure-rate": "0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := newSimulateDriver(tt.values)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 20; i++ {
+				_, _, err := d.read()
+				if len(tt.wantType) == 0 {
+					if err != nil {
+						t.Fatalf("unexpected error %v", err)
+					}
+					continue
+				}
+				if err == nil {
+					t.Fatal("the read didn't fail")
+				}
+				if got := classifyError(err); got != tt.wantType {
+					t.Fatalf("got error type %s, want %s", got, tt.wantType)
+				}
+			}
+		})
+	}
+}
+
+func TestSimulateDriverReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.csv")
+	data := "time,Temperature,humidity\n2024-01-01T00:00:00Z,21.5,40\n2024-01-01T00:01:00Z,,\n2024-01-01T00:02:00Z,22,41.5\n"
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	d, err := newSimulateDriver(map[string]string{"file": path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the rows start over at the end of the file
+	want := []struct {
+		temperature, humidity float64
+		failed                bool
+	}{{21.5, 40, false}, {0, 0, true}, {22, 41.5, false}, {21.5, 40, false}}
+	for i, w := range want {
+		temperature, humidity, err := d.read()
+		if (err != nil) != w.failed {
+			t.Fatalf("read %d: got error %v, want failure %v", i+1, err, w.failed)
+		}
+		if temperature != w.temperature || humidity != w.humidity {
+			t.Errorf("read %d: got %g °C and %g %%, want %g °C and %g %%", i+1, temperature, humidity, w.temperature, w.humidity)
+		}
+	}
+}
+
+func TestNewSimulateDriver(t *testing.T) {
+	dir := t.TempDir()
+	noValues := filepath.Join(dir, "empty.csv")
+	noColumns := filepath.Join(dir, "columns.csv")
+	invalid := filepath.Join(dir, "invalid.csv")
+	for path, data := range map[string]string{
+		noValues:  "temperature,humidity\n",
+		noColumns: "time,temperature\n2024-01-01T00:00:00Z,21\n",
+		invalid:   "temperature,humidity\nwarm,40\n",
+	} {
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name    string
+		values  map[string]string
+		wantErr bool
+	}{
+		{name: "defaults", values: map[string]string{}},
+		{name: "failure window", values: map[string]string{"failure-every": "1h", "failure-for": "5m"}},
+		{name: "invalid temperature", values: map[string]string{"temperature": "warm"}, wantErr: true},
+		{name: "invalid period", values: map[string]string{"period": "0s"}, wantErr: true},
+		{name: "failure rate over 1", values: map[string]string{"failure-rate": "1.5"}, wantErr: true},
+		{name: "failure-every without failure-for", values: map[string]string{"failure-every": "1h"}, wantErr: true},
+		{name: "failure-for not shorter", values: map[string]string{"failure-every": "1h", "failure-for": "1h"}, wantErr: true},
+		{name: "unsupported failure type", values: map[string]string{"failure-type": "power"}, wantErr: true},
+		{name: "missing file", values: map[string]string{"file": filepath.Join(dir, "missing.csv")}, wantErr: true},
+		{name: "file without readings", values: map[string]string{"file": noValues}, wantErr: true},
+		{name: "file without humidity", values: map[string]string{"file": noColumns}, wantErr: true},
+		{name: "file with invalid values", values: map[string]string{"file": invalid}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newSimulateDriver(tt.values)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
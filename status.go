@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"periph.io/x/conn/v3/gpio"
+	"periph.io/x/conn/v3/gpio/gpioreg"
+	"periph.io/x/host/v3"
+)
+
+// Durations of the status pin signals.
+const (
+	statusBlinkDuration = 100 * time.Millisecond
+	statusPulseDuration = 200 * time.Millisecond
+	statusPulseInterval = time.Second
+)
+
+// statusIndicator drives a status LED or buzzer. The LED blinks on every
+// successful reading and is held on while a sensor is alarming, the buzzer
+// only pulses while a sensor is alarming. A sensor alarms after the given
+// number of consecutive failed reads or readings breaching a threshold.
+type statusIndicator struct {
+	pin        gpio.PinIO
+	buzzer     bool
+	alarmAfter int
+	thresholds []*threshold
+
+	mu sync.Mutex
+	// bad counts the consecutive failed or breaching readings per sensor
+	bad   map[string]int
+	blink bool
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// openStatusIndicator initializes the status pin configured by the --status-*
+// options.
+func (c *serveCommand) openStatusIndicator(thresholds []*threshold) (*statusIndicator, error) {
+	if _, err := host.Init(); err != nil {
+		return nil, fmt.Errorf("unable to initialize periph: %v", err)
+	}
+	pin := gpioreg.ByName(c.StatusPIN)
+	if pin == nil {
+		return nil, fmt.Errorf("unknown GPIO pin %q", c.StatusPIN)
+	}
+	if err := pin.Out(gpio.Low); err != nil {
+		return nil, err
+	}
+	s := &statusIndicator{
+		pin:        pin,
+		buzzer:     c.StatusMode == "buzzer",
+		alarmAfter: int(c.StatusAlarmAfter),
+		thresholds: thresholds,
+		bad:        map[string]int{},
+		wake:       make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// observeReading updates the state of the sensor.
+func (s *statusIndicator) observeReading(sensor string, r *reading, err error) {
+	s.mu.Lock()
+	if err != nil || len(breachedThresholds(s.thresholds, r)) > 0 {
+		s.bad[sensor]++
+	} else {
+		s.bad[sensor] = 0
+		s.blink = true
+	}
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// state returns whether any sensor is alarming and whether to blink for a
+// successful reading since the last call.
+func (s *statusIndicator) state() (alarming, blink bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, bad := range s.bad {
+		if bad >= s.alarmAfter {
+			alarming = true
+		}
+	}
+	blink, s.blink = s.blink, false
+	return alarming, blink
+}
+
+func (s *statusIndicator) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(statusPulseInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-s.wake:
+		case <-ticker.C:
+		}
+		alarming, blink := s.state()
+		var err error
+		switch {
+		case alarming && s.buzzer:
+			err = s.signal(statusPulseDuration)
+		case alarming:
+			err = s.pin.Out(gpio.High)
+		case blink && !s.buzzer:
+			err = s.signal(statusBlinkDuration)
+		default:
+			err = s.pin.Out(gpio.Low)
+		}
+		if err != nil {
+			log.Warn("Unable to set the status pin", "pin", s.pin.Name(), "err", err)
+		}
+	}
+}
+
+// signal turns the pin on for the duration.
+func (s *statusIndicator) signal(d time.Duration) error {
+	if err := s.pin.Out(gpio.High); err != nil {
+		return err
+	}
+	time.Sleep(d)
+	return s.pin.Out(gpio.Low)
+}
+
+// closer turns the pin off, so a stopped exporter doesn't look alarming.
+func (s *statusIndicator) closer() outputCloser {
+	return outputCloser{
+		name: "status",
+		close: func(ctx context.Context) error {
+			close(s.stop)
+			select {
+			case <-s.done:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			if err := s.pin.Out(gpio.Low); err != nil {
+				return err
+			}
+			return s.pin.Halt()
+		},
+	}
+}
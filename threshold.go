@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// thresholdSpec is the value of a --threshold option, a comma separated list
+// of key=value pairs.
+type thresholdSpec struct {
+	raw    string
+	values map[string]string
+}
+
+// thresholdSpecKeys lists the keys supported in a --threshold value.
+var thresholdSpecKeys = []string{"name", "sensor", "value", "min", "max", "severity"}
+
+func (s *thresholdSpec) UnmarshalFlag(value string) error {
+	values, err := parseSpec(value, thresholdSpecKeys)
+	if err != nil {
+		return err
+	}
+	s.raw, s.values = value, values
+	return nil
+}
+
+func (s thresholdSpec) MarshalFlag() (string, error) {
+	return s.raw, nil
+}
+
+// thresholdValues maps the value names usable in a threshold to the value of
+// the reading.
+var thresholdValues = map[string]func(r *reading) float64{
+	"temperature": func(r *reading) float64 { return r.Temperature },
+	"humidity":    func(r *reading) float64 { return r.Humidity },
+	"vpd":         func(r *reading) float64 { return r.VaporPressureDeficit },
+	"dew-point":   func(r *reading) float64 { return r.DewPoint },
+}
+
+// threshold is a range a value of the readings is expected to stay in.
+type threshold struct {
+	name string
+	// sensor limits the threshold to a single sensor, all sensors are checked
+	// when empty
+	sensor string
+	value  string
+	// min and max are the bounds of the range, at least one is set
+	min, max *float64
+	// severity is the severity label of the Alertmanager alerts
+	severity string
+}
+
+// configureThresholds validates the --threshold options.
+func configureThresholds(specs []thresholdSpec) ([]*threshold, error) {
+	var result []*threshold
+	names := map[string]bool{}
+	for _, spec := range specs {
+		v := spec.values
+		t := &threshold{name: v["name"], sensor: v["sensor"], value: v["value"], severity: "warning"}
+		if severity, ok := v["severity"]; ok {
+			t.severity = severity
+		}
+		if len(t.name) == 0 {
+			return nil, fmt.Errorf("missing name in --threshold %q", spec.raw)
+		}
+		if names[t.name] {
+			return nil, fmt.Errorf("duplicate name %s in --threshold %q", t.name, spec.raw)
+		}
+		names[t.name] = true
+		if _, ok := thresholdValues[t.value]; !ok {
+			return nil, fmt.Errorf("unsupported value %q in --threshold %q, supported: temperature, humidity, vpd, dew-point", t.value, spec.raw)
+		}
+		for key, bound := range map[string]**float64{"min": &t.min, "max": &t.max} {
+			raw, ok := v[key]
+			if !ok {
+				continue
+			}
+			f, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s in --threshold %q: %v", key, spec.raw, err)
+			}
+			*bound = &f
+		}
+		if t.min == nil && t.max == nil {
+			return nil, fmt.Errorf("min or max is required in --threshold %q", spec.raw)
+		}
+		if t.min != nil && t.max != nil && *t.min >= *t.max {
+			return nil, fmt.Errorf("min must be lower than max in --threshold %q", spec.raw)
+		}
+		result = append(result, t)
+	}
+	return result, nil
+}
+
+// check returns whether the threshold applies to the reading and whether the
+// value is outside of the range.
+func (t *threshold) check(r *reading) (applies, breached bool) {
+	if len(t.sensor) > 0 && t.sensor != r.Sensor {
+		return false, false
+	}
+	value := thresholdValues[t.value](r)
+	return true, (t.min != nil && value < *t.min) || (t.max != nil && value > *t.max)
+}
+
+// String describes the expected range, e.g. "temperature >= 2" or
+// "humidity 40..70".
+func (t *threshold) String() string {
+	switch {
+	case t.min == nil:
+		return fmt.Sprintf("%s <= %g", t.value, *t.max)
+	case t.max == nil:
+		return fmt.Sprintf("%s >= %g", t.value, *t.min)
+	default:
+		return fmt.Sprintf("%s %g..%g", t.value, *t.min, *t.max)
+	}
+}
+
+// breachedThresholds returns the names of the thresholds the reading is
+// outside of.
+func breachedThresholds(thresholds []*threshold, r *reading) []string {
+	var breached []string
+	for _, t := range thresholds {
+		if _, b := t.check(r); b {
+			breached = append(breached, t.name)
+		}
+	}
+	return breached
+}
+
+// thresholdMonitor logs the threshold breaches and exports them as metrics.
+// The breaches are sent to Alertmanager as well when a notifier is set.
+type thresholdMonitor struct {
+	thresholds []*threshold
+	metrics    *metrics
+	notifier   *alertmanagerNotifier
+
+	mu sync.Mutex
+	// breached is the set of breached thresholds per sensor
+	breached map[string]map[string]bool
+}
+
+func newThresholdMonitor(thresholds []*threshold, m *metrics, notifier *alertmanagerNotifier) *thresholdMonitor {
+	return &thresholdMonitor{
+		thresholds: thresholds,
+		metrics:    m,
+		notifier:   notifier,
+		breached:   map[string]map[string]bool{},
+	}
+}
+
+// observeReading checks the successful readings against the thresholds. A
+// failed reading leaves the breaches as they are, but resolves the alerts of
+// the sensor.
+func (m *thresholdMonitor) observeReading(sensor string, r *reading, err error) {
+	if err != nil {
+		m.resolveAlerts(sensor)
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.breached[sensor] == nil {
+		m.breached[sensor] = map[string]bool{}
+	}
+	for _, t := range m.thresholds {
+		applies, breached := t.check(r)
+		if !applies {
+			continue
+		}
+		value := thresholdValues[t.value](r)
+		switch was := m.breached[sensor][t.name]; {
+		case breached && !was:
+			log.Warn("Threshold breached", "sensor", sensor, "threshold", t.name, "range", t.String(), "value", value)
+		case !breached && was:
+			log.Info("Threshold resolved", "sensor", sensor, "threshold", t.name, "range", t.String(), "value", value)
+		}
+		m.breached[sensor][t.name] = breached
+		state := 0.0
+		if breached {
+			state = 1
+		}
+		m.metrics.thresholdBreached.WithLabelValues(sensorLabels(sensor, t.name)...).Set(state)
+		if m.notifier != nil {
+			m.notifier.observe(r, t, breached)
+		}
+	}
+}
+
+// resolveAlerts resolves the Alertmanager alerts of the sensor, e.g. when its
+// values expired.
+func (m *thresholdMonitor) resolveAlerts(sensor string) {
+	if m.notifier != nil {
+		m.notifier.resolveSensor(sensor)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func parseThresholds(t *testing.T, values ...string) ([]*threshold, error) {
+	t.Helper()
+	var specs []thresholdSpec
+	for _, value := range values {
+		var spec thresholdSpec
+		if err := spec.UnmarshalFlag(value); err != nil {
+			t.Fatal(err)
+		}
+		specs = append(specs, spec)
+	}
+	return configureThresholds(specs)
+}
+
+func TestConfigureThresholds(t *testing.T) {
+	tests := []struct {
+		name    string
+		specs   []string
+		want    string
+		wantErr string
+	}{
+		{
+			name:  "min and max",
+			specs: []string{"name=cold,value=temperature,min=2,max=8"},
+			want:  "temperature 2..8 warning",
+		},
+		{
+			name:  "min only with severity",
+			specs: []string{"name=frost,sensor=attic,value=temperature,min=0,severity=critical"},
+			want:  "temperature >= 0 critical",
+		},
+		{
+			name:  "max only",
+			specs: []string{"name=mold,value=humidity,max=70"},
+			want:  "humidity <= 70 warning",
+		},
+		{
+			name:    "missing name",
+			specs:   []string{"value=humidity,max=70"},
+			wantErr: "missing name",
+		},
+		{
+			name:    "duplicate name",
+			specs:   []string{"name=a,value=humidity,max=70", "name=a,value=temperature,max=30"},
+			wantErr: "duplicate name a",
+		},
+		{
+			name:    "unsupported value",
+			specs:   []string{"name=a,value=pressure,max=70"},
+			wantErr: "unsupported value",
+		},
+		{
+			name:    "no bounds",
+			specs:   []string{"name=a,value=humidity"},
+			wantErr: "min or max is required",
+		},
+		{
+			name:    "invalid bound",
+			specs:   []string{"name=a,value=humidity,min=low"},
+			wantErr: "invalid min",
+		},
+		{
+			name:    "min not lower than max",
+			specs:   []string{"name=a,value=humidity,min=70,max=70"},
+			wantErr: "min must be lower than max",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			thresholds, err := parseThresholds(t, tt.specs...)
+			if len(tt.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := thresholds[0].String() + " " + thresholds[0].severity; got != tt.want {
+				t.Errorf("threshold = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestThresholdCheck(t *testing.T) {
+	tests := []struct {
+		name         string
+		spec         string
+		sensor       string
+		temperature  float64
+		humidity     float64
+		wantApplies  bool
+		wantBreached bool
+	}{
+		{name: "inside", spec: "name=t,value=temperature,min=2,max=8", temperature: 5, humidity: 50, wantApplies: true},
+		{name: "below min", spec: "name=t,value=temperature,min=2,max=8", temperature: 1.9, humidity: 50, wantApplies: true, wantBreached: true},
+		{name: "above max", spec: "name=t,value=temperature,min=2,max=8", temperature: 8.1, humidity: 50, wantApplies: true, wantBreached: true},
+		{name: "on the min", spec: "name=t,value=temperature,min=2,max=8", temperature: 2, humidity: 50, wantApplies: true},
+		{name: "on the max", spec: "name=t,value=temperature,min=2,max=8", temperature: 8, humidity: 50, wantApplies: true},
+		{name: "max only", spec: "name=h,value=humidity,max=70", temperature: 20, humidity: 75, wantApplies: true, wantBreached: true},
+		{name: "min only", spec: "name=h,value=humidity,min=30", temperature: 20, humidity: 75, wantApplies: true},
+		{name: "other sensor", spec: "name=t,sensor=cellar,value=temperature,max=8", temperature: 20, humidity: 50},
+		{name: "dew point", spec: "name=d,value=dew-point,max=10", temperature: 20, humidity: 80, wantApplies: true, wantBreached: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			thresholds, err := parseThresholds(t, tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sensor := tt.sensor
+			if len(sensor) == 0 {
+				sensor = "attic"
+			}
+			applies, breached := thresholds[0].check(newReading(sensor, tt.temperature, tt.humidity, 0))
+			if applies != tt.wantApplies || breached != tt.wantBreached {
+				t.Errorf("check = %v, %v, want %v, %v", applies, breached, tt.wantApplies, tt.wantBreached)
+			}
+		})
+	}
+}
+
+func TestThresholdMonitor(t *testing.T) {
+	thresholds, err := parseThresholds(t, "name=cold,value=temperature,min=2,max=8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newMetrics(prometheus.NewRegistry(), "dht", nil, false)
+	monitor := newThresholdMonitor(thresholds, m, nil)
+	// the breach follows every reading, a reading back in the range resolves
+	// it right away
+	steps := []struct {
+		temperature  float64
+		wantBreached bool
+	}{
+		{temperature: 5},
+		{temperature: 9, wantBreached: true},
+		{temperature: 8.5, wantBreached: true},
+		{temperature: 8},
+		{temperature: 1, wantBreached: true},
+		{temperature: 2},
+	}
+	for i, step := range steps {
+		monitor.observeReading("attic", newReading("attic", step.temperature, 50, 0), nil)
+		want := 0.0
+		if step.wantBreached {
+			want = 1
+		}
+		if got := gaugeValue(t, m.thresholdBreached.WithLabelValues("attic", "", "cold")); got != want {
+			t.Errorf("step %d: threshold_breached at %g = %g, want %g", i, step.temperature, got, want)
+		}
+		if got := monitor.breached["attic"]["cold"]; got != step.wantBreached {
+			t.Errorf("step %d: breached at %g = %v, want %v", i, step.temperature, got, step.wantBreached)
+		}
+	}
+	// failed reads leave the state as it is
+	monitor.observeReading("attic", newReading("attic", 0, 50, 0), nil)
+	monitor.observeReading("attic", nil, errTestRead)
+	if got := gaugeValue(t, m.thresholdBreached.WithLabelValues("attic", "", "cold")); got != 1 {
+		t.Errorf("threshold_breached after a failed read = %g, want 1", got)
+	}
+}
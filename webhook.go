@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// webhookQueueSize is the number of readings waiting for delivery. Readings
+// are dropped when the endpoint can't keep up.
+const webhookQueueSize = 100
+
+// webhookReplayInterval is how often the delivery of the buffered readings is
+// attempted while the endpoint is unavailable.
+const webhookReplayInterval = 30 * time.Second
+
+// webhook POSTs every successful reading as JSON to an endpoint.
+type webhook struct {
+	client     *http.Client
+	url        string
+	headers    map[string]string
+	retries    int
+	retryDelay time.Duration
+
+	// mu guards the queue against readings pushed after it was closed, e.g.
+	// over MQTT
+	mu     sync.Mutex
+	closed bool
+	queue  chan *reading
+	done   chan struct{}
+	// ctx is cancelled when the shutdown timeout expires, it interrupts the
+	// delivery in progress
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// buffer keeps the readings that couldn't be delivered until the endpoint
+	// is back, nil when not configured
+	buffer *diskBuffer
+
+	deliveries    prometheus.Counter
+	failures      prometheus.Counter
+	dropped       prometheus.Counter
+	buffered      prometheus.Gauge
+	bufferDropped prometheus.Counter
+}
+
+func (c *serveCommand) newWebhook(reg prometheus.Registerer) (*webhook, error) {
+	factory := promauto.With(reg)
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &webhook{
+		client:     &http.Client{Timeout: c.WebhookTimeout},
+		url:        c.WebhookURL,
+		headers:    c.WebhookHeaders,
+		retries:    int(c.WebhookRetries),
+		retryDelay: c.WebhookRetryDelay,
+		queue:      make(chan *reading, webhookQueueSize),
+		done:       make(chan struct{}),
+		ctx:        ctx,
+		cancel:     cancel,
+		deliveries: factory.NewCounter(prometheus.CounterOpts{
+			Namespace: opts.Metrics.Namespace,
+			Name:      metricName(opts.Metrics.Names, "webhook_deliveries_total"),
+			Help:      "Number of readings delivered to the webhook",
+		}),
+		failures: factory.NewCounter(prometheus.CounterOpts{
+			Namespace: opts.Metrics.Namespace,
+			Name:      metricName(opts.Metrics.Names, "webhook_delivery_failures_total"),
+			Help:      "Number of readings that couldn't be delivered to the webhook after all retries",
+		}),
+		dropped: factory.NewCounter(prometheus.CounterOpts{
+			Namespace: opts.Metrics.Namespace,
+			Name:      metricName(opts.Metrics.Names, "webhook_dropped_total"),
+			Help:      "Number of readings dropped because the webhook queue was full",
+		}),
+	}
+	if len(c.WebhookBufferFile) > 0 {
+		buffer, err := openDiskBuffer(c.WebhookBufferFile, int(c.WebhookBufferSize), c.WebhookBufferDrop == "newest")
+		if err != nil {
+			return nil, fmt.Errorf("unable to open the webhook buffer: %v", err)
+		}
+		w.buffer = buffer
+		w.buffered = factory.NewGauge(prometheus.GaugeOpts{
+			Namespace: opts.Metrics.Namespace,
+			Name:      metricName(opts.Metrics.Names, "webhook_buffered_readings"),
+			Help:      "Number of readings buffered on disk until the webhook is available",
+		})
+		w.bufferDropped = factory.NewCounter(prometheus.CounterOpts{
+			Namespace: opts.Metrics.Namespace,
+			Name:      metricName(opts.Metrics.Names, "webhook_buffer_dropped_total"),
+			Help:      "Number of readings dropped because the webhook buffer was full",
+		})
+		w.buffered.Set(float64(buffer.len()))
+		if buffer.len() > 0 {
+			log.Info("Loaded buffered webhook readings", "file", c.WebhookBufferFile, "readings", buffer.len())
+		}
+	}
+	go w.run()
+	return w, nil
+}
+
+// observeReading queues the successful readings for delivery.
+func (w *webhook) observeReading(_ string, r *reading, err error) {
+	if err != nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	select {
+	case w.queue <- r:
+	default:
+		w.dropped.Inc()
+		log.Warn("Webhook queue is full, dropping reading", "sensor", r.Sensor)
+	}
+}
+
+func (w *webhook) run() {
+	defer close(w.done)
+	var replay <-chan time.Time
+	if w.buffer != nil {
+		defer w.closeBuffer()
+		ticker := time.NewTicker(webhookReplayInterval)
+		defer ticker.Stop()
+		replay = ticker.C
+		w.replay()
+	}
+	for {
+		select {
+		case r, ok := <-w.queue:
+			if !ok {
+				return
+			}
+			w.send(r)
+		case <-replay:
+			w.replay()
+		}
+	}
+}
+
+// send delivers the reading, or buffers it when the buffer isn't empty, so the
+// readings arrive in order, or when the endpoint is unavailable.
+func (w *webhook) send(r *reading) {
+	body, err := json.Marshal(r)
+	if err != nil {
+		w.failures.Inc()
+		log.Error("Unable to encode the webhook reading", "sensor", r.Sensor, "err", err)
+		return
+	}
+	if w.buffer != nil && w.buffer.len() > 0 {
+		w.store(r.Sensor, body)
+		return
+	}
+	retry, err := w.deliver(r.Sensor, body)
+	switch {
+	case err == nil:
+		w.deliveries.Inc()
+	case retry && w.buffer != nil:
+		log.Warn("Webhook delivery failed, buffering the readings until the webhook is available", "sensor", r.Sensor, "url", w.url, "err", err)
+		w.store(r.Sensor, body)
+	default:
+		w.failures.Inc()
+		log.Error("Webhook delivery failed", "sensor", r.Sensor, "url", w.url, "err", err)
+	}
+}
+
+// store appends the reading to the buffer.
+func (w *webhook) store(sensor string, body []byte) {
+	dropped, err := w.buffer.push(body)
+	if dropped {
+		w.bufferDropped.Inc()
+		log.Warn("Webhook buffer is full, dropping reading", "policy", map[bool]string{false: "oldest", true: "newest"}[w.buffer.dropNewest], "sensor", sensor)
+	}
+	if err != nil {
+		w.failures.Inc()
+		log.Error("Unable to buffer the webhook reading", "sensor", sensor, "file", w.buffer.path, "err", err)
+	}
+	w.buffered.Set(float64(w.buffer.len()))
+}
+
+// replay delivers the buffered readings oldest first. It stops at the first
+// failure worth retrying and continues on the next tick, readings queued in
+// the meantime are buffered behind the replayed ones. The delivered readings
+// are removed from the file when it stops.
+func (w *webhook) replay() {
+	if w.buffer.len() == 0 {
+		return
+	}
+	defer func() {
+		if err := w.buffer.sync(); err != nil {
+			log.Error("Unable to update the webhook buffer", "file", w.buffer.path, "err", err)
+		}
+	}()
+	log.Info("Delivering buffered webhook readings", "readings", w.buffer.len())
+	delivered := 0
+	for w.buffer.len() > 0 && !w.isClosed() {
+		retry, err := w.post(w.buffer.peek())
+		if err != nil && retry {
+			log.Info("Webhook is still unavailable", "delivered", delivered, "buffered", w.buffer.len(), "err", err)
+			return
+		}
+		if err != nil {
+			w.failures.Inc()
+			log.Error("Webhook rejected a buffered reading", "url", w.url, "err", err)
+		} else {
+			w.deliveries.Inc()
+			delivered++
+		}
+		if err := w.buffer.pop(); err != nil {
+			log.Error("Unable to update the webhook buffer", "file", w.buffer.path, "err", err)
+		}
+		w.buffered.Set(float64(w.buffer.len()))
+		w.bufferQueued()
+	}
+	log.Info("Delivered buffered webhook readings", "delivered", delivered, "buffered", w.buffer.len())
+}
+
+// bufferQueued moves the queued readings to the buffer, so the queue doesn't
+// overflow while a long outage is replayed.
+func (w *webhook) bufferQueued() {
+	for {
+		select {
+		case r, ok := <-w.queue:
+			if !ok {
+				return
+			}
+			body, err := json.Marshal(r)
+			if err != nil {
+				w.failures.Inc()
+				continue
+			}
+			w.store(r.Sensor, body)
+		default:
+			return
+		}
+	}
+}
+
+func (w *webhook) isClosed() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.closed
+}
+
+// closeBuffer writes the buffered readings, they are delivered after the
+// exporter starts again.
+func (w *webhook) closeBuffer() {
+	if w.buffer.len() > 0 {
+		log.Info("Keeping the undelivered webhook readings in the buffer", "file", w.buffer.path, "readings", w.buffer.len())
+	}
+	if err := w.buffer.close(); err != nil {
+		log.Error("Unable to write the webhook buffer", "file", w.buffer.path, "err", err)
+	}
+}
+
+// deliver POSTs the body, retrying with an exponential backoff on network
+// errors, 429 and 5xx responses. It reports whether the last failure was worth
+// retrying.
+func (w *webhook) deliver(sensor string, body []byte) (retry bool, err error) {
+	delay := w.retryDelay
+	for attempt := 0; ; attempt++ {
+		retry, err := w.post(body)
+		if err == nil {
+			return false, nil
+		}
+		if !retry || attempt >= w.retries {
+			return retry, err
+		}
+		log.Debug("Webhook delivery attempt failed", "sensor", sensor, "attempt", attempt+1, "err", err)
+		select {
+		case <-w.ctx.Done():
+			return true, err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// post sends the body once and reports whether a failure is worth retrying.
+func (w *webhook) post(body []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(w.ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-dht-prometheus/"+version)
+	for name, value := range w.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("webhook returned %s", resp.Status)
+	default:
+		return false, fmt.Errorf("webhook returned %s", resp.Status)
+	}
+}
+
+// closer delivers the queued readings before the exporter exits. Once the
+// context is done the remaining readings are buffered without delivery, or
+// dropped without a buffer.
+func (w *webhook) closer() outputCloser {
+	return outputCloser{
+		name: "webhook",
+		close: func(ctx context.Context) error {
+			w.mu.Lock()
+			w.closed = true
+			close(w.queue)
+			w.mu.Unlock()
+			select {
+			case <-w.done:
+				return nil
+			case <-ctx.Done():
+			}
+			pending := len(w.queue)
+			w.cancel()
+			<-w.done
+			return fmt.Errorf("%d readings not delivered: %v", pending, ctx.Err())
+		},
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// webhookServer answers the webhook requests with the statuses in order and
+// records the delivered readings.
+type webhookServer struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	statuses  []int
+	attempts  int
+	delivered []reading
+}
+
+func newWebhookServer(t *testing.T, statuses ...int) *webhookServer {
+	s := &webhookServer{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		status := http.StatusNoContent
+		if s.attempts < len(s.statuses) {
+			status = s.statuses[s.attempts]
+		}
+		s.attempts++
+		if status < 300 {
+			var delivered reading
+			if err := json.NewDecoder(r.Body).Decode(&delivered); err != nil {
+				t.Errorf("invalid webhook body: %v", err)
+			}
+			s.delivered = append(s.delivered, delivered)
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func newTestWebhook(t *testing.T, url string, retries uint, bufferFile string) *webhook {
+	c := &serveCommand{
+		WebhookURL:        url,
+		WebhookTimeout:    time.Second,
+		WebhookRetries:    retries,
+		WebhookRetryDelay: time.Millisecond,
+		WebhookBufferFile: bufferFile,
+		WebhookBufferSize: 10,
+		WebhookBufferDrop: "oldest",
+	}
+	w, err := c.newWebhook(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func TestWebhookDeliver(t *testing.T) {
+	tests := []struct {
+		name         string
+		retries      uint
+		statuses     []int
+		wantAttempts int
+		wantErr      bool
+		wantRetry    bool
+	}{
+		{name: "delivered", retries: 3, statuses: []int{http.StatusOK}, wantAttempts: 1},
+		{name: "retried server error", retries: 3, statuses: []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusOK}, wantAttempts: 3},
+		{name: "retried rate limit", retries: 3, statuses: []int{http.StatusTooManyRequests, http.StatusAccepted}, wantAttempts: 2},
+		{name: "client error not retried", retries: 3, statuses: []int{http.StatusBadRequest}, wantAttempts: 1, wantErr: true},
+		{name: "out of retries", retries: 2, statuses: []int{500, 500, 500, 500}, wantAttempts: 3, wantErr: true, wantRetry: true},
+		{name: "no retries", retries: 0, statuses: []int{500, http.StatusOK}, wantAttempts: 1, wantErr: true, wantRetry: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newWebhookServer(t, tt.statuses...)
+			w := newTestWebhook(t, server.URL, tt.retries, "")
+			defer w.closer().close(context.Background())
+			body, err := json.Marshal(newReading("attic", 21.5, 40, 1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			retry, err := w.deliver("attic", body)
+			if (err != nil) != tt.wantErr || retry != tt.wantRetry {
+				t.Errorf("got error %v and retry %v, want error %v and retry %v", err, retry, tt.wantErr, tt.wantRetry)
+			}
+			if server.attempts != tt.wantAttempts {
+				t.Errorf("got %d attempts, want %d", server.attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestWebhookCloserDeliversQueuedReadings(t *testing.T) {
+	server := newWebhookServer(t, http.StatusInternalServerError)
+	w := newTestWebhook(t, server.URL, 1, "")
+	w.observeReading("attic", newReading("attic", 21.5, 40, 0), nil)
+	w.observeReading("attic", nil, errors.New("CRCs doesn't match"))
+	w.observeReading("cellar", newReading("cellar", 15, 70, 0), nil)
+	if err := w.closer().close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(server.delivered) != 2 || server.delivered[0].Sensor != "attic" || server.delivered[1].Sensor != "cellar" {
+		t.Errorf("got delivered readings %+v, want attic and cellar", server.delivered)
+	}
+	if got := testutil.ToFloat64(w.deliveries); got != 2 {
+		t.Errorf("got %g deliveries, want 2", got)
+	}
+	// readings observed after the close are ignored
+	w.observeReading("attic", newReading("attic", 22, 41, 0), nil)
+}
+
+func TestWebhookBufferReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webhook.jsonl")
+
+	// the endpoint is down, the closer keeps the readings in the buffer file
+	down := newWebhookServer(t, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	w := newTestWebhook(t, down.URL, 0, path)
+	w.observeReading("attic", newReading("attic", 21.5, 40, 0), nil)
+	w.observeReading("cellar", newReading("cellar", 15, 70, 0), nil)
+	w.observeReading("garage", newReading("garage", 8, 80, 0), nil)
+	if err := w.closer().close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(down.delivered) != 0 {
+		t.Errorf("got delivered readings %+v, want none", down.delivered)
+	}
+	if got := readBufferFile(t, path); len(got) != 3 {
+		t.Fatalf("got %d buffered readings, want 3", len(got))
+	}
+
+	// the buffered readings are replayed in order after a restart
+	up := newWebhookServer(t)
+	w = newTestWebhook(t, up.URL, 0, path)
+	if got := testutil.ToFloat64(w.buffered); got != 3 {
+		t.Errorf("got %g buffered readings after the restart, want 3", got)
+	}
+	// the replay stops when the webhook is closed, wait until it's done
+	for deadline := time.Now().Add(5 * time.Second); testutil.ToFloat64(w.buffered) > 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("the buffered readings weren't replayed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	w.observeReading("attic", newReading("attic", 22, 41, 0), nil)
+	if err := w.closer().close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range up.delivered {
+		got = append(got, r.Sensor)
+	}
+	if want := []string{"attic", "cellar", "garage", "attic"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got delivered readings of %v, want %v", got, want)
+	}
+	if got := readBufferFile(t, path); len(got) != 0 {
+		t.Errorf("got buffered readings %v, want none", got)
+	}
+}